@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/pipeline/calculate"
+	"github.com/lab5e/aqserver/pkg/pipeline/convert"
+	"github.com/lab5e/aqserver/pkg/pipeline/pmcalc"
+	"github.com/lab5e/aqserver/pkg/store"
+)
+
+// newCalcChain creates the calculation stages shared by all commands
+// that compute values.  It returns the first and the last stage of the
+// chain so that it can be linked into a pipeline.
+func newCalcChain(db store.Store) (*calculate.Calculate, pipeline.Pipeline) {
+	calc := calculate.New(db)
+
+	pm, err := pmcalc.New(pmConfig())
+	if err != nil {
+		log.Fatalf("Invalid PM calculation parameters: %v", err)
+	}
+
+	conv, err := convert.New(conversionConfig())
+	if err != nil {
+		log.Fatalf("Invalid unit conversion parameters: %v", err)
+	}
+
+	calc.AddNext(pm)
+	pm.AddNext(conv)
+	return calc, conv
+}
+
+// conversionConfig returns the unit conversion parameters given on
+// the command line.
+func conversionConfig() model.ConversionConfig {
+	return model.ConversionConfig{
+		Pressure:           opt.Pressure,
+		StandardConditions: opt.StandardConditions,
+		TemperatureSource:  opt.TemperatureSource,
+	}
+}
+
+// pmConfig returns the PM calculation parameters given on the command
+// line.
+func pmConfig() model.PMConfig {
+	cfg := model.DefaultPMConfig()
+	cfg.ParticleDensity = opt.ParticleDensity
+	cfg.Kappa = opt.Kappa
+
+	if opt.OPCBinBoundaries != "" {
+		var boundaries []float64
+		for _, s := range strings.Split(opt.OPCBinBoundaries, ",") {
+			b, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				log.Fatalf("Invalid OPC bin boundary '%s': %v", s, err)
+			}
+			boundaries = append(boundaries, b)
+		}
+		cfg.BinBoundaries = boundaries
+	}
+	return cfg
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// boardsCmd lists the device board registry, showing which board was
+// installed in which device when.
+type boardsCmd struct {
+	DeviceID string `long:"device" description:"Only show history for this device" value-name:"<deviceID>"`
+	SysID    uint64 `long:"sysid" description:"Only show history for this board" value-name:"<sysID>"`
+}
+
+// Execute ...
+func (a *boardsCmd) Execute(_ []string) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	boards, err := db.ListDeviceBoards()
+	if err != nil {
+		log.Fatalf("Unable to list device board registry: %v", err)
+	}
+
+	fmt.Print("\n---------------------------------------------------------------------------\n")
+	fmt.Print("   ID        DeviceID                 SysID  ValidFrom             ValidTo\n")
+	fmt.Print("---------------------------------------------------------------------------\n")
+	for _, b := range boards {
+		if (a.DeviceID != "" && b.DeviceID != a.DeviceID) || (a.SysID != 0 && b.SysID != a.SysID) {
+			continue
+		}
+
+		to := "-"
+		if b.ValidTo != nil {
+			to = b.ValidTo.Format(layout)
+		}
+		fmt.Printf(" %4d  %14s  %20d  %20s  %20s\n", b.ID, b.DeviceID, b.SysID, b.ValidFrom.Format(layout), to)
+	}
+	fmt.Print("---------------------------------------------------------------------------\n\n")
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+)
+
+// maxCals is the maximum number of calibration entries we check.
+const maxCals = 100000
+
+// calCmd groups the calibration data subcommands.
+type calCmd struct {
+	Check calCheckCmd `command:"check" description:"report gaps and overlaps in calibration validity"`
+}
+
+// calCheckCmd reports gaps and overlaps in the calibration data.
+type calCheckCmd struct {
+	DeviceID string `long:"device" description:"Only check this device" value-name:"<deviceID>"`
+}
+
+// Execute ...
+func (a *calCheckCmd) Execute(_ []string) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var cals []model.Cal
+	if a.DeviceID != "" {
+		cals, err = db.ListCalsForDevice(a.DeviceID)
+	} else {
+		cals, err = db.ListCals(0, maxCals)
+	}
+	if err != nil {
+		log.Fatalf("Unable to list calibration data: %v", err)
+	}
+
+	issues := model.CheckCals(cals, time.Now())
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+
+	log.Printf("checked %d calibration entries, found %d issues", len(cals), len(issues))
+	return nil
+}
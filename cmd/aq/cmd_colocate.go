@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lab5e/aqserver/pkg/colocate"
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline/calculate"
+)
+
+// colocateCmd fits a correction for a device against reference
+// station data.
+type colocateCmd struct {
+	DeviceID    string        `long:"device" description:"Device ID" required:"yes" value-name:"<deviceID>"`
+	Reference   string        `long:"reference" description:"Reference data CSV file" required:"yes" value-name:"<file>"`
+	Component   string        `long:"component" description:"Component the reference data measures" choice:"no2" choice:"o3" choice:"no" required:"yes"`
+	From        string        `long:"from" description:"Only use data at or after this time (default start of reference data)" value-name:"<YYYY-MM-DD|RFC3339>"`
+	To          string        `long:"to" description:"Only use data before this time (default end of reference data)" value-name:"<YYYY-MM-DD|RFC3339>"`
+	ValidFrom   string        `long:"valid-from" description:"When the correction becomes valid (default --from)" value-name:"<YYYY-MM-DD|RFC3339>"`
+	Separator   string        `long:"separator" description:"Field separator in reference data" default:"," value-name:"<char>"`
+	TimeColumn  string        `long:"time-column" description:"Reference column holding the start of each period" default:"time" value-name:"<name>"`
+	ValueColumn string        `long:"value-column" description:"Reference column holding the value" default:"value" value-name:"<name>"`
+	TimeLayout  string        `long:"time-layout" description:"Go time layout of the reference timestamps (default RFC3339)" value-name:"<layout>"`
+	Unit        string        `long:"unit" description:"Unit of the reference values" choice:"ugm3" choice:"ppb" default:"ugm3"`
+	Interval    time.Duration `long:"interval" description:"Averaging period of the reference data" default:"1h" value-name:"<duration>"`
+	MinMessages int           `long:"min-messages" description:"Minimum number of device messages in a period for it to be used" default:"1" value-name:"<n>"`
+	DryRun      bool          `long:"dry-run" description:"Fit and report the correction without storing it"`
+}
+
+// componentMolarMass maps components to their molar mass.
+var componentMolarMass = map[string]float64{
+	model.ComponentNO2: model.MolarMassNO2,
+	model.ComponentO3:  model.MolarMassO3,
+	model.ComponentNO:  model.MolarMassNO,
+}
+
+// Execute ...
+func (a *colocateCmd) Execute(_ []string) error {
+	separator, size := utf8.DecodeRuneInString(a.Separator)
+	if size == 0 || size != len(a.Separator) {
+		return fmt.Errorf("--separator must be a single character")
+	}
+
+	f, err := os.Open(a.Reference)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	refs, err := colocate.ReadReference(f, colocate.ReferenceFormat{
+		Separator:   separator,
+		TimeColumn:  a.TimeColumn,
+		ValueColumn: a.ValueColumn,
+		TimeLayout:  a.TimeLayout,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to read reference data from '%s': %v", a.Reference, err)
+	}
+
+	// Reference stations usually report ug/m3 at standard conditions
+	if a.Unit == "ugm3" {
+		factor := model.PPBToUGM3(1.0, componentMolarMass[a.Component], model.StandardPressure, model.StandardTemperature)
+		for i := range refs {
+			refs[i].Value /= factor
+		}
+	}
+
+	from := refs[0].Time.UnixMilli()
+	to := refs[len(refs)-1].Time.Add(a.Interval).UnixMilli()
+	if a.From != "" {
+		from, err = parseTimestamp(a.From)
+		if err != nil {
+			return err
+		}
+	}
+	if a.To != "" {
+		to, err = parseTimestamp(a.To)
+		if err != nil {
+			return err
+		}
+	}
+
+	validFrom := from
+	if a.ValidFrom != "" {
+		validFrom, err = parseTimestamp(a.ValidFrom)
+		if err != nil {
+			return err
+		}
+	}
+
+	db, err := getDB()
+	if err != nil {
+		log.Fatalf("Unable to open or create database file '%s': %v", opt.DBFilename, err)
+	}
+	defer db.Close()
+
+	msgs, err := db.ListDeviceMessagesByDate(a.DeviceID, from, to)
+	if err != nil {
+		return err
+	}
+
+	// Recalculate without corrections so that existing corrections
+	// do not affect the fit.
+	calc := calculate.New(db)
+	calc.SetApplyCorrections(false)
+	for i := range msgs {
+		err := calc.Publish(context.Background(), &msgs[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	samples, err := colocate.Align(refs, msgs, a.Component, a.Interval, a.MinMessages)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("aligned %d reference values with %d messages from device='%s' into %d samples", len(refs), len(msgs), a.DeviceID, len(samples))
+
+	c, err := model.FitCorrection(samples)
+	if err != nil {
+		return err
+	}
+
+	c.DeviceID = a.DeviceID
+	c.Component = a.Component
+	c.ValidFrom = time.UnixMilli(validFrom).UTC()
+	c.Created = time.Now().UTC()
+
+	log.Printf("%s = %.4f + %.4f*ppb + %.4f*temp + %.4f*hum  (R2=%.3f, n=%d)", c.Component, c.Intercept, c.PPBCoef, c.TempCoef, c.HumCoef, c.R2, c.Samples)
+
+	if a.DryRun {
+		return nil
+	}
+
+	id, err := db.PutCorrection(c)
+	if err != nil {
+		return err
+	}
+	log.Printf("stored correction %d, valid from %s", id, formatTimestamp(validFrom))
+	return nil
+}
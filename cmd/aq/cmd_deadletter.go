@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/pipeline/builder"
+	"github.com/lab5e/aqserver/pkg/pipeline/retry"
+)
+
+// deadLetterCmd groups the dead letter subcommands.
+type deadLetterCmd struct {
+	List   deadLetterListCmd   `command:"list" description:"list messages the pipeline gave up on"`
+	Replay deadLetterReplayCmd `command:"replay" description:"pass dead letters through the pipeline again"`
+}
+
+// deadLetterListCmd lists dead letters.
+type deadLetterListCmd struct {
+	DeviceID string `long:"device" description:"Only list dead letters for this device" value-name:"<deviceID>"`
+}
+
+// deadLetterReplayCmd replays dead letters into the stage that gave up
+// on them.  Dead letters that make it through are deleted.
+type deadLetterReplayCmd struct {
+	IDs            []int64 `long:"id" description:"Only replay this dead letter.  May be repeated" value-name:"<id>"`
+	DeviceID       string  `long:"device" description:"Only replay dead letters for this device" value-name:"<deviceID>"`
+	Stage          string  `long:"stage" description:"Replay into this stage instead of the stage that gave up" value-name:"<name>"`
+	PipelineConfig string  `long:"pipeline-config" description:"YAML or JSON file describing the pipeline stages (default built in pipeline)" value-name:"<file>"`
+
+	// MQTT
+	MQTTAddress     string `long:"mqtt-address" description:"MQTT Address" default:"" value-name:"<[host]:port>"`
+	MQTTClientID    string `long:"mqtt-client-id" env:"MQTT_CLIENT_ID" description:"MQTT Client ID" default:""`
+	MQTTPassword    string `long:"mqtt-password" env:"MQTT_PASSWORD" description:"MQTT Password" default:""`
+	MQTTTopicPrefix string `long:"mqtt-topic-prefix" description:"MQTT topic prefix" default:"aq" value-name:"MQTT topic prefix"`
+}
+
+// Execute ...
+func (a *deadLetterListCmd) Execute(_ []string) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	letters, err := db.ListDeadLetters()
+	if err != nil {
+		log.Fatalf("Unable to list dead letters: %v", err)
+	}
+
+	fmt.Print("\n---------------------------------------------------------------------------\n")
+	fmt.Print("   ID  Created               DeviceID        Stage       Attempts  Reason\n")
+	fmt.Print("---------------------------------------------------------------------------\n")
+	for _, d := range letters {
+		if a.DeviceID != "" && d.DeviceID != a.DeviceID {
+			continue
+		}
+		fmt.Printf(" %4d  %20s  %14s  %10s  %8d  %s\n", d.ID, d.Created.Format(layout), d.DeviceID, d.Stage, d.Attempts, d.Reason)
+	}
+	fmt.Print("---------------------------------------------------------------------------\n\n")
+	return nil
+}
+
+// Execute ...
+func (a *deadLetterReplayCmd) Execute(_ []string) error {
+	db, err := getDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	cfg := builder.DefaultConfig(a.MQTTAddress != "")
+	if a.PipelineConfig != "" {
+		cfg, err = builder.ReadConfig(a.PipelineConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	built, err := builder.Build(cfg, &builder.Env{
+		DB:         db,
+		PM:         pmConfig(),
+		Conversion: conversionConfig(),
+		MQTT: builder.MQTTOptions{
+			Address:     a.MQTTAddress,
+			ClientID:    a.MQTTClientID,
+			Password:    a.MQTTPassword,
+			TopicPrefix: a.MQTTTopicPrefix,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("invalid pipeline: %v", err)
+	}
+
+	ctx := context.Background()
+	err = built.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	letters, err := db.ListDeadLetters()
+	if err != nil {
+		log.Fatalf("Unable to list dead letters: %v", err)
+	}
+
+	ids := make(map[int64]bool)
+	for _, id := range a.IDs {
+		ids[id] = true
+	}
+
+	replayed := 0
+	failed := 0
+	for _, d := range letters {
+		if (len(ids) > 0 && !ids[d.ID]) || (a.DeviceID != "" && d.DeviceID != a.DeviceID) {
+			continue
+		}
+
+		err := a.replay(ctx, built, &d)
+		if err != nil {
+			log.Printf("dead letter %d failed again: %v", d.ID, err)
+			failed++
+			continue
+		}
+
+		err = db.DeleteDeadLetter(d.ID)
+		if err != nil {
+			log.Fatalf("Unable to delete dead letter %d: %v", d.ID, err)
+		}
+		replayed++
+	}
+
+	log.Printf("replayed %d dead letters, %d failed", replayed, failed)
+	return built.Stop(ctx)
+}
+
+// replay passes a dead letter to its stage.  If the stage is a retry
+// stage we go directly to the stage after it, since the retry stage
+// would just store it as a dead letter again if it fails.
+func (a *deadLetterReplayCmd) replay(ctx context.Context, built *builder.Built, d *model.DeadLetter) error {
+	name := d.Stage
+	if a.Stage != "" {
+		name = a.Stage
+	}
+
+	var stage pipeline.Pipeline = built.Stages[name]
+	if stage == nil {
+		return fmt.Errorf("stage '%s' is not part of the pipeline", name)
+	}
+	if r, ok := stage.(*retry.Retry); ok {
+		stage = r.Next()
+	}
+
+	m, err := d.DecodeMessage()
+	if err != nil {
+		return err
+	}
+
+	if stage == nil {
+		return nil
+	}
+	return stage.Publish(ctx, m)
+}
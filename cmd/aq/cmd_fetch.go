@@ -1,108 +1,181 @@
 package main
 
 import (
-	"encoding/base64"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
-	"strconv"
 	"time"
 
+	"github.com/lab5e/aqserver/pkg/caldata"
 	"github.com/lab5e/aqserver/pkg/model"
 	"github.com/lab5e/aqserver/pkg/pipeline"
-	"github.com/lab5e/aqserver/pkg/pipeline/calculate"
 	"github.com/lab5e/aqserver/pkg/pipeline/persist"
-	"github.com/lab5e/go-spanapi/v4"
-	"github.com/lab5e/go-spanapi/v4/apitools"
+	"github.com/lab5e/aqserver/pkg/pipeline/registry"
+	"github.com/lab5e/aqserver/pkg/spanlistener"
+	"github.com/lab5e/aqserver/pkg/store"
 )
 
+// checkpointInterval is how many messages we fetch between each time
+// we write the fetch checkpoint.
+const checkpointInterval = 200
+
 // fetchCmd fetches backlog of data
-type fetchCmd struct{}
+type fetchCmd struct {
+	Since  string `long:"since" description:"Only fetch messages received at or after this time" value-name:"<YYYY-MM-DD|RFC3339>"`
+	Until  string `long:"until" description:"Only fetch messages received before this time" value-name:"<YYYY-MM-DD|RFC3339>"`
+	DryRun bool   `long:"dry-run" description:"Report how many messages would be new without storing anything"`
+}
 
 // Execute ...
 func (a *fetchCmd) Execute(_ []string) error {
+	since, err := parseTimestamp(a.Since)
+	if err != nil {
+		return err
+	}
+
+	until, err := parseTimestamp(a.Until)
+	if err != nil {
+		return err
+	}
+
 	db, err := getDB()
 	if err != nil {
 		log.Fatalf("Unable to open or create database file '%s': %v", opt.DBFilename, err)
 	}
 	defer db.Close()
 
+	cp, err := db.GetFetchCheckpoint(opt.SpanCollectionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		cp = &model.FetchCheckpoint{CollectionID: opt.SpanCollectionID}
+	} else if err != nil {
+		return err
+	}
+
+	// Unless told otherwise we only fetch what has arrived since the
+	// last completed fetch.  We fix the upper bound so that data
+	// arriving while we fetch does not shift the paging, which
+	// makes it possible to resume with the same bounds.
+	if a.Since == "" {
+		since = cp.HighWater
+		if since > 0 {
+			since++
+		}
+	}
+
+	opts := spanlistener.FetchOptions{Since: since, Until: until}
+	if until == 0 {
+		opts.Until = time.Now().UnixMilli()
+	}
+
+	// Resume if there is an interrupted fetch with matching bounds.
+	// Bounds that are not given match whatever was in progress.
+	if cp.Offset != "" && (a.Since == "" || since == cp.Since) && (a.Until == "" || until == cp.Until) {
+		opts = spanlistener.FetchOptions{Since: cp.Since, Until: cp.Until, Offset: cp.Offset}
+		log.Printf("resuming interrupted fetch after message %s", cp.Offset)
+	}
+
+	log.Printf("fetching collection='%s' since=%s until=%s", opt.SpanCollectionID, formatTimestamp(opts.Since), formatTimestamp(opts.Until))
+
+	if a.DryRun {
+		return a.dryRun(db, opts)
+	}
+
+	pipelineRegistry, err := registry.New(db)
+	if err != nil {
+		log.Fatalf("Unable to load device board registry: %v", err)
+	}
+
 	// Load the calibration data from dir to ensure we have latest
-	loadCalibrationData(db, opt.CalibrationDataDir)
+	caldata.Load(db, pipelineRegistry, opt.CalibrationDataDir)
 
 	// Set up pipeline
 	pipelineRoot := pipeline.New(db)
-	pipelineCalc := calculate.New(db)
+	pipelineCalc, pipelineCalcLast := newCalcChain(db)
 	pipelinePersist := persist.New(db)
 
-	pipelineRoot.AddNext(pipelineCalc)
-	pipelineCalc.AddNext(pipelinePersist)
-
-	config := spanapi.NewConfiguration()
-	client := spanapi.NewAPIClient(config)
+	pipelineRoot.AddNext(pipelineRegistry)
+	pipelineRegistry.AddNext(pipelineCalc)
+	pipelineCalcLast.AddNext(pipelinePersist)
 
-	ctx := apitools.ContextWithAuth(opt.SpanAPIToken)
+	cp.Since = opts.Since
+	cp.Until = opts.Until
 
-	lastMessageID := ""
+	var newest int64
 	count := 0
 	totalCount := 0
-	for {
-		items, _, err := client.CollectionsApi.ListCollectionData(ctx, opt.SpanCollectionID).
-			Offset(lastMessageID).
-			Limit(200).
-			Execute()
+	err = spanlistener.FetchData(opt.SpanAPIToken, opt.SpanCollectionID, opts, func(m *model.Message) error {
+		// Stop rather than skip messages that could not be stored, so
+		// that the fetch can be resumed from the last checkpoint.
+		err := pipelineRoot.Publish(context.Background(), m)
 		if err != nil {
-			log.Printf("list collections error: %v", err)
-			return err
+			return fmt.Errorf("unable to process message %s: %v", m.MessageID, err)
 		}
+		count++
+		totalCount++
 
-		if len(items.Data) == 0 {
-			log.Printf("done, fetched %d data points", totalCount)
-			return nil
+		if m.ReceivedTime > newest {
+			newest = m.ReceivedTime
 		}
 
-		for _, item := range items.Data {
-			lastMessageID = *item.MessageId
-			received, err := strconv.ParseInt(*item.Received, 10, 64)
-			if err != nil {
-				log.Printf("Error converting timestamp string (%s): %v", *item.Received, err)
-				received = timeToMilliseconds(time.Now())
-			}
-
-			bytes, err := base64.StdEncoding.DecodeString(*item.Payload)
-			if err != nil {
-				log.Printf("error base64-decoding payload='%s': %v", *item.Payload, err)
-				continue
-			}
-
-			pb, err := model.ProtobufFromData(bytes)
-			if err != nil {
-				log.Printf("error protobuf-decoding payload='%s': %v", *item.Payload, err)
-				continue
-			}
-
-			message := model.MessageFromProtobuf(pb)
-			message.DeviceID = *item.Device.DeviceId
-			message.ReceivedTime = received
-			message.PacketSize = len(bytes)
-
-			pipelineRoot.Publish(message)
-			count++
-			totalCount++
+		if totalCount%checkpointInterval == 0 {
+			cp.Offset = m.MessageID
+			a.saveCheckpoint(db, cp)
 		}
+
 		if count >= 1000 {
 			count = 0
-			lastItem := items.Data[len(items.Data)-1]
-
-			lastTimestamp := ""
-			lastReceivedMS, err := strconv.ParseInt(*lastItem.Received, 10, 64)
-			if err == nil {
-				lastTimestamp = time.UnixMilli(lastReceivedMS).Format(time.RFC3339)
-			}
-			log.Printf(" - fetched %d (%s)", totalCount, lastTimestamp)
+			log.Printf(" - fetched %d (%s)", totalCount, formatTimestamp(m.ReceivedTime))
 		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("list collections error: %v", err)
+		return err
+	}
+
+	// The fetch completed so there is nothing to resume
+	cp.Offset = ""
+	if newest > cp.HighWater {
+		cp.HighWater = newest
+	}
+	a.saveCheckpoint(db, cp)
+
+	log.Printf("done, fetched %d data points, skipped %d duplicates", totalCount, pipelinePersist.Duplicates())
+	return nil
+}
+
+// dryRun pages through the data and reports how many of the messages
+// are not already in the database.
+func (a *fetchCmd) dryRun(db store.Store, opts spanlistener.FetchOptions) error {
+	total := 0
+	newMessages := 0
+	err := spanlistener.FetchData(opt.SpanAPIToken, opt.SpanCollectionID, opts, func(m *model.Message) error {
+		total++
 
+		exists, err := db.MessageExists(m.DeviceID, m.MessageID)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			newMessages++
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("list collections error: %v", err)
+		return err
 	}
+
+	log.Printf("dry run: %d messages in range, %d would be new", total, newMessages)
+	return nil
 }
 
-func timeToMilliseconds(t time.Time) int64 {
-	return t.UnixNano() / int64(time.Millisecond)
+func (a *fetchCmd) saveCheckpoint(db store.Store, cp *model.FetchCheckpoint) {
+	cp.Updated = time.Now().UnixMilli()
+	err := db.PutFetchCheckpoint(cp)
+	if err != nil {
+		log.Printf("Error saving fetch checkpoint: %v", err)
+	}
 }
@@ -13,10 +13,15 @@ import (
 type importCmd struct {
 	CalFetch bool   `short:"f" long:"fetch-cal" description:"Fetch calibration data from network"`
 	CalURL   string `short:"u" long:"cal-url" description:"Distribution URL for calibration data" default:""`
+	Recalc   bool   `long:"recalc" description:"Recalculate stored messages covered by the imported calibration data"`
 }
 
 const (
 	layout = "2006-01-02T15:04:05.000Z"
+
+	// recalcBatchSize is the batch size used when recalculating
+	// after import.
+	recalcBatchSize = 500
 )
 
 // Execute runs the import command.
@@ -57,6 +62,12 @@ func (a *importCmd) importFiles(files []string) {
 			continue
 		}
 
+		err = cal.Validate()
+		if err != nil {
+			log.Printf("Invalid calibration data in %s, skipping: %v", fileName, err)
+			continue
+		}
+
 		// Override CollectionID if parameter is non-empty
 		if opt.SpanCollectionID != "" {
 			cal.CollectionID = opt.SpanCollectionID
@@ -68,5 +79,13 @@ func (a *importCmd) importFiles(files []string) {
 		}
 
 		log.Printf("Imported %s, CollectionID='%s', deviceID='%s', ID='%d'", fileName, cal.CollectionID, cal.DeviceID, id)
+
+		if a.Recalc {
+			cal.ID = id
+			err = recalcForCal(db, &cal, recalcBatchSize)
+			if err != nil {
+				log.Printf("Error recalculating messages for %s: %v", fileName, err)
+			}
+		}
 	}
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/store"
+)
+
+// recalcCmd recomputes the derived values of stored messages, typically
+// after calibration data has been added or corrected.
+type recalcCmd struct {
+	CalID     int64  `long:"cal-id" description:"Recalculate the messages covered by this calibration entry" value-name:"<id>"`
+	DeviceID  string `long:"device" description:"Device ID" value-name:"<deviceID>"`
+	From      string `long:"from" description:"Recalculate messages received at or after this time" value-name:"<YYYY-MM-DD|RFC3339>"`
+	To        string `long:"to" description:"Recalculate messages received before this time (default now)" value-name:"<YYYY-MM-DD|RFC3339>"`
+	BatchSize int    `long:"batch-size" description:"Number of messages updated per transaction" default:"500" value-name:"<n>"`
+}
+
+// Execute ...
+func (a *recalcCmd) Execute(_ []string) error {
+	if a.BatchSize < 1 {
+		return fmt.Errorf("--batch-size must be positive")
+	}
+
+	if (a.CalID == 0) == (a.DeviceID == "") {
+		return fmt.Errorf("specify either --cal-id or --device")
+	}
+
+	db, err := getDB()
+	if err != nil {
+		log.Fatalf("Unable to open or create database file '%s': %v", opt.DBFilename, err)
+	}
+	defer db.Close()
+
+	if a.CalID != 0 {
+		cal, err := db.GetCal(a.CalID)
+		if err != nil {
+			return fmt.Errorf("unable to get calibration entry %d: %v", a.CalID, err)
+		}
+		return recalcForCal(db, cal, a.BatchSize)
+	}
+
+	from, err := parseTimestamp(a.From)
+	if err != nil {
+		return err
+	}
+
+	to, err := parseTimestamp(a.To)
+	if err != nil {
+		return err
+	}
+	if to == 0 {
+		to = time.Now().UnixMilli()
+	}
+
+	if to <= from {
+		return fmt.Errorf("--to must be after --from")
+	}
+
+	return recalc(db, a.DeviceID, from, to, a.BatchSize)
+}
+
+// recalcForCal recalculates the messages that cal applies to, which
+// are those received from cal.ValidFrom until cal.ValidTo or the next
+// calibration entry for the same device becomes valid.
+func recalcForCal(db store.Store, cal *model.Cal, batchSize int) error {
+	cals, err := db.ListCalsForDevice(cal.DeviceID)
+	if err != nil {
+		return err
+	}
+
+	from := cal.ValidFrom.UnixMilli()
+	to := time.Now().UnixMilli()
+	if cal.ValidTo != nil && cal.ValidTo.UnixMilli() < to {
+		to = cal.ValidTo.UnixMilli()
+	}
+	for _, c := range cals {
+		if c.ID == cal.ID || c.SysID != cal.SysID {
+			continue
+		}
+
+		validFrom := c.ValidFrom.UnixMilli()
+		if validFrom > from && validFrom < to {
+			to = validFrom
+		}
+	}
+
+	log.Printf("recalculating device='%s' from %s to %s using calibration entry %d", cal.DeviceID, formatTimestamp(from), formatTimestamp(to), cal.ID)
+	return recalc(db, cal.DeviceID, from, to, batchSize)
+}
+
+// recalc recomputes the derived values for messages from deviceID
+// received in [from:to> and writes them back to the database.
+func recalc(db store.Store, deviceID string, from int64, to int64, batchSize int) error {
+	calc, _ := newCalcChain(db)
+
+	stats, err := rewriteDeviceMessages(db, deviceID, from, to, batchSize, func(m *model.Message) (*model.Message, error) {
+		return m, calc.Publish(context.Background(), m)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("done, recalculated %d messages, %d failed", stats.Updated, stats.Failed)
+	return nil
+}
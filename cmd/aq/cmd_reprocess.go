@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/caldata"
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/pipeline/registry"
+)
+
+// reprocessCmd re-decodes stored raw payloads and re-runs the
+// calculations, updating the stored messages in place.
+type reprocessCmd struct {
+	DeviceID  string `long:"device" description:"Device ID" required:"yes" value-name:"<deviceID>"`
+	From      string `long:"from" description:"Reprocess messages received at or after this time" required:"yes" value-name:"<YYYY-MM-DD|RFC3339>"`
+	To        string `long:"to" description:"Reprocess messages received before this time (default now)" value-name:"<YYYY-MM-DD|RFC3339>"`
+	BatchSize int    `long:"batch-size" description:"Number of messages updated per transaction" default:"500" value-name:"<n>"`
+}
+
+// Execute ...
+func (a *reprocessCmd) Execute(_ []string) error {
+	from, err := parseTimestamp(a.From)
+	if err != nil {
+		return err
+	}
+
+	to, err := parseTimestamp(a.To)
+	if err != nil {
+		return err
+	}
+	if to == 0 {
+		to = time.Now().UnixMilli()
+	}
+
+	if to <= from {
+		return fmt.Errorf("--to must be after --from")
+	}
+
+	if a.BatchSize < 1 {
+		return fmt.Errorf("--batch-size must be positive")
+	}
+
+	db, err := getDB()
+	if err != nil {
+		log.Fatalf("Unable to open or create database file '%s': %v", opt.DBFilename, err)
+	}
+	defer db.Close()
+
+	reg, err := registry.New(db)
+	if err != nil {
+		log.Fatalf("Unable to load device board registry: %v", err)
+	}
+
+	// Load the calibration data from dir to ensure we have latest
+	caldata.Load(db, reg, opt.CalibrationDataDir)
+
+	calc, _ := newCalcChain(db)
+
+	stats, err := rewriteDeviceMessages(db, a.DeviceID, from, to, a.BatchSize, func(stored *model.Message) (*model.Message, error) {
+		if len(stored.Payload) == 0 {
+			return nil, errSkipMessage
+		}
+		return reprocessMessage(calc, stored)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("done, updated %d messages, skipped %d without raw payload, %d failed", stats.Updated, stats.Skipped, stats.Failed)
+	return nil
+}
+
+// reprocessMessage decodes the raw payload of a stored message and
+// runs it through the calculations again.  Everything that was not
+// part of the payload is carried over from the stored message.
+func reprocessMessage(calc pipeline.Pipeline, stored *model.Message) (*model.Message, error) {
+	pb, err := model.ProtobufFromData(stored.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	m := model.MessageFromProtobuf(pb)
+	m.ID = stored.ID
+	m.DeviceID = stored.DeviceID
+	m.MessageID = stored.MessageID
+	m.CollectionID = stored.CollectionID
+	m.ReceivedTime = stored.ReceivedTime
+	m.PacketSize = stored.PacketSize
+	m.Payload = stored.Payload
+
+	err = calc.Publish(context.Background(), m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
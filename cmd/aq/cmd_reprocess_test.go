@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	aqv1 "github.com/lab5e/aqserver/pkg/aq/v1"
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline/calculate"
+	"github.com/lab5e/aqserver/pkg/store/sqlitestore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReprocessKeepsMetadata(t *testing.T) {
+	db, err := sqlitestore.New(":memory:")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	payload, err := model.DataFromProtobuf(&aqv1.Sample{Sysid: 42, Sensor_1Work: 1234})
+	assert.Nil(t, err)
+
+	id, err := db.PutMessage(&model.Message{
+		DeviceID:     "dev1",
+		MessageID:    "msg1",
+		CollectionID: "col1",
+		ReceivedTime: 1000,
+		PacketSize:   len(payload),
+		Payload:      payload,
+	})
+	assert.Nil(t, err)
+
+	calc := calculate.New(db)
+	stats, err := rewriteDeviceMessages(db, "dev1", 0, 2000, 10, func(stored *model.Message) (*model.Message, error) {
+		return reprocessMessage(calc, stored)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Updated)
+
+	m, err := db.GetMessage(id)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(42), m.SysID)
+	assert.Equal(t, uint32(1234), m.Sensor1Work)
+	assert.Equal(t, "dev1", m.DeviceID)
+	assert.Equal(t, "msg1", m.MessageID)
+	assert.Equal(t, "col1", m.CollectionID)
+	assert.Equal(t, int64(1000), m.ReceivedTime)
+	assert.Equal(t, len(payload), m.PacketSize)
+	assert.Equal(t, payload, m.Payload)
+}
@@ -1,21 +1,24 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/lab5e/aqserver/pkg/api"
+	"github.com/lab5e/aqserver/pkg/caldata"
 	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/pipeline/builder"
 	"github.com/lab5e/aqserver/pkg/pipeline/calculate"
 	"github.com/lab5e/aqserver/pkg/pipeline/circular"
-	"github.com/lab5e/aqserver/pkg/pipeline/persist"
-	"github.com/lab5e/aqserver/pkg/pipeline/pipelog"
-	"github.com/lab5e/aqserver/pkg/pipeline/pipemqtt"
+	"github.com/lab5e/aqserver/pkg/pipeline/registry"
 	"github.com/lab5e/aqserver/pkg/pipeline/stream"
 	"github.com/lab5e/aqserver/pkg/spanlistener"
-)
-
-const (
-	circularBufferLength = 1000
+	"github.com/lab5e/aqserver/pkg/udplistener"
 )
 
 type serverCmd struct {
@@ -29,16 +32,77 @@ type serverCmd struct {
 	MQTTPassword    string `long:"mqtt-password" env:"MQTT_PASSWORD" description:"MQTT Password" default:""`
 	MQTTTopicPrefix string `long:"mqtt-topic-prefix" description:"MQTT topic prefix" default:"aq" value-name:"MQTT topic prefix"`
 
+	// Span collections.  If none are given we listen to the global
+	// --span-collection-id using --span-api-token.
+	SpanCollections []string `long:"span-collection" description:"Span collection to listen to, optionally with its own API token.  May be repeated" value-name:"<collectionID>[:<token>]"`
+
+	// Span webhook output
+	SpanWebhookSecret string `long:"span-webhook-secret" env:"SPAN_WEBHOOK_SECRET" description:"Shared secret for Span webhook output, enables webhook endpoint" default:""`
+	SpanWebhookHeader string `long:"span-webhook-header" description:"Header carrying the Span webhook secret" default:"X-Span-Secret"`
+
+	// HTTP ingest
+	IngestToken string `long:"ingest-token" env:"AQ_INGEST_TOKEN" description:"Bearer token for the ingest endpoint, enables ingest endpoint" default:""`
+
 	// UDP listener
 	UDPListenAddress string `long:"udp-listener" description:"Listen address for UDP listener" default:"" value-name:"<[host]:port>"`
 	UDPBufferSize    int    `long:"udp-buffer-size" description:"Size of UDP read buffer" default:"1024" value-name:"<num bytes>"`
+
+	// Pipeline
+	PipelineConfig string `long:"pipeline-config" description:"YAML or JSON file describing the pipeline stages (default built in pipeline)" value-name:"<file>"`
+	SpillDir       string `long:"spill-dir" description:"Directory for messages spilled to disk by async pipeline stages" default:"./spill" value-name:"<dir>"`
+
+	// Shutdown
+	ShutdownTimeout time.Duration `long:"shutdown-timeout" description:"How long to wait for the pipeline to drain on SIGINT or SIGTERM" default:"30s" value-name:"<duration>"`
+
+	// Calculation
+	CalcDebug bool `long:"calc-debug" description:"Include intermediate calculation values in streamed messages"`
+
+	// Calibration data reloading
+	NoCalWatch      bool          `long:"no-cal-watch" description:"Do not watch the calibration data directory for changes"`
+	CalPollInterval time.Duration `long:"cal-poll-interval" description:"Poll interval for calibration data directory if inotify is not available" default:"30s" value-name:"<duration>"`
+	AdminToken      string        `long:"admin-token" env:"AQ_ADMIN_TOKEN" description:"Bearer token for the admin API, enables admin endpoints" default:""`
 }
 
 var listeners []spanlistener.SpanListener
 
-func (a *serverCmd) startSpanListener(r pipeline.Pipeline) spanlistener.SpanListener {
-	log.Printf("Starting Span listener, listening to collection='%s'", opt.SpanCollectionID)
-	spanListener, err := spanlistener.Create(r, opt.SpanAPIToken, opt.SpanCollectionID)
+// spanCollection is a collection we listen to and the API token used
+// to access it.
+type spanCollection struct {
+	collectionID string
+	token        string
+}
+
+// spanCollections returns the Span collections to listen to.
+func (a *serverCmd) spanCollections() []spanCollection {
+	if len(a.SpanCollections) == 0 {
+		if opt.SpanAPIToken == "" {
+			return nil
+		}
+		return []spanCollection{{collectionID: opt.SpanCollectionID, token: opt.SpanAPIToken}}
+	}
+
+	var collections []spanCollection
+	for _, spec := range a.SpanCollections {
+		collectionID, token, found := strings.Cut(spec, ":")
+		if !found || token == "" {
+			token = opt.SpanAPIToken
+		}
+
+		if collectionID == "" {
+			log.Fatalf("Empty collection ID in --span-collection '%s'", spec)
+		}
+		if token == "" {
+			log.Fatalf("No API token for collection '%s'.  Please specify --span-api-token or <collectionID>:<token>", collectionID)
+		}
+
+		collections = append(collections, spanCollection{collectionID: collectionID, token: token})
+	}
+	return collections
+}
+
+func (a *serverCmd) startSpanListener(ctx context.Context, r pipeline.Pipeline, collection spanCollection) spanlistener.SpanListener {
+	log.Printf("Starting Span listener, listening to collection='%s'", collection.collectionID)
+	spanListener, err := spanlistener.Create(ctx, r, collection.token, collection.collectionID)
 	if err != nil {
 		log.Fatalf("Unable to start Span listener: %v", err)
 	}
@@ -46,6 +110,16 @@ func (a *serverCmd) startSpanListener(r pipeline.Pipeline) spanlistener.SpanList
 	return spanListener
 }
 
+func (a *serverCmd) startUDPListener(ctx context.Context, r pipeline.Pipeline) spanlistener.SpanListener {
+	log.Printf("Starting UDP listener on '%s'", a.UDPListenAddress)
+	udpListener, err := udplistener.Create(ctx, r, a.UDPListenAddress, a.UDPBufferSize)
+	if err != nil {
+		log.Fatalf("Unable to start UDP listener: %v", err)
+	}
+	listeners = append(listeners, udpListener)
+	return udpListener
+}
+
 // Execute ...
 func (a *serverCmd) Execute(_ []string) error {
 	// Set up persistence
@@ -55,8 +129,74 @@ func (a *serverCmd) Execute(_ []string) error {
 	}
 	defer db.Close()
 
+	// Build the pipeline
+	// Stream to MQTT server if enabled
+	pipelineConfig := builder.DefaultConfig(a.MQTTAddress != "")
+	if a.PipelineConfig != "" {
+		pipelineConfig, err = builder.ReadConfig(a.PipelineConfig)
+		if err != nil {
+			log.Fatalf("Unable to read pipeline config: %v", err)
+		}
+	}
+
+	built, err := builder.Build(pipelineConfig, &builder.Env{
+		DB:         db,
+		CalcDebug:  a.CalcDebug,
+		PM:         pmConfig(),
+		Conversion: conversionConfig(),
+		MQTT: builder.MQTTOptions{
+			Address:     a.MQTTAddress,
+			ClientID:    a.MQTTClientID,
+			Password:    a.MQTTPassword,
+			TopicPrefix: a.MQTTTopicPrefix,
+		},
+		SpillDir: a.SpillDir,
+	})
+	if err != nil {
+		log.Fatalf("Invalid pipeline: %v", err)
+	}
+	pipelineRoot := built.Root
+
+	// Find the stages the rest of the server needs to talk to.  The
+	// API needs a broker and a buffer even if they are not part of
+	// the pipeline, in which case they will just stay empty.
+	var (
+		pipelineCalcs    calcCaches
+		pipelineRegistry *registry.Registry
+		pipelineStream   *stream.Broker
+		pipelineCirc     *circular.Buffer
+	)
+	for _, stage := range built.Stages {
+		switch s := stage.(type) {
+		case *calculate.Calculate:
+			pipelineCalcs = append(pipelineCalcs, s)
+		case *registry.Registry:
+			pipelineRegistry = s
+		case *stream.Broker:
+			pipelineStream = s
+		case *circular.Buffer:
+			pipelineCirc = s
+		}
+	}
+	if pipelineRegistry == nil {
+		pipelineRegistry, err = registry.New(db)
+		if err != nil {
+			log.Fatalf("Unable to load device board registry: %v", err)
+		}
+	}
+	var standaloneStream bool
+	if pipelineStream == nil {
+		pipelineStream = stream.NewBroker()
+		standaloneStream = true
+	}
+	if pipelineCirc == nil {
+		pipelineCirc = circular.New(builder.DefaultCircularBufferSize)
+	}
+
+	reloader := caldata.NewReloader(db, pipelineRegistry, pipelineCalcs, opt.CalibrationDataDir)
+
 	// Load the calibration data to pick up any new calibration sets.
-	err = loadCalibrationData(db, opt.CalibrationDataDir)
+	_, err = reloader.Reload()
 	if err != nil {
 		// At this point we don't actually care if this returns an
 		// error because it just means that we won't get any new
@@ -64,34 +204,59 @@ func (a *serverCmd) Execute(_ []string) error {
 		log.Printf("Did not load any (new) calibration data: %v", err)
 	}
 
-	// Create pipeline elements
-	// TODO(borud): make streaming broker configurable
-	pipelineRoot := pipeline.New(db)
-	pipelineCalc := calculate.New(db)
-	pipelinePersist := persist.New(db)
-	pipelineLog := pipelog.New()
-	pipelineCirc := circular.New(circularBufferLength)
-	pipelineStream := stream.NewBroker()
+	// Reload the calibration data when the directory changes or
+	// when we get SIGHUP
+	if !a.NoCalWatch {
+		watcher, err := caldata.Watch(opt.CalibrationDataDir, a.CalPollInterval, func() {
+			reloadCalibrationData(reloader, "calibration data directory changed")
+		})
+		if err != nil {
+			log.Printf("Not watching calibration data directory: %v", err)
+		} else {
+			defer watcher.Close()
+		}
+	}
 
-	// Chain them together
-	pipelineRoot.AddNext(pipelineCalc)
-	pipelineCalc.AddNext(pipelinePersist)
-	pipelinePersist.AddNext(pipelineLog)
-	pipelineLog.AddNext(pipelineStream)
-	pipelineStream.AddNext(pipelineCirc)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadCalibrationData(reloader, "got SIGHUP")
+		}
+	}()
 
-	// Stream to MQTT server if enabled
-	if a.MQTTAddress != "" {
-		pipelineMQTT := pipemqtt.New(a.MQTTClientID, a.MQTTPassword, a.MQTTAddress, a.MQTTTopicPrefix)
-		pipelineCirc.AddNext(pipelineMQTT)
+	// If we have no listeners and do not accept data over HTTP there
+	// is no point to starting so we terminate
+	collections := a.spanCollections()
+	httpIngest := a.SpanWebhookSecret != "" || a.IngestToken != ""
+	if len(collections) == 0 && a.UDPListenAddress == "" && !httpIngest {
+		log.Fatalf("No listeners defined so terminating.  Please specify at least one listener, a webhook secret or an ingest token.")
 	}
 
-	// Start Horde listener if enabled
-	a.startSpanListener(pipelineRoot)
+	// SIGINT and SIGTERM start a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// If we have no listeners there is no point to starting so we terminate
-	if len(listeners) == 0 {
-		log.Fatalf("No listeners defined so terminating.  Please specify at least one listener.")
+	// Start the pipeline stages before anything is published to them
+	err = built.Start(ctx)
+	if err != nil {
+		log.Fatalf("Unable to start pipeline: %v", err)
+	}
+
+	// The listeners publish with their own context so that messages
+	// in flight when we shut down are not abandoned until the shutdown
+	// timeout has passed.
+	publishCtx, cancelPublish := context.WithCancel(context.Background())
+	defer cancelPublish()
+
+	// Start one Span listener per collection
+	for _, collection := range collections {
+		a.startSpanListener(publishCtx, pipelineRoot, collection)
+	}
+
+	// Start UDP listener if enabled
+	if a.UDPListenAddress != "" {
+		a.startUDPListener(publishCtx, pipelineRoot)
 	}
 
 	// Start api server
@@ -99,15 +264,104 @@ func (a *serverCmd) Execute(_ []string) error {
 		Broker:         pipelineStream,
 		DB:             db,
 		CircularBuffer: pipelineCirc,
+		Pipeline:       pipelineRoot,
 		ListenAddr:     a.WebListenAddr,
 		AccessLogDir:   a.WebAccessLogDir,
+
+		SpanWebhookSecret: a.SpanWebhookSecret,
+		SpanWebhookHeader: a.SpanWebhookHeader,
+		IngestToken:       a.IngestToken,
+
+		AdminToken:  a.AdminToken,
+		CalReloader: reloader,
 	})
 	api.Start()
 
-	// Wait for all listeners to shut down
+	// Run until we get a signal or all listeners have shut down.  If
+	// we only accept data over HTTP we run until we get a signal.
+	var listenersDone chan struct{}
+	if len(listeners) > 0 {
+		listenersDone = make(chan struct{})
+		go func() {
+			for _, listener := range listeners {
+				listener.WaitForShutdown()
+			}
+			close(listenersDone)
+		}()
+	}
+
+	select {
+	case <-ctx.Done():
+		log.Printf("Shutting down, waiting up to %v for the pipeline to drain", a.ShutdownTimeout)
+	case <-listenersDone:
+		log.Printf("All listeners have shut down, shutting down")
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), a.ShutdownTimeout)
+	defer cancel()
+
+	// Stop taking in messages before draining the pipeline
 	for _, listener := range listeners {
-		listener.WaitForShutdown()
+		listener.Shutdown()
+	}
+	listenersStopped := make(chan struct{})
+	go func() {
+		for _, listener := range listeners {
+			listener.WaitForShutdown()
+		}
+		close(listenersStopped)
+	}()
+	select {
+	case <-listenersStopped:
+	case <-shutdownCtx.Done():
+		log.Printf("Listeners did not stop in time, abandoning messages being published")
+		cancelPublish()
+		<-listenersStopped
+	}
+
+	err = api.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Webserver shutdown error: %v", err)
+	}
+
+	err = built.Stop(shutdownCtx)
+	if err != nil {
+		log.Printf("Error stopping pipeline: %v", err)
+	}
+
+	if standaloneStream {
+		err = pipelineStream.Stop(shutdownCtx)
+		if err != nil {
+			log.Printf("Error stopping stream broker: %v", err)
+		}
+	}
+
+	log.Printf("Shutdown complete")
+	return nil
+}
+
+// reloadCalibrationData imports the calibration data directory and
+// reloads the calibration data cache.
+func reloadCalibrationData(reloader *caldata.Reloader, reason string) {
+	log.Printf("Reloading calibration data: %s", reason)
+	_, err := reloader.Reload()
+	if err != nil {
+		log.Printf("Error reloading calibration data: %v", err)
+	}
+}
+
+// calcCaches lets us reload the calibration data caches of all the
+// calculate stages in the pipeline.
+type calcCaches []*calculate.Calculate
+
+// Reload ...
+func (c calcCaches) Reload() error {
+	for _, calc := range c {
+		err := calc.Reload()
+		if err != nil {
+			return err
+		}
 	}
-	api.Shutdown()
 	return nil
 }
@@ -16,10 +16,26 @@ var opt struct {
 	MySQLConnectString string `long:"mysql-connect-string" env:"MYSQL_CONNECT_STRING" description:"MySQL connect string"`
 	Verbose            bool   `short:"v"`
 
-	Fetch  fetchCmd  `command:"fetch" description:"fetch data backlog"`
-	Import importCmd `command:"import" description:"import calibration data"`
-	List   listCmd   `command:"list" description:"list calibration data"`
-	Server serverCmd `command:"server" description:"run server"`
+	// PM calculation from OPC bins
+	ParticleDensity  float64 `long:"particle-density" description:"Particle density used for PM calculation" default:"1.65" value-name:"<g/cm3>"`
+	Kappa            float64 `long:"kappa" description:"Hygroscopicity for PM humidity correction, 0 disables correction" default:"0.4" value-name:"<kappa>"`
+	OPCBinBoundaries string  `long:"opc-bin-boundaries" description:"Comma separated OPC bin boundaries, 25 values (default OPC-N3 bins)" value-name:"<um,um,...>"`
+
+	// Conversion from ppb to ug/m3
+	Pressure           float64 `long:"pressure" description:"Air pressure used for ug/m3 conversion" default:"101325" value-name:"<Pa>"`
+	StandardConditions bool    `long:"standard-conditions" description:"Convert to ug/m3 at standard temperature (20C) instead of measured temperature"`
+	TemperatureSource  string  `long:"temperature-source" description:"Measured temperature used for ug/m3 conversion" choice:"afe3" choice:"board" default:"afe3"`
+
+	Boards     boardsCmd     `command:"boards" description:"list which board was installed in which device"`
+	Cal        calCmd        `command:"cal" description:"calibration data tools"`
+	Colocate   colocateCmd   `command:"colocate" description:"fit correction against reference station data"`
+	DeadLetter deadLetterCmd `command:"deadletter" description:"list and replay messages the pipeline gave up on"`
+	Fetch      fetchCmd      `command:"fetch" description:"fetch data backlog"`
+	Import     importCmd     `command:"import" description:"import calibration data"`
+	List       listCmd       `command:"list" description:"list calibration data"`
+	Recalc     recalcCmd     `command:"recalc" description:"recalculate stored messages after calibration changes"`
+	Reprocess  reprocessCmd  `command:"reprocess" description:"re-decode stored payloads and recalculate"`
+	Server     serverCmd     `command:"server" description:"run server"`
 }
 
 func main() {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/store"
+)
+
+// rewriteWindow is the time window we read from the database at a
+// time, to avoid loading the complete history of a device into memory.
+const rewriteWindow = 24 * time.Hour
+
+// errSkipMessage is returned by rewrite functions to leave a message
+// untouched.
+var errSkipMessage = errors.New("skip message")
+
+// rewriteStats summarizes the result of rewriteDeviceMessages.
+type rewriteStats struct {
+	Updated int
+	Skipped int
+	Failed  int
+}
+
+// rewriteDeviceMessages runs f on every stored message for deviceID
+// received in [from:to> and writes the returned messages back to the
+// database in batches of batchSize.  If f returns errSkipMessage the
+// message is left untouched, other errors are logged and counted as
+// failures.
+func rewriteDeviceMessages(db store.Store, deviceID string, from int64, to int64, batchSize int, f func(m *model.Message) (*model.Message, error)) (rewriteStats, error) {
+	var stats rewriteStats
+	batch := make([]*model.Message, 0, batchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := db.UpdateMessages(batch)
+		if err != nil {
+			return err
+		}
+		stats.Updated += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for start := from; start < to; start += rewriteWindow.Milliseconds() {
+		end := start + rewriteWindow.Milliseconds()
+		if end > to {
+			end = to
+		}
+
+		msgs, err := db.ListDeviceMessagesByDate(deviceID, start, end)
+		if err != nil {
+			return stats, err
+		}
+
+		for i := range msgs {
+			m, err := f(&msgs[i])
+			if err == errSkipMessage {
+				stats.Skipped++
+				continue
+			}
+			if err != nil {
+				log.Printf("Error rewriting message id=%d: %v", msgs[i].ID, err)
+				stats.Failed++
+				continue
+			}
+
+			batch = append(batch, m)
+			if len(batch) >= batchSize {
+				err := flush()
+				if err != nil {
+					return stats, err
+				}
+			}
+		}
+
+		if len(msgs) > 0 {
+			log.Printf(" - processed up to %s, updated %d", formatTimestamp(end), stats.Updated+len(batch))
+		}
+	}
+
+	return stats, flush()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// timestampLayouts are the layouts accepted for timestamps given on
+// the command line.  Timestamps without a timezone are UTC.
+var timestampLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseTimestamp parses a command line timestamp and returns it as
+// milliseconds since epoch.  An empty string yields 0.
+func parseTimestamp(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	for _, layout := range timestampLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t.UnixMilli(), nil
+		}
+	}
+	return 0, fmt.Errorf("unable to parse timestamp '%s', expected YYYY-MM-DD or RFC3339", s)
+}
+
+// formatTimestamp formats milliseconds since epoch for log output.
+func formatTimestamp(ts int64) string {
+	if ts == 0 {
+		return "-"
+	}
+	return time.UnixMilli(ts).UTC().Format(time.RFC3339)
+}
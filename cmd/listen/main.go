@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 
@@ -16,7 +17,7 @@ func main() {
 	}
 
 	pipeline := pipeline.New(db)
-	listener, err := spanlistener.Create(pipeline, os.Getenv("SPAN_API_TOKEN"), "17dh0cf43jg007")
+	listener, err := spanlistener.Create(context.Background(), pipeline, os.Getenv("SPAN_API_TOKEN"), "17dh0cf43jg007")
 	if err != nil {
 		log.Fatal(err)
 	}
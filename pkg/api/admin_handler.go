@@ -0,0 +1,64 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/lab5e/aqserver/pkg/caldata"
+)
+
+// CalibrationReloader reloads the calibration data.
+type CalibrationReloader interface {
+	Reload() (caldata.LoadStats, error)
+}
+
+// adminAuthorized checks that the request carries the admin token as
+// a bearer token.
+func (s *Server) adminAuthorized(r *http.Request) bool {
+	return bearerAuthorized(r, s.adminToken)
+}
+
+// bearerAuthorized checks that the request carries token as a bearer
+// token.  An empty token never matches.
+func bearerAuthorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// adminOnly wraps a handler so that it requires the admin token.
+func (s *Server) adminOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" || !s.adminAuthorized(r) {
+			log.Printf("Rejected admin request from %s: invalid token", r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// reloadCalibrationHandler imports the calibration data directory and
+// reloads the calibration data cache.  It must be wrapped by adminOnly.
+func (s *Server) reloadCalibrationHandler(w http.ResponseWriter, r *http.Request) {
+	if s.calReloader == nil {
+		http.Error(w, "admin API not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	stats, err := s.calReloader.Reload()
+	if err != nil {
+		log.Printf("Error reloading calibration data: %v", err)
+		http.Error(w, fmt.Sprintf("error reloading calibration data: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
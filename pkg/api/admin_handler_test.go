@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/lab5e/aqserver/pkg/caldata"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeReloader struct {
+	reloads int
+}
+
+func (f *fakeReloader) Reload() (caldata.LoadStats, error) {
+	f.reloads++
+	return caldata.LoadStats{Files: 3, New: 1}, nil
+}
+
+func TestReloadCalibration(t *testing.T) {
+	reloader := &fakeReloader{}
+	s := New(&ServerConfig{
+		AdminToken:  "sekrit",
+		CalReloader: reloader,
+	})
+	h := s.adminOnly(http.HandlerFunc(s.reloadCalibrationHandler))
+
+	send := func(auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/reload-calibration", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, send("").Code)
+	assert.Equal(t, http.StatusForbidden, send("Bearer wrong").Code)
+	assert.Equal(t, http.StatusForbidden, send("sekrit").Code)
+	assert.Equal(t, 0, reloader.reloads)
+
+	w := send("Bearer sekrit")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"files":3,"new":1,"updated":0}`, w.Body.String())
+	assert.Equal(t, 1, reloader.reloads)
+
+	// Authorized, but there is nothing to reload
+	s = New(&ServerConfig{AdminToken: "sekrit"})
+	h = s.adminOnly(http.HandlerFunc(s.reloadCalibrationHandler))
+	assert.Equal(t, http.StatusServiceUnavailable, send("Bearer sekrit").Code)
+}
+
+func TestAdminOnly(t *testing.T) {
+	s := New(&ServerConfig{AdminToken: "sekrit"})
+	h := s.adminOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	send := func(auth string) int {
+		req := httptest.NewRequest("GET", "/debug/vars", nil)
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusForbidden, send(""))
+	assert.Equal(t, http.StatusForbidden, send("Bearer wrong"))
+	assert.Equal(t, http.StatusTeapot, send("Bearer sekrit"))
+}
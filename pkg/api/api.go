@@ -3,6 +3,7 @@ package api
 
 import (
 	"context"
+	"expvar"
 	"log"
 	"net/http"
 	"os"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/lab5e/aqserver/pkg/pipeline"
 	"github.com/lab5e/aqserver/pkg/pipeline/circular"
 	"github.com/lab5e/aqserver/pkg/pipeline/stream"
 	"github.com/lab5e/aqserver/pkg/store"
@@ -21,11 +23,19 @@ type Server struct {
 	db             store.Store
 	broker         *stream.Broker
 	circularBuffer *circular.Buffer
+	pipeline       pipeline.Pipeline
 	listenAddr     string
 	readTimeout    time.Duration
 	writeTimeout   time.Duration
-	httpServer     http.Server
+	httpServer     *http.Server
 	accessLogDir   string
+
+	spanWebhookSecret string
+	spanWebhookHeader string
+	ingestToken       string
+
+	adminToken  string
+	calReloader CalibrationReloader
 }
 
 // ServerConfig represents the webserver configuration
@@ -33,27 +43,55 @@ type ServerConfig struct {
 	DB             store.Store
 	Broker         *stream.Broker
 	CircularBuffer *circular.Buffer
+	Pipeline       pipeline.Pipeline // Pipeline root that ingested messages are published to
 	ListenAddr     string
 	AccessLogDir   string
+
+	// SpanWebhookSecret is the shared secret Span webhook requests
+	// must carry in the SpanWebhookHeader header.  The webhook
+	// endpoint is only enabled if the secret is set.
+	SpanWebhookSecret string
+	SpanWebhookHeader string
+
+	// IngestToken is the bearer token ingest requests must carry.
+	// The ingest endpoint is only enabled if the token is set.
+	IngestToken string
+
+	// AdminToken is the bearer token admin requests must carry.  The
+	// admin endpoints are only enabled if the token is set.
+	AdminToken  string
+	CalReloader CalibrationReloader
 }
 
 const (
-	defaultReadTimeout     = (15 * time.Second)
-	defaultWriteTimeout    = (30 * time.Second)
-	defaultShutdownTimeout = (10 * time.Second)
-	accessLogFileMode      = 0644
+	defaultReadTimeout  = (15 * time.Second)
+	defaultWriteTimeout = (30 * time.Second)
+	accessLogFileMode   = 0644
 )
 
 // New creates a new webserver instance
 func New(config *ServerConfig) *Server {
+	webhookHeader := config.SpanWebhookHeader
+	if webhookHeader == "" {
+		webhookHeader = DefaultSpanWebhookHeader
+	}
+
 	return &Server{
 		db:             config.DB,
 		broker:         config.Broker,
 		circularBuffer: config.CircularBuffer,
+		pipeline:       config.Pipeline,
 		listenAddr:     config.ListenAddr,
 		readTimeout:    defaultReadTimeout,
 		writeTimeout:   defaultWriteTimeout,
 		accessLogDir:   config.AccessLogDir,
+
+		spanWebhookSecret: config.SpanWebhookSecret,
+		spanWebhookHeader: webhookHeader,
+		ingestToken:       config.IngestToken,
+
+		adminToken:  config.AdminToken,
+		calReloader: config.CalReloader,
 	}
 }
 
@@ -62,6 +100,16 @@ func (s *Server) Start() {
 	// Create router
 	m := mux.NewRouter().StrictSlash(true)
 	m.HandleFunc("/stream", s.streamHandler).Methods("GET")
+	if s.ingestToken != "" {
+		m.HandleFunc("/ingest", s.ingestHandler).Methods("POST")
+	}
+	if s.spanWebhookSecret != "" {
+		m.HandleFunc("/span/webhook", s.spanWebhookHandler).Methods("POST")
+	}
+	if s.adminToken != "" {
+		m.Handle("/admin/reload-calibration", s.adminOnly(http.HandlerFunc(s.reloadCalibrationHandler))).Methods("POST")
+		m.Handle("/debug/vars", s.adminOnly(expvar.Handler())).Methods("GET")
+	}
 	m.HandleFunc("/", s.indexHandler).Methods("GET")
 
 	// Set up access logging
@@ -79,7 +127,7 @@ func (s *Server) Start() {
 	}
 
 	// Set up webserver
-	server := &http.Server{
+	s.httpServer = &http.Server{
 		Handler:      handlers.ProxyHeaders(handlers.CombinedLoggingHandler(accessLogFile, m)),
 		Addr:         s.listenAddr,
 		WriteTimeout: s.readTimeout,
@@ -88,17 +136,15 @@ func (s *Server) Start() {
 
 	log.Printf("Webserver listening to '%s'", s.listenAddr)
 	go func() {
-		log.Printf("Webserver terminated: '%v'", server.ListenAndServe())
+		log.Printf("Webserver terminated: '%v'", s.httpServer.ListenAndServe())
 	}()
 }
 
-// Shutdown shuts down the webserver
-func (s *Server) Shutdown() {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultShutdownTimeout)
-	defer cancel()
-
-	err := s.httpServer.Shutdown(ctx)
-	if err != nil {
-		log.Printf("Webserver shutdown error: %v", err)
+// Shutdown stops accepting requests and waits for the requests in
+// progress to complete or for ctx to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.httpServer == nil {
+		return nil
 	}
+	return s.httpServer.Shutdown(ctx)
 }
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"log"
 	"os"
 	"testing"
@@ -21,5 +22,5 @@ func TestAPISimple(t *testing.T) {
 	})
 	assert.NotNil(t, s)
 	s.Start()
-	s.Shutdown()
+	assert.Nil(t, s.Shutdown(context.Background()))
 }
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+)
+
+const (
+	// maxIngestBodySize limits the size of a single ingest request.
+	maxIngestBodySize = 1024 * 1024
+)
+
+// ingestEnvelope is a Span webhook style JSON envelope carrying a
+// single base64 encoded protobuf payload.
+type ingestEnvelope struct {
+	DeviceID  string      `json:"deviceId"`
+	MessageID string      `json:"messageId"`
+	Received  msTimestamp `json:"received"`
+	Payload   string      `json:"payload"`
+}
+
+// ingestResponse is returned to the client after ingesting data.
+type ingestResponse struct {
+	Accepted int `json:"accepted"`
+	Failed   int `json:"failed"`
+}
+
+// msTimestamp is a timestamp in milliseconds since epoch.  Span
+// represents these as strings so we accept both strings and numbers.
+type msTimestamp int64
+
+// UnmarshalJSON accepts both quoted and unquoted integers.
+func (t *msTimestamp) UnmarshalJSON(data []byte) error {
+	s := string(bytes.Trim(data, `"`))
+	if s == "" || s == "null" {
+		*t = 0
+		return nil
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp '%s': %v", s, err)
+	}
+	*t = msTimestamp(v)
+	return nil
+}
+
+// ingestHandler accepts either a raw aqv1.Sample protobuf body, a
+// JSON envelope with a base64 encoded protobuf payload, or a JSON
+// array of model.Message objects and publishes the messages into the
+// pipeline.  Requests must carry the ingest token as a bearer token.
+func (s *Server) ingestHandler(w http.ResponseWriter, r *http.Request) {
+	if s.pipeline == nil || s.ingestToken == "" {
+		http.Error(w, "ingest not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	if !bearerAuthorized(r, s.ingestToken) {
+		log.Printf("Rejected ingest request from %s: invalid token", r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var messages []*model.Message
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-protobuf", "application/protobuf", "application/octet-stream":
+		m, err := messageFromPayload(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		messages = append(messages, m)
+
+	default:
+		messages, err = messagesFromJSON(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	now := time.Now().UnixMilli()
+	resp := ingestResponse{}
+	for _, m := range messages {
+		if m.ReceivedTime == 0 {
+			m.ReceivedTime = now
+		}
+
+		err := s.pipeline.Publish(r.Context(), m)
+		if err != nil {
+			log.Printf("Error publishing ingested message from %s: %v", r.RemoteAddr, err)
+			resp.Failed++
+			continue
+		}
+		resp.Accepted++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Failed > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// messagesFromJSON decodes either a single envelope or an array of
+// messages.
+func messagesFromJSON(body []byte) ([]*model.Message, error) {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil, fmt.Errorf("empty body")
+	}
+
+	if body[0] == '[' {
+		var messages []*model.Message
+		err := json.Unmarshal(body, &messages)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding messages: %v", err)
+		}
+		for i, m := range messages {
+			if m == nil {
+				return nil, fmt.Errorf("message %d is null", i)
+			}
+		}
+		return messages, nil
+	}
+
+	var env ingestEnvelope
+	err := json.Unmarshal(body, &env)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding envelope: %v", err)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("error base64-decoding payload: %v", err)
+	}
+
+	m, err := messageFromPayload(payload)
+	if err != nil {
+		return nil, err
+	}
+	m.DeviceID = env.DeviceID
+	m.MessageID = env.MessageID
+	m.ReceivedTime = int64(env.Received)
+
+	return []*model.Message{m}, nil
+}
+
+// messageFromPayload decodes a protobuf encoded aqv1.Sample.
+func messageFromPayload(payload []byte) (*model.Message, error) {
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("empty payload")
+	}
+
+	pb, err := model.ProtobufFromData(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error protobuf-decoding payload: %v", err)
+	}
+
+	m := model.MessageFromProtobuf(pb)
+	m.PacketSize = len(payload)
+	m.Payload = payload
+	return m, nil
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	aqv1 "github.com/lab5e/aqserver/pkg/aq/v1"
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/pipeline/circular"
+	"github.com/stretchr/testify/assert"
+)
+
+func newIngestServer() (*Server, *circular.Buffer) {
+	root := pipeline.New(nil)
+	buffer := circular.New(10)
+	root.AddNext(buffer)
+
+	return New(&ServerConfig{Pipeline: root, IngestToken: "sekrit"}), buffer
+}
+
+func post(s *Server, handler http.HandlerFunc, contentType string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/ingest", bytes.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer sekrit")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestIngestProtobuf(t *testing.T) {
+	s, buffer := newIngestServer()
+
+	data, err := model.DataFromProtobuf(&aqv1.Sample{Sysid: 7})
+	assert.Nil(t, err)
+
+	w := post(s, s.ingestHandler, "application/x-protobuf", data)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	msgs := buffer.GetContents()
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, uint64(7), msgs[0].SysID)
+	assert.Equal(t, len(data), msgs[0].PacketSize)
+	assert.NotZero(t, msgs[0].ReceivedTime)
+}
+
+func TestIngestEnvelope(t *testing.T) {
+	s, buffer := newIngestServer()
+
+	data, err := model.DataFromProtobuf(&aqv1.Sample{Sysid: 8})
+	assert.Nil(t, err)
+
+	body := fmt.Sprintf(`{"deviceId":"dev1","messageId":"msg1","received":"1600000000000","payload":"%s"}`, base64.StdEncoding.EncodeToString(data))
+	w := post(s, s.ingestHandler, "application/json", []byte(body))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	msgs := buffer.GetContents()
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, uint64(8), msgs[0].SysID)
+	assert.Equal(t, "dev1", msgs[0].DeviceID)
+	assert.Equal(t, "msg1", msgs[0].MessageID)
+	assert.Equal(t, int64(1600000000000), msgs[0].ReceivedTime)
+}
+
+func TestIngestMessageBatch(t *testing.T) {
+	s, buffer := newIngestServer()
+
+	body := `[{"deviceID":"dev1","sysID":1,"receivedTime":1000},{"deviceID":"dev2","sysID":2}]`
+	w := post(s, s.ingestHandler, "application/json", []byte(body))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"accepted":2,"failed":0}`, w.Body.String())
+
+	msgs := buffer.GetContents()
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, int64(1000), msgs[0].ReceivedTime)
+	assert.NotZero(t, msgs[1].ReceivedTime)
+}
+
+func TestIngestErrors(t *testing.T) {
+	s, _ := newIngestServer()
+
+	assert.Equal(t, http.StatusBadRequest, post(s, s.ingestHandler, "application/json", []byte("")).Code)
+	assert.Equal(t, http.StatusBadRequest, post(s, s.ingestHandler, "application/json", []byte("{garbage")).Code)
+	assert.Equal(t, http.StatusBadRequest, post(s, s.ingestHandler, "application/json", []byte(`{"payload":"not base64!"}`)).Code)
+	assert.Equal(t, http.StatusBadRequest, post(s, s.ingestHandler, "application/json", []byte(`[null]`)).Code)
+	assert.Equal(t, http.StatusBadRequest, post(s, s.ingestHandler, "application/json", []byte(`[{"deviceID":"d1"},null]`)).Code)
+	assert.Equal(t, http.StatusBadRequest, post(s, s.ingestHandler, "application/x-protobuf", []byte{0xff, 0xff}).Code)
+
+	disabled := New(&ServerConfig{Pipeline: pipeline.New(nil)})
+	assert.Equal(t, http.StatusServiceUnavailable, post(disabled, disabled.ingestHandler, "application/json", []byte("[]")).Code)
+}
+
+func TestIngestUnauthorized(t *testing.T) {
+	s, buffer := newIngestServer()
+
+	for _, auth := range []string{"", "Bearer wrong", "sekrit"} {
+		req := httptest.NewRequest("POST", "/ingest", bytes.NewReader([]byte("[{}]")))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		s.ingestHandler(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	}
+	assert.Empty(t, buffer.GetContents())
+}
@@ -0,0 +1,104 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// DefaultSpanWebhookHeader is the default name of the header carrying
+// the shared secret configured on the Span webhook output.
+const DefaultSpanWebhookHeader = "X-Span-Secret"
+
+// spanWebhookBody is the body Span posts to webhook outputs.
+type spanWebhookBody struct {
+	Messages []spanOutputDataMessage `json:"messages"`
+}
+
+// spanOutputDataMessage mirrors the parts of Span's output data
+// message that we need.
+type spanOutputDataMessage struct {
+	Type   string `json:"type"`
+	Device struct {
+		DeviceID     string            `json:"deviceId"`
+		CollectionID string            `json:"collectionId"`
+		Tags         map[string]string `json:"tags"`
+	} `json:"device"`
+	Payload   string      `json:"payload"`
+	Received  msTimestamp `json:"received"`
+	MessageID string      `json:"messageId"`
+}
+
+// spanWebhookHandler receives data from a Span webhook output.
+// Requests are only accepted if they carry the configured shared
+// secret.
+func (s *Server) spanWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if s.pipeline == nil || s.spanWebhookSecret == "" {
+		http.Error(w, "webhook not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	secret := r.Header.Get(s.spanWebhookHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(s.spanWebhookSecret)) != 1 {
+		log.Printf("Rejected Span webhook request from %s: invalid secret", r.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBodySize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var webhook spanWebhookBody
+	err = json.Unmarshal(body, &webhook)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error decoding body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp := ingestResponse{}
+	for _, odm := range webhook.Messages {
+		// We only care about messages containing data
+		if odm.Type != "data" {
+			continue
+		}
+
+		payload, err := base64.StdEncoding.DecodeString(odm.Payload)
+		if err != nil {
+			log.Printf("payload error: %v", err)
+			resp.Failed++
+			continue
+		}
+
+		message, err := messageFromPayload(payload)
+		if err != nil {
+			log.Printf("payload error: %v", err)
+			resp.Failed++
+			continue
+		}
+		message.DeviceID = odm.Device.DeviceID
+		message.CollectionID = odm.Device.CollectionID
+		message.MessageID = odm.MessageID
+		message.ReceivedTime = int64(odm.Received)
+		message.Tags = odm.Device.Tags
+
+		err = s.pipeline.Publish(r.Context(), message)
+		if err != nil {
+			log.Printf("Error publishing webhook message %s: %v", odm.MessageID, err)
+			resp.Failed++
+			continue
+		}
+		resp.Accepted++
+	}
+
+	// Span only cares about the status code, but the counts are
+	// useful when testing by hand.
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/pipeline/circular"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpanWebhook(t *testing.T) {
+	body, err := os.ReadFile("testdata/span-webhook.json")
+	assert.Nil(t, err)
+
+	root := pipeline.New(nil)
+	buffer := circular.New(10)
+	root.AddNext(buffer)
+
+	s := New(&ServerConfig{
+		Pipeline:          root,
+		SpanWebhookSecret: "sekrit",
+	})
+
+	send := func(secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/span/webhook", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if secret != "" {
+			req.Header.Set(DefaultSpanWebhookHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		s.spanWebhookHandler(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, send("").Code)
+	assert.Equal(t, http.StatusForbidden, send("wrong").Code)
+	assert.Equal(t, 0, len(buffer.GetContents()))
+
+	w := send("sekrit")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"accepted":2,"failed":0}`, w.Body.String())
+
+	msgs := buffer.GetContents()
+	assert.Equal(t, 2, len(msgs))
+	assert.Equal(t, "17dh0cf43jg785", msgs[0].DeviceID)
+	assert.Equal(t, "17dh0cf43jg7ms1", msgs[0].MessageID)
+	assert.Equal(t, int64(1681726200000), msgs[0].ReceivedTime)
+	assert.Equal(t, uint64(357518080229701), msgs[0].SysID)
+	assert.Equal(t, uint32(519656), msgs[0].Sensor1Work)
+	assert.Equal(t, 77, msgs[0].PacketSize)
+	assert.Equal(t, "Elgeseter", msgs[0].Tags["name"])
+	assert.Equal(t, "17dh0cf43jg7ms2", msgs[1].MessageID)
+}
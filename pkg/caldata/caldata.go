@@ -0,0 +1,204 @@
+// Package caldata reads calibration data files from a directory and
+// imports them into the database.
+package caldata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline/registry"
+	"github.com/lab5e/aqserver/pkg/store"
+)
+
+// DefaultFilenamePattern is the default pattern to be used for
+// reading the calibration data files.
+const DefaultFilenamePattern = "*.json"
+
+// LoadStats summarizes what Load did.
+type LoadStats struct {
+	Files   int `json:"files"`   // Number of valid calibration files read
+	New     int `json:"new"`     // Number of calibration entries added
+	Updated int `json:"updated"` // Number of existing calibration entries that were changed
+}
+
+// ReadDir reads the calibration data files in dir and its
+// subdirectories.  Files that cannot be used are logged and skipped.
+func ReadDir(dir string) ([]model.Cal, error) {
+	var cals []model.Cal
+	pattern := DefaultFilenamePattern
+
+	f := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Print(err)
+			return nil
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		match, err := filepath.Match(pattern, info.Name())
+		if err != nil {
+			log.Printf("Error matching '%s': %v", pattern, err)
+			return err
+		}
+
+		if !match {
+			log.Printf("SKIP '%s', no match for %s", info.Name(), pattern)
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("SKIP '%s', error reading : %v", path, err)
+			return nil
+		}
+
+		var cal model.Cal
+		err = json.Unmarshal(data, &cal)
+		if err != nil {
+			log.Printf("SKIP '%s' unable to parse : %v", path, err)
+			return nil
+		}
+
+		// Check if SysID is present.  If it is not the calibration
+		// file cannot be used and will be skipped.
+		if cal.SysID == 0 {
+			log.Printf("SKIP '%s' Not a valid calibration file: SysID missing", path)
+			return nil
+		}
+
+		err = cal.Validate()
+		if err != nil {
+			log.Printf("SKIP '%s' Not a valid calibration file: %v", path, err)
+			return nil
+		}
+
+		cals = append(cals, cal)
+		return nil
+	}
+
+	dirInfo, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dirInfo.IsDir() {
+		return nil, fmt.Errorf("'%s' is not a directory", dir)
+	}
+
+	err = filepath.Walk(dir, f)
+	if err != nil {
+		return nil, err
+	}
+	return cals, nil
+}
+
+// Load reads the calibration data files in dir and imports them into
+// the database.  Files that have been imported before are matched to
+// the existing entry by DeviceID, CollectionID, AFESerial and
+// ValidFrom, and the entry is updated if the file has changed.  The
+// device board pairings in the files are recorded in reg.
+func Load(db store.Store, reg *registry.Registry, dir string) (LoadStats, error) {
+	var stats LoadStats
+
+	cals, err := ReadDir(dir)
+	if err != nil {
+		return stats, err
+	}
+
+	// The calibration data tells us which device a board was
+	// installed in when it was calibrated, so we record that in the
+	// device board registry.  Process in date order so that the
+	// registry ends up with the right history.
+	sort.Slice(cals, func(i, j int) bool {
+		return cals[i].ValidFrom.Before(cals[j].ValidFrom)
+	})
+
+	for i := range cals {
+		cal := &cals[i]
+		stats.Files++
+
+		if cal.DeviceID != "" {
+			_, err := reg.Record(cal.DeviceID, cal.SysID, cal.ValidFrom)
+			if err != nil {
+				log.Printf("Error updating device board registry: %v", err)
+			}
+		}
+
+		existing, err := findCal(db, cal)
+		if err != nil {
+			log.Printf("Error loading calibration data: %v", err)
+			continue
+		}
+
+		if existing == nil {
+			_, err := db.PutCal(cal)
+			if err != nil {
+				log.Printf("Error loading calibration data: %v", err)
+				continue
+			}
+			log.Printf("Adding calibration data for %s", cal.DeviceID)
+			stats.New++
+			continue
+		}
+
+		if sameCal(existing, cal) {
+			continue
+		}
+
+		cal.ID = existing.ID
+		err = db.UpdateCal(cal)
+		if err != nil {
+			log.Printf("Error updating calibration data: %v", err)
+			continue
+		}
+		log.Printf("Updating calibration data %d for %s", cal.ID, cal.DeviceID)
+		stats.Updated++
+	}
+
+	log.Printf("Read %d calibration files from %s and found %d new and %d changed sets.", stats.Files, dir, stats.New, stats.Updated)
+	return stats, nil
+}
+
+// findCal returns the stored calibration entry that cal is a version
+// of, or nil if there is none.
+func findCal(db store.Store, cal *model.Cal) (*model.Cal, error) {
+	cals, err := db.ListCalsForDevice(cal.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range cals {
+		if c.CollectionID == cal.CollectionID && c.AFESerial == cal.AFESerial && c.ValidFrom.Equal(cal.ValidFrom) {
+			return &c, nil
+		}
+	}
+	return nil, nil
+}
+
+// sameCal returns true if a and b hold the same calibration data.
+// Timestamps are compared at the resolution of the database.
+func sameCal(a *model.Cal, b *model.Cal) bool {
+	normalize := func(c model.Cal) ([]byte, error) {
+		c.ID = 0
+		c.ValidFrom = c.ValidFrom.UTC().Truncate(time.Second)
+		c.AFECalDate = c.AFECalDate.UTC().Truncate(time.Second)
+		if c.ValidTo != nil {
+			t := c.ValidTo.UTC().Truncate(time.Second)
+			c.ValidTo = &t
+		}
+		return json.Marshal(c)
+	}
+
+	ja, errA := normalize(*a)
+	jb, errB := normalize(*b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
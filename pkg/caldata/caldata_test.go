@@ -0,0 +1,103 @@
+package caldata
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline/registry"
+	"github.com/lab5e/aqserver/pkg/store/sqlitestore"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCal writes cal as a calibration file in dir.
+func writeCal(t *testing.T, dir string, name string, cal *model.Cal) {
+	data, err := json.Marshal(cal)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, name), data, 0644))
+}
+
+func TestLoad(t *testing.T) {
+	data, err := os.ReadFile("testdata/16-000158.json")
+	assert.Nil(t, err)
+
+	var cal model.Cal
+	assert.Nil(t, json.Unmarshal(data, &cal))
+
+	db, err := sqlitestore.New(":memory:")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	reg, err := registry.New(db)
+	assert.Nil(t, err)
+
+	dir := t.TempDir()
+	writeCal(t, dir, "a.json", &cal)
+
+	// The same board moved to another device later
+	moved := cal
+	moved.DeviceID = "otherdevice"
+	moved.ValidFrom = cal.ValidFrom.AddDate(1, 0, 0)
+	writeCal(t, dir, "b.json", &moved)
+
+	// Broken files are skipped
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{not json"), 0644))
+
+	stats, err := Load(db, reg, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, LoadStats{Files: 2, New: 2}, stats)
+
+	boards, err := db.ListDeviceBoards()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(boards))
+
+	// Loading again changes nothing
+	stats, err = Load(db, reg, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, LoadStats{Files: 2}, stats)
+
+	// Changing a file updates the existing entry
+	cal.Vt20Offset = 0.5
+	writeCal(t, dir, "a.json", &cal)
+
+	stats, err = Load(db, reg, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, LoadStats{Files: 2, Updated: 1}, stats)
+
+	cals, err := db.ListCalsForDevice(cal.DeviceID)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(cals))
+	assert.Equal(t, 0.5, cals[0].Vt20Offset)
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+
+	var changes int32
+	w, err := Watch(dir, 10*time.Millisecond, func() {
+		atomic.AddInt32(&changes, 1)
+	})
+	assert.Nil(t, err)
+	defer w.Close()
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.json"), []byte("{}"), 0644))
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&changes) == 1 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPollNotifier(t *testing.T) {
+	dir := t.TempDir()
+
+	n := newPollNotifier(dir, 10*time.Millisecond)
+	defer n.Close()
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "a.json"), []byte("{}"), 0644))
+	select {
+	case <-n.C():
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change detected")
+	}
+}
@@ -0,0 +1,47 @@
+package caldata
+
+import (
+	"sync"
+
+	"github.com/lab5e/aqserver/pkg/pipeline/registry"
+	"github.com/lab5e/aqserver/pkg/store"
+)
+
+// Cache is a cache of calibration data that can be reloaded from the
+// database, like the calculate pipeline step.
+type Cache interface {
+	Reload() error
+}
+
+// Reloader imports the calibration data directory and reloads the
+// cache.  Reloads may be triggered from several places at once, so
+// they are serialized.
+type Reloader struct {
+	mu    sync.Mutex
+	db    store.Store
+	reg   *registry.Registry
+	cache Cache
+	dir   string
+}
+
+// NewReloader creates a Reloader for the calibration data in dir.
+func NewReloader(db store.Store, reg *registry.Registry, cache Cache, dir string) *Reloader {
+	return &Reloader{
+		db:    db,
+		reg:   reg,
+		cache: cache,
+		dir:   dir,
+	}
+}
+
+// Reload imports the calibration data directory and reloads the cache.
+func (r *Reloader) Reload() (LoadStats, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stats, err := Load(r.db, r.reg, r.dir)
+	if err != nil {
+		return stats, err
+	}
+	return stats, r.cache.Reload()
+}
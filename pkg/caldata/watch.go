@@ -0,0 +1,184 @@
+package caldata
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// settleDelay is how long we wait for things to calm down after a
+// change before reloading.  Copying a batch of files or an editor
+// saving a file generates a burst of changes and we only want to
+// reload once.
+const settleDelay = 500 * time.Millisecond
+
+// notifier signals on C when something has changed in the watched
+// directory.
+type notifier interface {
+	C() <-chan struct{}
+	Close() error
+}
+
+// Watcher watches a calibration data directory and calls a function
+// when files in it change.  It uses inotify where available and falls
+// back to polling.
+type Watcher struct {
+	notifier notifier
+	onChange func()
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Watch starts watching dir.  onChange is called from a separate
+// goroutine after the files in dir have changed.  pollInterval is the
+// interval used if we have to fall back to polling.
+func Watch(dir string, pollInterval time.Duration, onChange func()) (*Watcher, error) {
+	_, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := newInotifyNotifier(dir)
+	if err != nil {
+		log.Printf("Unable to watch '%s' using inotify, polling every %s instead: %v", dir, pollInterval, err)
+		n = newPollNotifier(dir, pollInterval)
+	}
+
+	w := &Watcher{
+		notifier: n,
+		onChange: onChange,
+		done:     make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+func (w *Watcher) run() {
+	defer w.wg.Done()
+
+	timer := time.NewTimer(settleDelay)
+	timer.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			timer.Stop()
+			return
+
+		case <-w.notifier.C():
+			timer.Reset(settleDelay)
+
+		case <-timer.C:
+			w.onChange()
+		}
+	}
+}
+
+// Close stops watching.
+func (w *Watcher) Close() error {
+	err := w.notifier.Close()
+	close(w.done)
+	w.wg.Wait()
+	return err
+}
+
+// signal does a non-blocking send on c.  If a signal is already
+// pending there is no need for another.
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// fileState is what the poll notifier compares to detect changes.
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// pollNotifier detects changes by periodically scanning the directory.
+type pollNotifier struct {
+	dir      string
+	interval time.Duration
+	c        chan struct{}
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newPollNotifier(dir string, interval time.Duration) *pollNotifier {
+	n := &pollNotifier{
+		dir:      dir,
+		interval: interval,
+		c:        make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	// Scan before returning so that changes made right after we
+	// start watching are detected.
+	n.wg.Add(1)
+	go n.run(n.scan())
+	return n
+}
+
+func (n *pollNotifier) run(last map[string]fileState) {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+
+		case <-ticker.C:
+			current := n.scan()
+			if !sameFiles(last, current) {
+				signal(n.c)
+			}
+			last = current
+		}
+	}
+}
+
+func (n *pollNotifier) scan() map[string]fileState {
+	files := make(map[string]fileState)
+	filepath.Walk(n.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		files[path] = fileState{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return files
+}
+
+func sameFiles(a map[string]fileState, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, sa := range a {
+		sb, ok := b[path]
+		if !ok || sa.size != sb.size || !sa.modTime.Equal(sb.modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// C ...
+func (n *pollNotifier) C() <-chan struct{} {
+	return n.c
+}
+
+// Close ...
+func (n *pollNotifier) Close() error {
+	close(n.done)
+	n.wg.Wait()
+	return nil
+}
@@ -0,0 +1,73 @@
+//go:build linux
+
+package caldata
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// inotifyMask selects the events that mean a calibration file may have
+// been added, changed or removed.
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotifyNotifier detects changes using inotify.  Every directory
+// that exists when we start watching is watched, but directories
+// created later are not.
+type inotifyNotifier struct {
+	f *os.File
+	c chan struct{}
+}
+
+func newInotifyNotifier(dir string) (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		_, err = syscall.InotifyAddWatch(fd, path, inotifyMask)
+		return err
+	})
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	// Since the file descriptor is non-blocking, reads go through
+	// the runtime poller and closing the file makes a pending read
+	// return.
+	n := &inotifyNotifier{
+		f: os.NewFile(uintptr(fd), "inotify"),
+		c: make(chan struct{}, 1),
+	}
+	go n.run()
+	return n, nil
+}
+
+func (n *inotifyNotifier) run() {
+	// We reload the whole directory on any change so the events
+	// themselves are not interesting.
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		_, err := n.f.Read(buf)
+		if err != nil {
+			return
+		}
+		signal(n.c)
+	}
+}
+
+// C ...
+func (n *inotifyNotifier) C() <-chan struct{} {
+	return n.c
+}
+
+// Close ...
+func (n *inotifyNotifier) Close() error {
+	return n.f.Close()
+}
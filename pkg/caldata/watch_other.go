@@ -0,0 +1,11 @@
+//go:build !linux
+
+package caldata
+
+import (
+	"errors"
+)
+
+func newInotifyNotifier(_ string) (notifier, error) {
+	return nil, errors.New("inotify is only available on Linux")
+}
@@ -0,0 +1,169 @@
+// Package colocate aligns reference station measurements with device
+// measurements so that corrections can be fitted.
+package colocate
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+)
+
+// Errors returned when reading reference data.
+var (
+	ErrMissingColumn = errors.New("Column not found in reference data header")
+	ErrNoReference   = errors.New("No usable reference values")
+)
+
+// ReferenceFormat describes the layout of a reference CSV file.
+type ReferenceFormat struct {
+	Separator   rune   // Field separator, eg. ',' or ';' for NILU exports
+	TimeColumn  string // Name of the column holding the start of the averaging period
+	ValueColumn string // Name of the column holding the value
+	TimeLayout  string // Layout for time.Parse.  Empty means RFC3339.
+	Location    *time.Location
+}
+
+// ReferenceValue is one value from the reference station.
+type ReferenceValue struct {
+	Time  time.Time
+	Value float64
+}
+
+// ReadReference reads a reference time series in CSV format.  The
+// first line must be a header naming the columns.  Rows where the
+// value is empty or not a number are skipped since reference data
+// commonly has gaps.
+func ReadReference(r io.Reader, format ReferenceFormat) ([]ReferenceValue, error) {
+	reader := csv.NewReader(r)
+	if format.Separator != 0 {
+		reader.Comma = format.Separator
+	}
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	layout := format.TimeLayout
+	if layout == "" {
+		layout = time.RFC3339
+	}
+
+	loc := format.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	timeIndex := columnIndex(header, format.TimeColumn)
+	valueIndex := columnIndex(header, format.ValueColumn)
+	if timeIndex < 0 {
+		return nil, fmt.Errorf("%w: '%s'", ErrMissingColumn, format.TimeColumn)
+	}
+	if valueIndex < 0 {
+		return nil, fmt.Errorf("%w: '%s'", ErrMissingColumn, format.ValueColumn)
+	}
+
+	var values []ReferenceValue
+	line := 1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		line++
+		if err != nil {
+			return nil, err
+		}
+
+		if timeIndex >= len(record) || valueIndex >= len(record) {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(record[valueIndex]), ",", ".", 1), 64)
+		if err != nil || math.IsNaN(value) {
+			continue
+		}
+
+		t, err := time.ParseInLocation(layout, strings.TrimSpace(record[timeIndex]), loc)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		values = append(values, ReferenceValue{Time: t, Value: value})
+	}
+
+	if len(values) == 0 {
+		return nil, ErrNoReference
+	}
+	return values, nil
+}
+
+func columnIndex(header []string, name string) int {
+	for i, h := range header {
+		if strings.EqualFold(strings.TrimSpace(h), name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Align averages the device messages over each reference period
+// [Time:Time+interval> and returns one sample per period that has at
+// least minMessages messages.  The messages must be sorted by
+// ReceivedTime.  Reference values must be in ppb.  Uncalibrated
+// messages are skipped since they carry no values.
+func Align(refs []ReferenceValue, msgs []model.Message, component string, interval time.Duration, minMessages int) ([]model.CorrectionSample, error) {
+	var samples []model.CorrectionSample
+
+	for _, ref := range refs {
+		from := ref.Time.UnixMilli()
+		to := ref.Time.Add(interval).UnixMilli()
+
+		start := sort.Search(len(msgs), func(i int) bool {
+			return msgs[i].ReceivedTime >= from
+		})
+
+		var sum model.CorrectionSample
+		n := 0
+		for i := start; i < len(msgs) && msgs[i].ReceivedTime < to; i++ {
+			if msgs[i].Uncalibrated {
+				continue
+			}
+
+			v, err := model.ComponentValue(&msgs[i], component)
+			if err != nil {
+				return nil, err
+			}
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+
+			sum.PPB += v
+			sum.Temperature += msgs[i].AFE3TempValue
+			sum.Humidity += float64(msgs[i].BoardRelHumidity)
+			n++
+		}
+
+		if n == 0 || n < minMessages {
+			continue
+		}
+
+		samples = append(samples, model.CorrectionSample{
+			PPB:         sum.PPB / float64(n),
+			Temperature: sum.Temperature / float64(n),
+			Humidity:    sum.Humidity / float64(n),
+			Reference:   ref.Value,
+		})
+	}
+	return samples, nil
+}
@@ -0,0 +1,72 @@
+package colocate
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/stretchr/testify/assert"
+)
+
+const niluExport = `fromtime;totime;value;unit
+2022-03-01 00:00;2022-03-01 01:00;12,5;ug/m3
+2022-03-01 01:00;2022-03-01 02:00;;ug/m3
+2022-03-01 02:00;2022-03-01 03:00;20.0;ug/m3
+`
+
+func TestReadReference(t *testing.T) {
+	refs, err := ReadReference(strings.NewReader(niluExport), ReferenceFormat{
+		Separator:   ';',
+		TimeColumn:  "fromtime",
+		ValueColumn: "value",
+		TimeLayout:  "2006-01-02 15:04",
+	})
+	assert.Nil(t, err)
+
+	// The row without a value is skipped
+	assert.Equal(t, 2, len(refs))
+	assert.Equal(t, time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC), refs[0].Time)
+	assert.Equal(t, 12.5, refs[0].Value)
+	assert.Equal(t, 20.0, refs[1].Value)
+
+	_, err = ReadReference(strings.NewReader(niluExport), ReferenceFormat{Separator: ';', TimeColumn: "time", ValueColumn: "value"})
+	assert.ErrorIs(t, err, ErrMissingColumn)
+}
+
+func TestAlign(t *testing.T) {
+	t0 := time.Date(2022, 3, 1, 0, 0, 0, 0, time.UTC)
+	refs := []ReferenceValue{
+		{Time: t0, Value: 10},
+		{Time: t0.Add(time.Hour), Value: 20},
+		{Time: t0.Add(2 * time.Hour), Value: 30},
+	}
+
+	at := func(d time.Duration, ppb float64) model.Message {
+		return model.Message{ReceivedTime: t0.Add(d).UnixMilli(), NO2PPB: ppb, AFE3TempValue: 10, BoardRelHumidity: 40}
+	}
+	uncalibrated := at(20*time.Minute, 0)
+	uncalibrated.Uncalibrated = true
+
+	msgs := []model.Message{
+		at(10*time.Minute, 8),
+		uncalibrated,
+		at(40*time.Minute, 12),
+		at(70*time.Minute, 18),
+		// Nothing in the third hour
+	}
+
+	samples, err := Align(refs, msgs, model.ComponentNO2, time.Hour, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(samples))
+	assert.Equal(t, model.CorrectionSample{PPB: 10, Temperature: 10, Humidity: 40, Reference: 10}, samples[0])
+	assert.Equal(t, 18.0, samples[1].PPB)
+	assert.Equal(t, 20.0, samples[1].Reference)
+
+	samples, err = Align(refs, msgs, model.ComponentNO2, time.Hour, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(samples))
+
+	_, err = Align(refs, msgs, "co", time.Hour, 1)
+	assert.NotNil(t, err)
+}
@@ -4,24 +4,45 @@ import (
 	"time"
 )
 
+// Default sensor types for the three AFE3 channels.  These are used
+// when the calibration data does not specify the sensor type, and are
+// the lookup tables the channels have always used so that existing
+// calibration data gives the same results as before.
+const (
+	DefaultSensor1Type = "NO-A4"
+	DefaultSensor2Type = "NO2-A4"
+	DefaultSensor3Type = "O3-A4"
+)
+
 // Cal contains the calibration data for a device.
 type Cal struct {
-	ID           int64     `db:"id" json:"-"`
-	DeviceID     string    `db:"device_id" json:"deviceID"`
-	SysID        uint64    `db:"sysid" json:"sysID"` // System id, CPU id or similar
-	CollectionID string    `db:"collection_id" json:"collectionID"`
-	ValidFrom    time.Time `db:"valid_from" json:"from"`
+	ID           int64      `db:"id" json:"-"`
+	DeviceID     string     `db:"device_id" json:"deviceID"`
+	SysID        uint64     `db:"sysid" json:"sysID"` // System id, CPU id or similar
+	CollectionID string     `db:"collection_id" json:"collectionID"`
+	ValidFrom    time.Time  `db:"valid_from" json:"from"`
+	ValidTo      *time.Time `db:"valid_to" json:"to,omitempty"` // Optional end of validity, exclusive
 
 	// New fields
+	BoardType     string    `db:"board_type" json:"boardType"` // Selects the calculator, defaults to "afe3"
 	CircuitType   string    `db:"circuit_type" json:"circuitType"`
 	AFESerial     string    `db:"afe_serial" json:"afeSerial"`
 	AFEType       string    `db:"afe_type" json:"afeType"`
 	Sensor1Serial string    `db:"sensor1_serial" json:"sensor1Serial"`
 	Sensor2Serial string    `db:"sensor2_serial" json:"sensor2Serial"`
 	Sensor3Serial string    `db:"sensor3_serial" json:"sensor3Serial"`
+	Sensor1Type   string    `db:"sensor1_type" json:"sensor1Type"` // Sensor model, eg. "NO2-A4"
+	Sensor2Type   string    `db:"sensor2_type" json:"sensor2Type"`
+	Sensor3Type   string    `db:"sensor3_type" json:"sensor3Type"`
 	AFECalDate    time.Time `db:"afe_cal_date" json:"AFECalDate"` // When was the sensor calibrated
 	Vt20Offset    float64   `db:"vt20_offset" json:"vt20Offset"`  // Temperature offset for probe at 20C
 
+	// Temperature compensation algorithm per sensor, 0 for the legacy
+	// algorithm or 1 for AAN 803 algorithm 1
+	Sensor1Algorithm int `db:"sensor1_algorithm" json:"sensor1Algorithm"`
+	Sensor2Algorithm int `db:"sensor2_algorithm" json:"sensor2Algorithm"`
+	Sensor3Algorithm int `db:"sensor3_algorithm" json:"sensor3Algorithm"`
+
 	Sensor1WEe           int32   `db:"sensor1_we_e" json:"sensor1WEe"`                     // Unit: mV
 	Sensor1WE0           int32   `db:"sensor1_we_0" json:"sensor1WE0"`                     // Unit: mV
 	Sensor1AEe           int32   `db:"sensor1_ae_e" json:"sensor1AEe"`                     // Unit: mV
@@ -43,3 +64,47 @@ type Cal struct {
 	Sensor3PCBGain       float64 `db:"sensor3_pcb_gain" json:"sensor3PCBGain"`             // Unit: mV / nA
 	Sensor3WESensitivity float64 `db:"sensor3_we_sensitivity" json:"sensor3WESensitivity"` // Unit: mV / ppb
 }
+
+// Covers returns true if the calibration entry is valid at time t.
+func (c *Cal) Covers(t time.Time) bool {
+	if t.Before(c.ValidFrom) {
+		return false
+	}
+	return c.ValidTo == nil || t.Before(*c.ValidTo)
+}
+
+// SensorTypes returns the sensor types of the three channels, filling
+// in the default for channels where the type is not set.
+func (c *Cal) SensorTypes() [3]string {
+	types := [3]string{c.Sensor1Type, c.Sensor2Type, c.Sensor3Type}
+	defaults := [3]string{DefaultSensor1Type, DefaultSensor2Type, DefaultSensor3Type}
+	for i := range types {
+		if types[i] == "" {
+			types[i] = defaults[i]
+		}
+	}
+	return types
+}
+
+// Algorithms returns the temperature compensation algorithms of the
+// three channels.  Channels that do not specify an algorithm use
+// AlgorithmLegacy.
+func (c *Cal) Algorithms() [3]int {
+	return [3]int{c.Sensor1Algorithm, c.Sensor2Algorithm, c.Sensor3Algorithm}
+}
+
+// Validate checks that there is a calculator for the board type and,
+// if the calculator is able to, that the calibration data has what the
+// calculator needs.
+func (c *Cal) Validate() error {
+	calc, err := GetCalculator(c.BoardType)
+	if err != nil {
+		return err
+	}
+
+	v, ok := calc.(CalValidator)
+	if !ok {
+		return nil
+	}
+	return v.ValidateCal(c)
+}
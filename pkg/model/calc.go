@@ -2,9 +2,28 @@
 package model
 
 import (
+	"fmt"
+	"math"
+
 	"github.com/sgreben/piecewiselinear"
 )
 
+// Temperature compensation algorithms.  Algorithm 1 is from Alphasense
+// Application Note AAN 803.  Both use the nT lookup table.
+const (
+	// AlgorithmLegacy : WEc = (WEu - WEe - WE0) - nT * (AEu - AEe - AE0)
+	//
+	// This is how readings were compensated before the algorithm
+	// could be chosen, and is used when the calibration data does not
+	// specify an algorithm so that existing calibration data gives
+	// the same results as before.
+	AlgorithmLegacy = 0
+	// Algorithm1 : WEc = (WEu - WEe) - nT * (AEu - AEe)
+	Algorithm1 = 1
+)
+
+// sensorLut holds the temperature dependent correction factor nT for
+// a sensor type.
 type sensorLut struct {
 	LUT []float64
 }
@@ -19,8 +38,8 @@ var (
 	// Note AAN 803.  Included the whole table although we only need 3
 	// entries in case we will use any of these sensors in the future.
 	afe3Luts = map[string]sensorLut{
-		"CO-A4":  {LUT: []float64{1.0, 1.0, 1.0, 1.0, 1.0, -1.0, -0.76, -0.76 - 0.76}},
-		"CO2-B4": {LUT: []float64{-1.0, -1.0, -1.0, -1.0, -1.0, -1.0, -3.8 - 3.8 - 3.8}},
+		"CO-A4":  {LUT: []float64{1.0, 1.0, 1.0, 1.0, 1.0, -1.0, -0.76, -0.76, -0.76}},
+		"CO2-B4": {LUT: []float64{-1.0, -1.0, -1.0, -1.0, -1.0, -1.0, -3.8, -3.8, -3.8}},
 		"NO-A4":  {LUT: []float64{1.48, 1.48, 1.48, 1.48, 1.48, 2.02, 1.72, 1.72, 1.72}},
 		"NO-B4":  {LUT: []float64{1.04, 1.04, 1.04, 1.04, 1.04, 1.82, 2.0, 2.0, 2.0}},
 		"NO2-A4": {LUT: []float64{1.09, 1.09, 1.09, 1.09, 1.09, 1.35, 3.0, 3.0, 3.0}},
@@ -31,58 +50,218 @@ var (
 		"O3-B4":  {LUT: []float64{0.77, 0.77, 0.77, 0.77, 1.56, 1.56, 1.56, 2.85 /*, no value */}},
 	}
 
-	// Create correction functions for the sensors we use
-	correctSensor1 = correctionFuncFromName("NO-A4")
-	correctSensor2 = correctionFuncFromName("NO2-A4")
-	correctSensor3 = correctionFuncFromName("O3-A4")
+	// Correction functions for all the sensors in afe3Luts
+	correctionFuncs = correctionFuncsFromLuts()
 )
 
+func init() {
+	RegisterCalculator(afe3Calculator{})
+}
+
+// afe3Calculator calculates gas concentrations for boards with the
+// Alphasense AFE3 analog front end.
+type afe3Calculator struct{}
+
+// Name ...
+func (afe3Calculator) Name() string {
+	return "afe3"
+}
+
+// Inputs ...
+func (afe3Calculator) Inputs() []string {
+	return []string{
+		"afe3_temp_raw",
+		"sensor1work", "sensor1aux",
+		"sensor2work", "sensor2aux",
+		"sensor3work", "sensor3aux",
+	}
+}
+
+// Outputs ...
+func (afe3Calculator) Outputs() []string {
+	return []string{"afe3_temp_value", "no2_ppb", "o3_ppb", "no_ppb"}
+}
+
+// Calculate ...
+func (afe3Calculator) Calculate(m *Message, cal *Cal) error {
+	CalculateSensorValues(m, cal)
+	return nil
+}
+
+// ValidateCal checks that the calibration data refers to sensor types
+// and algorithms we have temperature correction tables for.
+func (afe3Calculator) ValidateCal(c *Cal) error {
+	algorithms := c.Algorithms()
+
+	for i, t := range c.SensorTypes() {
+		_, ok := afe3Luts[t]
+		if !ok {
+			return fmt.Errorf("unknown sensor type '%s' for sensor %d", t, i+1)
+		}
+
+		if algorithms[i] != AlgorithmLegacy && algorithms[i] != Algorithm1 {
+			return fmt.Errorf("unknown algorithm %d for sensor %d", algorithms[i], i+1)
+		}
+	}
+	return nil
+}
+
+// afe3Channel holds the readings and calibration data for one of the
+// AFE3 sensor channels.
+type afe3Channel struct {
+	sensorType  string
+	algorithm   int
+	work        uint32
+	aux         uint32
+	weE         int32
+	we0         int32
+	aeE         int32
+	ae0         int32
+	gain        float64
+	sensitivity float64
+}
+
+// afe3Channels returns the three sensor channels of m.
+func afe3Channels(m *Message, cal *Cal) [3]afe3Channel {
+	sensorTypes := cal.SensorTypes()
+	algorithms := cal.Algorithms()
+
+	return [3]afe3Channel{
+		{sensorTypes[0], algorithms[0], m.Sensor1Work, m.Sensor1Aux, cal.Sensor1WEe, cal.Sensor1WE0, cal.Sensor1AEe, cal.Sensor1AE0, cal.Sensor1PCBGain, cal.Sensor1WESensitivity},
+		{sensorTypes[1], algorithms[1], m.Sensor2Work, m.Sensor2Aux, cal.Sensor2WEe, cal.Sensor2WE0, cal.Sensor2AEe, cal.Sensor2AE0, cal.Sensor2PCBGain, cal.Sensor2WESensitivity},
+		{sensorTypes[2], algorithms[2], m.Sensor3Work, m.Sensor3Aux, cal.Sensor3WEe, cal.Sensor3WE0, cal.Sensor3AEe, cal.Sensor3AE0, cal.Sensor3PCBGain, cal.Sensor3WESensitivity},
+	}
+}
+
 // CalculateSensorValues calculates sensor values using measured data
 // and calibration data specific to the the device.
+//
+// For each sensor channel the calculation is done in these steps:
+//
+//  1. The raw ADC readings of the working and auxiliary electrodes
+//     are converted to mV (WEu and AEu).
+//  2. The electronic zero (WEe, AEe) is subtracted and the result is
+//     temperature compensated using the channel's algorithm, giving
+//     the corrected working electrode voltage WEc in mV.
+//  3. WEc is divided by the PCB gain (mV/nA) to get the sensor
+//     current in nA.
+//  4. The current is divided by the sensor sensitivity in nA/ppb,
+//     which is the WE sensitivity (mV/ppb) divided by the PCB gain,
+//     to get the concentration in ppb.
+//
+// If the PCB gain is missing from the calibration data step 3 is
+// skipped and the concentration is computed directly from WEc and
+// the WE sensitivity, which gives the same result.
+//
+// If m.CalcDebug is non-nil the intermediate values are recorded in
+// it.
 func CalculateSensorValues(m *Message, cal *Cal) {
 
 	// Calculate the temperature.
 	// TODO(borud): have @tlan and @hansj double-check this
 	m.AFE3TempValue = ((float64(m.AFE3TempRaw) * afe3ScalingFactor) - cal.Vt20Offset + 0.02) * 1000.0
 
-	var sensor1TempCorrectionFactor = correctSensor1(m.AFE3TempValue)
-	var sensor2TempCorrectionFactor = correctSensor2(m.AFE3TempValue)
-	var sensor3TempCorrectionFactor = correctSensor3(m.AFE3TempValue)
+	var ppb [3]float64
+	for i, ch := range afe3Channels(m, cal) {
+		var debug *SensorDebug
+		if m.CalcDebug != nil {
+			debug = &m.CalcDebug.Sensors[i]
+		}
+		ppb[i] = ch.ppb(m.AFE3TempValue, debug)
+	}
 
-	// Sensor 1 - NO2 sensor
-	{
-		wmV := voltage(m.Sensor1Work, cal.Sensor1WEe, cal.Sensor1WE0)
-		amV := voltage(m.Sensor1Aux, cal.Sensor1AEe, cal.Sensor1AE0) * sensor1TempCorrectionFactor
-		m.NO2PPB = (wmV - amV) / cal.Sensor1WESensitivity
+	if m.CalcDebug != nil {
+		m.CalcDebug.Temperature = m.AFE3TempValue
 	}
 
+	// Sensor 1 - NO2 sensor
+	m.NO2PPB = ppb[0]
+
 	// Sensor 2 - O3 + NO2 sensor, calculate O3 by subtracting NO2 sensor value
-	{
-		wmV := voltage(m.Sensor2Work, cal.Sensor2WEe, cal.Sensor2WE0)
-		amV := voltage(m.Sensor2Aux, cal.Sensor2AEe, cal.Sensor2AE0) * sensor2TempCorrectionFactor
-		m.O3PPB = ((wmV - amV) / cal.Sensor2WESensitivity) - m.NO2PPB
-	}
+	m.O3PPB = ppb[1] - m.NO2PPB
 
 	// Sensor 3 - NO sensor
-	{
-		wmV := voltage(m.Sensor3Work, cal.Sensor3WEe, cal.Sensor3WE0)
-		amV := voltage(m.Sensor3Aux, cal.Sensor3AEe, cal.Sensor3AE0) * sensor3TempCorrectionFactor
-		m.NOPPB = (wmV - amV) / cal.Sensor3WESensitivity
+	m.NOPPB = ppb[2]
+}
+
+// ppb runs the calculation steps for the channel at temperature t.  If
+// debug is non-nil the intermediate values are recorded in it.
+func (ch afe3Channel) ppb(t float64, debug *SensorDebug) float64 {
+	weu := millivolts(ch.work)
+	aeu := millivolts(ch.aux)
+
+	f := correctionFactor(ch.sensorType, t)
+	wec := compensate(ch.algorithm, f, weu, aeu, ch.weE, ch.we0, ch.aeE, ch.ae0)
+
+	var current float64
+	ppb := wec / ch.sensitivity
+	if ch.gain != 0 {
+		current = wec / ch.gain
+		ppb = current / (ch.sensitivity / ch.gain)
+	}
+
+	if debug != nil {
+		*debug = SensorDebug{
+			SensorType:       ch.sensorType,
+			Algorithm:        ch.algorithm,
+			WEuMV:            weu,
+			AEuMV:            aeu,
+			CorrectionFactor: f,
+			WEcMV:            wec,
+			CurrentNA:        current,
+			PPB:              ppb,
+		}
 	}
+	return ppb
 }
 
-func voltage(w uint32, offset int32, zero int32) float64 {
-	return (float64(w) * afe3ScalingFactor * 1000) - float64(offset+zero)
+// millivolts converts a raw ADC reading to mV.
+func millivolts(w uint32) float64 {
+	return float64(w) * afe3ScalingFactor * 1000
 }
 
-func correctionFuncFromName(name string) func(float64) float64 {
-	lut, ok := afe3Luts[name]
+// compensate returns the temperature compensated working electrode
+// voltage WEc in mV according to the given algorithm.  weu
+// and aeu are the uncorrected working and auxiliary electrode
+// voltages, f is the temperature dependent factor nT.
+func compensate(algorithm int, f float64, weu float64, aeu float64, weE int32, we0 int32, aeE int32, ae0 int32) float64 {
+	we := weu - float64(weE)
+	ae := aeu - float64(aeE)
+
+	switch algorithm {
+	case AlgorithmLegacy:
+		return (we - float64(we0)) - f*(ae-float64(ae0))
+	case Algorithm1:
+		return we - f*ae
+	}
+	return math.NaN()
+}
+
+// correctionFactor returns the temperature correction factor nT for
+// the sensor type at temperature t.  Unknown sensor types give NaN
+// since we have no way of computing a meaningful value.  Calibration
+// data is validated on import so this should not happen.
+func correctionFactor(sensorType string, t float64) float64 {
+	f, ok := correctionFuncs[sensorType]
 	if !ok {
-		panic("Sensor name not found: " + name)
+		return math.NaN()
 	}
+	return f(t)
+}
+
+func correctionFuncsFromLuts() map[string]func(float64) float64 {
+	funcs := make(map[string]func(float64) float64)
+	for name, lut := range afe3Luts {
+		funcs[name] = lutFunc(lut.LUT)
+	}
+	return funcs
+}
 
-	f := piecewiselinear.Function{Y: lut.LUT}
-	f.X = afe3LutTemperatures[:len(lut.LUT)]
+// lutFunc returns a function that interpolates linearly between the
+// values in the lookup table.
+func lutFunc(lut []float64) func(float64) float64 {
+	f := piecewiselinear.Function{Y: lut}
+	f.X = afe3LutTemperatures[:len(lut)]
 
 	return func(t float64) float64 {
 		return f.At(t)
@@ -2,6 +2,7 @@ package model
 
 import (
 	"math"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -58,8 +59,8 @@ func TestCalculateSensorValues(_ *testing.T) {
 
 func TestAFE3LUTs(t *testing.T) {
 	// Ensure the lookup tables are correct
-	assert.Equal(t, afe3Luts["CO-A4"].LUT, []float64{1.0, 1.0, 1.0, 1.0, 1.0, -1.0, -0.76, -0.76 - 0.76})
-	assert.Equal(t, afe3Luts["CO2-B4"].LUT, []float64{-1.0, -1.0, -1.0, -1.0, -1.0, -1.0, -3.8 - 3.8 - 3.8})
+	assert.Equal(t, afe3Luts["CO-A4"].LUT, []float64{1.0, 1.0, 1.0, 1.0, 1.0, -1.0, -0.76, -0.76, -0.76})
+	assert.Equal(t, afe3Luts["CO2-B4"].LUT, []float64{-1.0, -1.0, -1.0, -1.0, -1.0, -1.0, -3.8, -3.8, -3.8})
 	assert.Equal(t, afe3Luts["NO-A4"].LUT, []float64{1.48, 1.48, 1.48, 1.48, 1.48, 2.02, 1.72, 1.72, 1.72})
 	assert.Equal(t, afe3Luts["NO-B4"].LUT, []float64{1.04, 1.04, 1.04, 1.04, 1.04, 1.82, 2.0, 2.0, 2.0})
 	assert.Equal(t, afe3Luts["NO2-A4"].LUT, []float64{1.09, 1.09, 1.09, 1.09, 1.09, 1.35, 3.0, 3.0, 3.0})
@@ -83,11 +84,180 @@ func TestInterpolation(t *testing.T) {
 	//	perform a simple test to check that the spline matching is
 	//	within reasonable limits for at least the spline points
 	for k, v := range afe3Luts {
-		f := correctionFuncFromName(k)
-		assert.NotNil(t, f)
-
 		for i := 0; i < len(v.LUT); i++ {
-			assert.True(t, compare(v.LUT[i], f(afe3LutTemperatures[i])))
+			assert.True(t, compare(v.LUT[i], correctionFactor(k, afe3LutTemperatures[i])))
+		}
+	}
+}
+
+func TestCalValidate(t *testing.T) {
+	cal := &Cal{}
+	assert.Nil(t, cal.Validate())
+	assert.Equal(t, [3]string{"NO-A4", "NO2-A4", "O3-A4"}, cal.SensorTypes())
+
+	cal.Sensor1Type = "NO2-B4"
+	assert.Nil(t, cal.Validate())
+	assert.Equal(t, "NO2-B4", cal.SensorTypes()[0])
+
+	cal.Sensor3Type = "XX-A4"
+	assert.NotNil(t, cal.Validate())
+}
+
+func TestCalculateSensorValuesUsesSensorType(t *testing.T) {
+	a := *messageTest
+	CalculateSensorValues(&a, calTest)
+
+	cal := *calTest
+	cal.Sensor1Type = "NO2-B4"
+	b := *messageTest
+	CalculateSensorValues(&b, &cal)
+
+	// Only the channel with a different sensor type should change
+	assert.NotEqual(t, a.NO2PPB, b.NO2PPB)
+	assert.Equal(t, a.NOPPB, b.NOPPB)
+
+	cal.Sensor1Type = "XX-A4"
+	CalculateSensorValues(&b, &cal)
+	assert.True(t, math.IsNaN(b.NO2PPB))
+}
+
+// TestCalculateSensorValuesRegression checks that calibration data
+// that specifies neither sensor types nor algorithms gives the same
+// values as before they could be chosen.  The expected values were
+// computed with the implementation in the baseline commit c708630.
+func TestCalculateSensorValuesRegression(t *testing.T) {
+	tests := []struct {
+		tempRaw uint32
+		temp    float64
+		no2     float64
+		o3      float64
+		no      float64
+	}{
+		{540375, 22.588599229925, 10.518538387257, 18.149803237003, 4.683162919943},
+		{560000, 34.286010768000, 10.859047376215, 21.149380999545, 4.683162919943},
+		{500000, -1.476776100000, 11.226598935788, 15.564997195051, -23.333493387522},
+	}
+
+	for _, test := range tests {
+		cal := *calTest
+		m := *messageTest
+		m.AFE3TempRaw = test.tempRaw
+		CalculateSensorValues(&m, &cal)
+
+		assert.InDelta(t, test.temp, m.AFE3TempValue, 1e-9)
+		assert.InDelta(t, test.no2, m.NO2PPB, 1e-9)
+		assert.InDelta(t, test.o3, m.O3PPB, 1e-9)
+		assert.InDelta(t, test.no, m.NOPPB, 1e-9)
+	}
+}
+
+// TestCompensate checks the algorithms using hand-worked examples.
+// WEu = 300 mV, WEe = 250 mV, AEu = 270 mV, AEe = 260 mV, WE0 = 20 mV,
+// AE0 = 10 mV, which gives WEu - WEe = 50 mV and AEu - AEe = 10 mV.
+func TestCompensate(t *testing.T) {
+	tests := []struct {
+		algorithm int
+		f         float64
+		expected  float64
+	}{
+		// (50 - 20) - 1.5 * (10 - 10)
+		{AlgorithmLegacy, 1.5, 30.0},
+		// (50 - 20) - 0.5 * (10 - 10), nT does not matter when AEu - AEe = AE0
+		{AlgorithmLegacy, 0.5, 30.0},
+		// 50 - 1.5 * 10
+		{Algorithm1, 1.5, 35.0},
+		// Negative factors, as found at high temperatures
+		{Algorithm1, -0.5, 55.0},
+		{AlgorithmLegacy, -0.5, 30.0},
+	}
+
+	for _, test := range tests {
+		wec := compensate(test.algorithm, test.f, 300.0, 270.0, 250, 20, 260, 10)
+		assert.InDelta(t, test.expected, wec, 1e-9, "algorithm %d f=%f", test.algorithm, test.f)
+	}
+
+	assert.True(t, math.IsNaN(compensate(2, 1.0, 300.0, 270.0, 250, 20, 260, 10)))
+}
+
+func TestAlgorithmLUTs(t *testing.T) {
+	for name, lut := range afe3Luts {
+		// Only the O3 sensors lack a value at 50C
+		if !strings.HasPrefix(name, "O3-") {
+			assert.Equal(t, len(afe3LutTemperatures), len(lut.LUT), name)
 		}
+
+		assert.True(t, len(lut.LUT) <= len(afe3LutTemperatures), name)
+		assert.InDelta(t, lut.LUT[0], correctionFactor(name, afe3LutTemperatures[0]), 1e-9)
+	}
+
+	// Interpolation between 20C and 30C for NO2-A4 nT (1.35 and 3.0)
+	assert.InDelta(t, 2.175, correctionFactor("NO2-A4", 25.0), 1e-9)
+
+	// Unknown sensor type
+	assert.True(t, math.IsNaN(correctionFactor("XX-A4", 20.0)))
+}
+
+func TestCalValidateAlgorithm(t *testing.T) {
+	cal := &Cal{}
+	assert.Equal(t, [3]int{AlgorithmLegacy, AlgorithmLegacy, AlgorithmLegacy}, cal.Algorithms())
+	assert.Nil(t, cal.Validate())
+
+	cal.Sensor1Algorithm = Algorithm1
+	assert.Nil(t, cal.Validate())
+
+	cal.Sensor1Algorithm = 7
+	assert.NotNil(t, cal.Validate())
+
+	cal.Sensor1Algorithm = -1
+	assert.NotNil(t, cal.Validate())
+
+	// AAN 803 algorithms 2 through 4 are not supported
+	for _, algorithm := range []int{2, 3, 4} {
+		cal.Sensor1Algorithm = algorithm
+		assert.NotNil(t, cal.Validate())
 	}
 }
+
+func TestCalculateSensorValuesDebug(t *testing.T) {
+	m := *messageTest
+	m.CalcDebug = &CalcDebug{}
+	CalculateSensorValues(&m, calTest)
+
+	assert.Equal(t, m.AFE3TempValue, m.CalcDebug.Temperature)
+
+	s := m.CalcDebug.Sensors[0]
+	assert.Equal(t, "NO-A4", s.SensorType)
+	assert.Equal(t, AlgorithmLegacy, s.Algorithm)
+	assert.InDelta(t, millivolts(messageTest.Sensor1Work), s.WEuMV, 1e-9)
+	assert.InDelta(t, millivolts(messageTest.Sensor1Aux), s.AEuMV, 1e-9)
+
+	// Each step must follow from the previous one
+	assert.InDelta(t, (s.WEuMV-float64(calTest.Sensor1WEe+calTest.Sensor1WE0))-s.CorrectionFactor*(s.AEuMV-float64(calTest.Sensor1AEe+calTest.Sensor1AE0)), s.WEcMV, 1e-9)
+	assert.InDelta(t, s.WEcMV/calTest.Sensor1PCBGain, s.CurrentNA, 1e-9)
+	assert.InDelta(t, s.CurrentNA/(calTest.Sensor1WESensitivity/calTest.Sensor1PCBGain), s.PPB, 1e-9)
+	assert.InDelta(t, m.NO2PPB, s.PPB, 1e-9)
+
+	// O3 is the difference between sensor 2 and sensor 1
+	assert.InDelta(t, m.CalcDebug.Sensors[1].PPB-m.NO2PPB, m.O3PPB, 1e-9)
+
+	// Without debug output the results are the same
+	plain := *messageTest
+	CalculateSensorValues(&plain, calTest)
+	assert.Nil(t, plain.CalcDebug)
+	assert.Equal(t, m.NO2PPB, plain.NO2PPB)
+}
+
+func TestCalculateSensorValuesWithoutGain(t *testing.T) {
+	cal := *calTest
+	cal.Sensor3PCBGain = 0
+
+	a := *messageTest
+	CalculateSensorValues(&a, calTest)
+
+	b := *messageTest
+	b.CalcDebug = &CalcDebug{}
+	CalculateSensorValues(&b, &cal)
+
+	assert.InDelta(t, a.NOPPB, b.NOPPB, 1e-9)
+	assert.Equal(t, 0.0, b.CalcDebug.Sensors[2].CurrentNA)
+}
@@ -0,0 +1,21 @@
+package model
+
+// CalcDebug holds the intermediate values of the sensor calculation.
+// It is meant for validating the calculation against bench data and
+// is never persisted.
+type CalcDebug struct {
+	Temperature float64        `json:"temperature"` // Temperature used for compensation, C
+	Sensors     [3]SensorDebug `json:"sensors"`
+}
+
+// SensorDebug holds the intermediate values for one sensor channel.
+type SensorDebug struct {
+	SensorType       string  `json:"sensorType"`
+	Algorithm        int     `json:"algorithm"`
+	WEuMV            float64 `json:"weuMV"`            // Uncorrected working electrode, mV
+	AEuMV            float64 `json:"aeuMV"`            // Uncorrected auxiliary electrode, mV
+	CorrectionFactor float64 `json:"correctionFactor"` // Temperature dependent factor for the algorithm
+	WEcMV            float64 `json:"wecMV"`            // Corrected working electrode, mV
+	CurrentNA        float64 `json:"currentNA"`        // Sensor current, nA.  Zero if PCB gain is missing
+	PPB              float64 `json:"ppb"`              // Concentration, ppb
+}
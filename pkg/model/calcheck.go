@@ -0,0 +1,147 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Kinds of calibration issues reported by CheckCals.
+const (
+	CalIssueInvalidRange = "invalid-range" // ValidTo is not after ValidFrom
+	CalIssueOverlap      = "overlap"       // Two entries are valid at the same time
+	CalIssueGap          = "gap"           // No entry is valid between two entries
+	CalIssueEnded        = "ended"         // The newest entry has ended, so there is no calibration now
+)
+
+// CalIssue is a problem found in the calibration entries of a device.
+type CalIssue struct {
+	Kind         string
+	DeviceID     string
+	SysID        uint64
+	CollectionID string
+	From         time.Time // Start of the affected period
+	To           time.Time // End of the affected period, zero if open ended
+	CalIDs       []int64   // The calibration entries involved
+}
+
+// String ...
+func (i CalIssue) String() string {
+	to := "-"
+	if !i.To.IsZero() {
+		to = i.To.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("%-13s device=%s sysID=%d collection=%s from=%s to=%s cals=%v", i.Kind, i.DeviceID, i.SysID, i.CollectionID, i.From.Format(time.RFC3339), to, i.CalIDs)
+}
+
+// calGroup identifies the calibration entries that compete for the
+// same messages.
+type calGroup struct {
+	sysID        uint64
+	collectionID string
+}
+
+// CheckCals looks for gaps and overlaps in the validity periods of the
+// calibration entries.  The entries of a device are grouped by the
+// SysID of its board and by collection, since that is what calibration
+// entries are looked up by.  An entry is valid when it Covers the
+// time, the same as when calibration entries are looked up, so an entry
+// without ValidTo overlaps every entry that starts after it.  now is
+// used to detect entries that have ended.
+func CheckCals(cals []Cal, now time.Time) []CalIssue {
+	groups := make(map[calGroup][]Cal)
+	for _, c := range cals {
+		key := calGroup{sysID: c.SysID, collectionID: c.CollectionID}
+		groups[key] = append(groups[key], c)
+	}
+
+	keys := make([]calGroup, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].sysID != keys[j].sysID {
+			return keys[i].sysID < keys[j].sysID
+		}
+		return keys[i].collectionID < keys[j].collectionID
+	})
+
+	var issues []CalIssue
+	for _, key := range keys {
+		issues = append(issues, checkDeviceCals(groups[key], now)...)
+	}
+	return issues
+}
+
+// checkDeviceCals checks the entries of one group.  An entry may
+// overlap any of the entries before it, not just the previous one, so
+// we keep track of the entry that ends last so far.
+func checkDeviceCals(cals []Cal, now time.Time) []CalIssue {
+	sort.SliceStable(cals, func(i, j int) bool {
+		return cals[i].ValidFrom.Before(cals[j].ValidFrom)
+	})
+
+	var issues []CalIssue
+	issue := func(kind string, from time.Time, to time.Time, c ...Cal) {
+		ids := make([]int64, len(c))
+		for i := range c {
+			ids[i] = c[i].ID
+		}
+		issues = append(issues, CalIssue{Kind: kind, DeviceID: c[0].DeviceID, SysID: c[0].SysID, CollectionID: c[0].CollectionID, From: from, To: to, CalIDs: ids})
+	}
+
+	// The entry that ends last so far.  An entry without ValidTo
+	// never ends.
+	var lastEnd *Cal
+	for i := range cals {
+		c := cals[i]
+		if c.ValidTo != nil && !c.ValidTo.After(c.ValidFrom) {
+			issue(CalIssueInvalidRange, c.ValidFrom, *c.ValidTo, c)
+			continue
+		}
+
+		switch {
+		case lastEnd == nil:
+
+		case lastEnd.Covers(c.ValidFrom):
+			issue(CalIssueOverlap, c.ValidFrom, earliestEnd(lastEnd, &c), *lastEnd, c)
+
+		case lastEnd.ValidTo.Before(c.ValidFrom):
+			issue(CalIssueGap, *lastEnd.ValidTo, c.ValidFrom, *lastEnd, c)
+		}
+
+		if lastEnd == nil || endsAfter(&c, lastEnd) {
+			lastEnd = &cals[i]
+		}
+	}
+
+	if lastEnd != nil && lastEnd.ValidTo != nil && lastEnd.ValidTo.Before(now) {
+		issue(CalIssueEnded, *lastEnd.ValidTo, time.Time{}, *lastEnd)
+	}
+	return issues
+}
+
+// endsAfter returns true if a is valid for longer than b.
+func endsAfter(a *Cal, b *Cal) bool {
+	switch {
+	case b.ValidTo == nil:
+		return false
+	case a.ValidTo == nil:
+		return true
+	}
+	return a.ValidTo.After(*b.ValidTo)
+}
+
+// earliestEnd returns the earliest ValidTo of a and b, or the zero
+// time if neither of them ends.
+func earliestEnd(a *Cal, b *Cal) time.Time {
+	switch {
+	case a.ValidTo == nil && b.ValidTo == nil:
+		return time.Time{}
+	case a.ValidTo == nil:
+		return *b.ValidTo
+	case b.ValidTo == nil || a.ValidTo.Before(*b.ValidTo):
+		return *a.ValidTo
+	}
+	return *b.ValidTo
+}
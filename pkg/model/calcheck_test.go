@@ -0,0 +1,94 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckCals(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2022, 1, d, 0, 0, 0, 0, time.UTC) }
+	until := func(d int) *time.Time { t := day(d); return &t }
+	now := day(30)
+
+	cals := []Cal{
+		// Device 1: 1 -> 5, gap, 10 -> 20 overlapping 15 -> open
+		{ID: 1, DeviceID: "d1", SysID: 1, ValidFrom: day(1), ValidTo: until(5)},
+		{ID: 3, DeviceID: "d1", SysID: 1, ValidFrom: day(15)},
+		{ID: 2, DeviceID: "d1", SysID: 1, ValidFrom: day(10), ValidTo: until(20)},
+
+		// Device 2: open entry overlapping a later one, and still
+		// valid after it has ended
+		{ID: 4, DeviceID: "d2", SysID: 2, ValidFrom: day(1)},
+		{ID: 5, DeviceID: "d2", SysID: 2, ValidFrom: day(10), ValidTo: until(20)},
+
+		// Device 3: invalid range
+		{ID: 6, DeviceID: "d3", SysID: 3, ValidFrom: day(10), ValidTo: until(10)},
+
+		// Device 4: same start
+		{ID: 7, DeviceID: "d4", SysID: 4, ValidFrom: day(10)},
+		{ID: 8, DeviceID: "d4", SysID: 4, ValidFrom: day(10)},
+
+		// Device 5: back to back, then ended
+		{ID: 9, DeviceID: "d5", SysID: 5, ValidFrom: day(1), ValidTo: until(10)},
+		{ID: 10, DeviceID: "d5", SysID: 5, ValidFrom: day(10), ValidTo: until(20)},
+	}
+
+	issues := CheckCals(cals, now)
+	assert.Equal(t, []CalIssue{
+		{Kind: CalIssueGap, DeviceID: "d1", SysID: 1, From: day(5), To: day(10), CalIDs: []int64{1, 2}},
+		{Kind: CalIssueOverlap, DeviceID: "d1", SysID: 1, From: day(15), To: day(20), CalIDs: []int64{2, 3}},
+		{Kind: CalIssueOverlap, DeviceID: "d2", SysID: 2, From: day(10), To: day(20), CalIDs: []int64{4, 5}},
+		{Kind: CalIssueInvalidRange, DeviceID: "d3", SysID: 3, From: day(10), To: day(10), CalIDs: []int64{6}},
+		{Kind: CalIssueOverlap, DeviceID: "d4", SysID: 4, From: day(10), CalIDs: []int64{7, 8}},
+		{Kind: CalIssueEnded, DeviceID: "d5", SysID: 5, From: day(20), CalIDs: []int64{10}},
+	}, issues)
+
+	// The issues match what the entries cover
+	assert.True(t, cals[3].Covers(now))
+	assert.True(t, cals[3].Covers(day(15)) && cals[4].Covers(day(15)))
+	assert.False(t, cals[9].Covers(now))
+
+	assert.Empty(t, CheckCals(cals[3:4], now))
+}
+
+func TestCheckCalsContained(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2022, 1, d, 0, 0, 0, 0, time.UTC) }
+	until := func(d int) *time.Time { t := day(d); return &t }
+	now := day(30)
+
+	// 1 -> 25 contains both 5 -> 10 and 15 -> 20, so there is no gap
+	// between them.  The entries continue with 25 -> open.
+	cals := []Cal{
+		{ID: 1, DeviceID: "d1", SysID: 1, ValidFrom: day(1), ValidTo: until(25)},
+		{ID: 2, DeviceID: "d1", SysID: 1, ValidFrom: day(5), ValidTo: until(10)},
+		{ID: 3, DeviceID: "d1", SysID: 1, ValidFrom: day(15), ValidTo: until(20)},
+		{ID: 4, DeviceID: "d1", SysID: 1, ValidFrom: day(25)},
+	}
+
+	assert.Equal(t, []CalIssue{
+		{Kind: CalIssueOverlap, DeviceID: "d1", SysID: 1, From: day(5), To: day(10), CalIDs: []int64{1, 2}},
+		{Kind: CalIssueOverlap, DeviceID: "d1", SysID: 1, From: day(15), To: day(20), CalIDs: []int64{1, 3}},
+	}, CheckCals(cals, now))
+
+	// Without the open entry the calibration has ended when the
+	// longest entry ends
+	assert.Equal(t, CalIssue{Kind: CalIssueEnded, DeviceID: "d1", SysID: 1, From: day(25), CalIDs: []int64{1}}, CheckCals(cals[:3], now)[2])
+}
+
+func TestCheckCalsCollections(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2022, 1, d, 0, 0, 0, 0, time.UTC) }
+
+	// Entries for different collections do not compete
+	cals := []Cal{
+		{ID: 1, DeviceID: "d1", SysID: 1, CollectionID: "pilot", ValidFrom: day(1)},
+		{ID: 2, DeviceID: "d1", SysID: 1, CollectionID: "production", ValidFrom: day(1)},
+	}
+	assert.Empty(t, CheckCals(cals, day(30)))
+
+	cals = append(cals, Cal{ID: 3, DeviceID: "d1", SysID: 1, CollectionID: "pilot", ValidFrom: day(1)})
+	assert.Equal(t, []CalIssue{
+		{Kind: CalIssueOverlap, DeviceID: "d1", SysID: 1, CollectionID: "pilot", From: day(1), CalIDs: []int64{1, 3}},
+	}, CheckCals(cals, day(30)))
+}
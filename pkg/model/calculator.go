@@ -0,0 +1,87 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DefaultBoardType is the board type assumed when calibration data
+// does not specify one.
+const DefaultBoardType = "afe3"
+
+// Calculator computes the derived values of a message for a
+// particular type of sensor board.  Inputs and Outputs name the
+// message fields, using their database column names, that the
+// calculator reads and writes.
+type Calculator interface {
+	Name() string
+	Inputs() []string
+	Outputs() []string
+	Calculate(m *Message, cal *Cal) error
+}
+
+// CalValidator is implemented by calculators that can check that
+// calibration data contains what they need.
+type CalValidator interface {
+	ValidateCal(cal *Cal) error
+}
+
+var (
+	calculatorsMu sync.RWMutex
+	calculators   = make(map[string]Calculator)
+)
+
+// RegisterCalculator makes a calculator available under its name.  It
+// panics if a calculator with the same name is already registered
+// since that is a programming error.
+func RegisterCalculator(c Calculator) {
+	calculatorsMu.Lock()
+	defer calculatorsMu.Unlock()
+
+	if _, ok := calculators[c.Name()]; ok {
+		panic("calculator already registered: " + c.Name())
+	}
+	calculators[c.Name()] = c
+}
+
+// GetCalculator returns the calculator for the board type.  An empty
+// board type gives the calculator for DefaultBoardType.
+func GetCalculator(boardType string) (Calculator, error) {
+	if boardType == "" {
+		boardType = DefaultBoardType
+	}
+
+	calculatorsMu.RLock()
+	defer calculatorsMu.RUnlock()
+
+	c, ok := calculators[boardType]
+	if !ok {
+		return nil, fmt.Errorf("no calculator for board type '%s'", boardType)
+	}
+	return c, nil
+}
+
+// Calculators returns the names of the registered calculators in
+// sorted order.
+func Calculators() []string {
+	calculatorsMu.RLock()
+	defer calculatorsMu.RUnlock()
+
+	names := make([]string, 0, len(calculators))
+	for name := range calculators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Calculate computes the derived values of m using the calculator for
+// the board type given by the calibration data.
+func Calculate(m *Message, cal *Cal) error {
+	c, err := GetCalculator(cal.BoardType)
+	if err != nil {
+		return err
+	}
+	return c.Calculate(m, cal)
+}
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCalculator struct{}
+
+func (fakeCalculator) Name() string      { return "fake" }
+func (fakeCalculator) Inputs() []string  { return []string{"boardtemp"} }
+func (fakeCalculator) Outputs() []string { return []string{"no2_ppb"} }
+
+func (fakeCalculator) Calculate(m *Message, _ *Cal) error {
+	m.NO2PPB = float64(m.BoardTemp) * 2
+	return nil
+}
+
+func TestCalculatorRegistry(t *testing.T) {
+	c, err := GetCalculator("")
+	assert.Nil(t, err)
+	assert.Equal(t, "afe3", c.Name())
+	assert.Contains(t, c.Outputs(), "no2_ppb")
+
+	_, err = GetCalculator("no-such-board")
+	assert.NotNil(t, err)
+
+	assert.Panics(t, func() { RegisterCalculator(afe3Calculator{}) })
+
+	// The registry is global, so unregister the fake calculator to
+	// be able to run the test more than once.
+	RegisterCalculator(fakeCalculator{})
+	defer func() {
+		calculatorsMu.Lock()
+		defer calculatorsMu.Unlock()
+		delete(calculators, fakeCalculator{}.Name())
+	}()
+	assert.Contains(t, Calculators(), "fake")
+
+	m := &Message{BoardTemp: 21}
+	assert.Nil(t, Calculate(m, &Cal{BoardType: "fake"}))
+	assert.Equal(t, 42.0, m.NO2PPB)
+
+	// Boards without calibration requirements always validate
+	assert.Nil(t, (&Cal{BoardType: "fake", Sensor1Type: "XX-A4"}).Validate())
+
+	assert.NotNil(t, Calculate(m, &Cal{BoardType: "no-such-board"}))
+	assert.NotNil(t, (&Cal{BoardType: "no-such-board"}).Validate())
+}
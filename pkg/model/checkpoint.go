@@ -0,0 +1,13 @@
+package model
+
+// FetchCheckpoint records how far we have come fetching the backlog
+// of a Span collection so that interrupted fetches can be resumed
+// and later fetches only have to pick up new data.
+type FetchCheckpoint struct {
+	CollectionID string `db:"collection_id" json:"collectionID"`
+	Since        int64  `db:"since_time" json:"since"`         // Lower bound of the fetch in progress, ms since epoch
+	Until        int64  `db:"until_time" json:"until"`         // Upper bound of the fetch in progress, ms since epoch
+	Offset       string `db:"offset_message_id" json:"offset"` // Last message ID fetched, empty if no fetch is in progress
+	HighWater    int64  `db:"high_water" json:"highWater"`     // Received time of the newest message fetched by a completed fetch
+	Updated      int64  `db:"updated_time" json:"updated"`     // When the checkpoint was last written, ms since epoch
+}
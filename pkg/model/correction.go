@@ -0,0 +1,178 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Gas components that corrections can be made for.
+const (
+	ComponentNO2 = "no2"
+	ComponentO3  = "o3"
+	ComponentNO  = "no"
+)
+
+// ErrTooFewSamples indicates that there is not enough data to fit a
+// correction.
+var ErrTooFewSamples = errors.New("Too few samples to fit correction")
+
+// Correction is a linear correction of a sensor value, typically fitted
+// by co-locating the device with a reference station.  The corrected
+// value in ppb is
+//
+//	Intercept + PPBCoef*ppb + TempCoef*temperature + HumCoef*humidity
+type Correction struct {
+	ID        int64     `db:"id" json:"id"`
+	DeviceID  string    `db:"device_id" json:"deviceID"`
+	Component string    `db:"component" json:"component"` // One of ComponentNO2, ComponentO3 or ComponentNO
+	ValidFrom time.Time `db:"valid_from" json:"from"`
+	Intercept float64   `db:"intercept" json:"intercept"` // Unit: ppb
+	PPBCoef   float64   `db:"ppb_coef" json:"ppbCoef"`
+	TempCoef  float64   `db:"temp_coef" json:"tempCoef"` // Unit: ppb / C
+	HumCoef   float64   `db:"hum_coef" json:"humCoef"`   // Unit: ppb / %RH
+	R2        float64   `db:"r2" json:"r2"`              // Coefficient of determination of the fit
+	Samples   int       `db:"samples" json:"samples"`    // Number of samples used in the fit
+	Created   time.Time `db:"created" json:"created"`
+}
+
+// CorrectionSample is one aligned observation used for fitting a
+// correction.
+type CorrectionSample struct {
+	PPB         float64 // Sensor value
+	Temperature float64 // C
+	Humidity    float64 // %RH
+	Reference   float64 // Reference value, ppb
+}
+
+// Apply returns the corrected value.
+func (c *Correction) Apply(ppb float64, temperature float64, humidity float64) float64 {
+	return c.Intercept + c.PPBCoef*ppb + c.TempCoef*temperature + c.HumCoef*humidity
+}
+
+// ApplyCorrections applies the corrections to the sensor values of
+// the message.  Nil corrections are skipped.
+func ApplyCorrections(m *Message, no2 *Correction, o3 *Correction, no *Correction) {
+	humidity := float64(m.BoardRelHumidity)
+
+	if no2 != nil {
+		m.NO2PPB = no2.Apply(m.NO2PPB, m.AFE3TempValue, humidity)
+	}
+	if o3 != nil {
+		m.O3PPB = o3.Apply(m.O3PPB, m.AFE3TempValue, humidity)
+	}
+	if no != nil {
+		m.NOPPB = no.Apply(m.NOPPB, m.AFE3TempValue, humidity)
+	}
+}
+
+// ComponentValue returns the value in ppb of the component in m.
+func ComponentValue(m *Message, component string) (float64, error) {
+	switch component {
+	case ComponentNO2:
+		return m.NO2PPB, nil
+	case ComponentO3:
+		return m.O3PPB, nil
+	case ComponentNO:
+		return m.NOPPB, nil
+	}
+	return 0, fmt.Errorf("unknown component '%s'", component)
+}
+
+// FitCorrection fits a correction to the samples using ordinary least
+// squares.
+func FitCorrection(samples []CorrectionSample) (*Correction, error) {
+	const n = 4
+
+	// We need more samples than parameters to say anything useful
+	// about the quality of the fit.
+	if len(samples) <= n {
+		return nil, ErrTooFewSamples
+	}
+
+	// Build the normal equations (X'X) b = X'y
+	var xtx [n][n]float64
+	var xty [n]float64
+	for _, s := range samples {
+		x := [n]float64{1, s.PPB, s.Temperature, s.Humidity}
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				xtx[i][j] += x[i] * x[j]
+			}
+			xty[i] += x[i] * s.Reference
+		}
+	}
+
+	b, err := solve(xtx, xty)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Correction{
+		Intercept: b[0],
+		PPBCoef:   b[1],
+		TempCoef:  b[2],
+		HumCoef:   b[3],
+		Samples:   len(samples),
+	}
+
+	// Coefficient of determination
+	var mean float64
+	for _, s := range samples {
+		mean += s.Reference
+	}
+	mean /= float64(len(samples))
+
+	var ssRes, ssTot float64
+	for _, s := range samples {
+		r := s.Reference - c.Apply(s.PPB, s.Temperature, s.Humidity)
+		ssRes += r * r
+		ssTot += (s.Reference - mean) * (s.Reference - mean)
+	}
+	if ssTot > 0 {
+		c.R2 = 1 - ssRes/ssTot
+	}
+
+	return c, nil
+}
+
+// solve solves the linear system a x = b using Gaussian elimination
+// with partial pivoting.
+func solve(a [4][4]float64, b [4]float64) ([4]float64, error) {
+	const n = 4
+	var x [n]float64
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return x, errors.New("Samples do not vary enough to fit correction")
+		}
+
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+
+		for row := col + 1; row < n; row++ {
+			f := a[row][col] / a[col][col]
+			for k := col; k < n; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+			b[row] -= f * b[col]
+		}
+	}
+
+	for row := n - 1; row >= 0; row-- {
+		sum := b[row]
+		for k := row + 1; k < n; k++ {
+			sum -= a[row][k] * x[k]
+		}
+		x[row] = sum / a[row][row]
+	}
+	return x, nil
+}
@@ -0,0 +1,54 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFitCorrection(t *testing.T) {
+	truth := Correction{Intercept: 2.0, PPBCoef: 0.8, TempCoef: -0.3, HumCoef: 0.05}
+
+	var samples []CorrectionSample
+	for i := 0; i < 50; i++ {
+		ppb := float64(i%17) * 3.1
+		temp := float64(i%7)*2.5 - 5
+		hum := float64(i%11)*6 + 20
+		samples = append(samples, CorrectionSample{
+			PPB:         ppb,
+			Temperature: temp,
+			Humidity:    hum,
+			Reference:   truth.Apply(ppb, temp, hum),
+		})
+	}
+
+	c, err := FitCorrection(samples)
+	assert.Nil(t, err)
+	assert.InDelta(t, truth.Intercept, c.Intercept, 1e-6)
+	assert.InDelta(t, truth.PPBCoef, c.PPBCoef, 1e-6)
+	assert.InDelta(t, truth.TempCoef, c.TempCoef, 1e-6)
+	assert.InDelta(t, truth.HumCoef, c.HumCoef, 1e-6)
+	assert.InDelta(t, 1.0, c.R2, 1e-9)
+	assert.Equal(t, 50, c.Samples)
+
+	_, err = FitCorrection(samples[:4])
+	assert.ErrorIs(t, err, ErrTooFewSamples)
+
+	// Constant temperature and humidity cannot be separated from the
+	// intercept.
+	for i := range samples {
+		samples[i].Temperature = 20
+		samples[i].Humidity = 50
+	}
+	_, err = FitCorrection(samples)
+	assert.NotNil(t, err)
+}
+
+func TestApplyCorrections(t *testing.T) {
+	m := &Message{NO2PPB: 10, O3PPB: 20, NOPPB: 30, AFE3TempValue: 10, BoardRelHumidity: 50}
+	ApplyCorrections(m, &Correction{Intercept: 1, PPBCoef: 2, TempCoef: 0.1, HumCoef: 0.01}, nil, nil)
+
+	assert.InDelta(t, 1+2*10+0.1*10+0.01*50, m.NO2PPB, 1e-9)
+	assert.Equal(t, 20.0, m.O3PPB)
+	assert.Equal(t, 30.0, m.NOPPB)
+}
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// DeadLetter is a message that a pipeline stage gave up on, kept with
+// the reason so that it can be inspected and replayed.
+type DeadLetter struct {
+	ID       int64     `db:"id" json:"id"`
+	Created  time.Time `db:"created" json:"created"`
+	Stage    string    `db:"stage" json:"stage"`       // Name of the stage the message is replayed into
+	Reason   string    `db:"reason" json:"reason"`     // The last error
+	Attempts int       `db:"attempts" json:"attempts"` // Number of times the message was tried
+	DeviceID string    `db:"device_id" json:"deviceID"`
+	Message  []byte    `db:"message" json:"message"` // The message as JSON
+	Payload  []byte    `db:"payload" json:"-"`       // Raw payload, which is not part of the JSON
+}
+
+// NewDeadLetter creates a dead letter for a message.
+func NewDeadLetter(stage string, m *Message, reason error, attempts int) (*DeadLetter, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLetter{
+		Created:  time.Now().UTC().Truncate(time.Second),
+		Stage:    stage,
+		Reason:   reason.Error(),
+		Attempts: attempts,
+		DeviceID: m.DeviceID,
+		Message:  data,
+		Payload:  m.Payload,
+	}, nil
+}
+
+// DecodeMessage returns the message of the dead letter.
+func (d *DeadLetter) DecodeMessage() (*Message, error) {
+	var m Message
+	err := json.Unmarshal(d.Message, &m)
+	if err != nil {
+		return nil, err
+	}
+	m.Payload = d.Payload
+	return &m, nil
+}
@@ -0,0 +1,116 @@
+package model
+
+import (
+	"time"
+)
+
+// DeviceBoard records that the AFE board identified by SysID was
+// installed in the device (enclosure) identified by the Span DeviceID
+// during a period of time.  The calibration data follows the board, so
+// when a board is moved to another device the history is needed to
+// tell which device a board was in and vice versa.
+type DeviceBoard struct {
+	ID        int64      `db:"id" json:"id"`
+	DeviceID  string     `db:"device_id" json:"deviceID"`
+	SysID     uint64     `db:"sysid" json:"sysID"`
+	ValidFrom time.Time  `db:"valid_from" json:"from"`
+	ValidTo   *time.Time `db:"valid_to" json:"to,omitempty"` // Set when the board was moved, exclusive
+}
+
+// Covers returns true if the board was installed in the device at
+// time t.
+func (b *DeviceBoard) Covers(t time.Time) bool {
+	if t.Before(b.ValidFrom) {
+		return false
+	}
+	return b.ValidTo == nil || t.Before(*b.ValidTo)
+}
+
+// FindDeviceBoard returns the entry in boards that covers t, or nil if
+// there is none.  If several entries cover t the one that starts last
+// is returned.
+func FindDeviceBoard(boards []DeviceBoard, t time.Time) *DeviceBoard {
+	var found *DeviceBoard
+	for i := range boards {
+		if !boards[i].Covers(t) {
+			continue
+		}
+		if found == nil || boards[i].ValidFrom.After(found.ValidFrom) {
+			found = &boards[i]
+		}
+	}
+	return found
+}
+
+// DeviceBoardChanges works out how boards must change to record that
+// the board sysID was seen in deviceID at time t.  It returns the
+// existing entries that must be updated and the entry that must be
+// added, if any.
+//
+// When t is newer than everything we know about the device and the
+// board, the open entries for both are ended at t and a new entry is
+// started.  Older observations can only move the start of the next
+// entry for the same device and board back in time, and are otherwise
+// ignored since they would contradict the history we have.
+func DeviceBoardChanges(boards []DeviceBoard, deviceID string, sysID uint64, t time.Time) ([]DeviceBoard, *DeviceBoard) {
+	// The entries for either the device or the board, the next
+	// entry starting after t for each of them and whether any of
+	// them is newer than t.
+	var related []DeviceBoard
+	var nextForDevice, nextForBoard *DeviceBoard
+	for i := range boards {
+		b := boards[i]
+		if b.DeviceID != deviceID && b.SysID != sysID {
+			continue
+		}
+
+		if b.DeviceID == deviceID && b.SysID == sysID && b.Covers(t) {
+			// Already recorded
+			return nil, nil
+		}
+
+		if b.Covers(t) && b.ValidTo != nil {
+			// t falls in a period where the device or the
+			// board was known to be elsewhere.
+			return nil, nil
+		}
+
+		if b.ValidFrom.After(t) {
+			if b.DeviceID == deviceID && (nextForDevice == nil || b.ValidFrom.Before(nextForDevice.ValidFrom)) {
+				nextForDevice = &boards[i]
+			}
+			if b.SysID == sysID && (nextForBoard == nil || b.ValidFrom.Before(nextForBoard.ValidFrom)) {
+				nextForBoard = &boards[i]
+			}
+		}
+		related = append(related, b)
+	}
+
+	if nextForDevice != nil || nextForBoard != nil {
+		if nextForDevice == nil || nextForDevice != nextForBoard {
+			return nil, nil
+		}
+
+		// The next entry for both the device and the board is the
+		// same pairing, so it must have started earlier than we
+		// thought.
+		b := *nextForDevice
+		b.ValidFrom = t
+		return []DeviceBoard{b}, nil
+	}
+
+	var updated []DeviceBoard
+	for _, b := range related {
+		if b.ValidTo == nil {
+			end := t
+			b.ValidTo = &end
+			updated = append(updated, b)
+		}
+	}
+
+	return updated, &DeviceBoard{
+		DeviceID:  deviceID,
+		SysID:     sysID,
+		ValidFrom: t,
+	}
+}
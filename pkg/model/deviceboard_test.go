@@ -0,0 +1,66 @@
+package model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceBoardChanges(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2022, 1, d, 0, 0, 0, 0, time.UTC) }
+	until := func(d int) *time.Time { t := day(d); return &t }
+
+	// Nothing known yet
+	updated, added := DeviceBoardChanges(nil, "d1", 1, day(1))
+	assert.Empty(t, updated)
+	assert.Equal(t, &DeviceBoard{DeviceID: "d1", SysID: 1, ValidFrom: day(1)}, added)
+
+	boards := []DeviceBoard{
+		{ID: 1, DeviceID: "d1", SysID: 1, ValidFrom: day(10)},
+		{ID: 2, DeviceID: "d2", SysID: 2, ValidFrom: day(1), ValidTo: until(5)},
+		{ID: 3, DeviceID: "d2", SysID: 3, ValidFrom: day(5)},
+	}
+
+	// Already recorded
+	updated, added = DeviceBoardChanges(boards, "d1", 1, day(11))
+	assert.Empty(t, updated)
+	assert.Nil(t, added)
+
+	// Board 1 moved from d1 to d2, ending both open entries
+	updated, added = DeviceBoardChanges(boards, "d2", 1, day(20))
+	assert.Equal(t, []DeviceBoard{
+		{ID: 1, DeviceID: "d1", SysID: 1, ValidFrom: day(10), ValidTo: until(20)},
+		{ID: 3, DeviceID: "d2", SysID: 3, ValidFrom: day(5), ValidTo: until(20)},
+	}, updated)
+	assert.Equal(t, &DeviceBoard{DeviceID: "d2", SysID: 1, ValidFrom: day(20)}, added)
+
+	// An earlier observation of the same pairing moves the start back
+	updated, added = DeviceBoardChanges(boards, "d1", 1, day(8))
+	assert.Equal(t, []DeviceBoard{{ID: 1, DeviceID: "d1", SysID: 1, ValidFrom: day(8)}}, updated)
+	assert.Nil(t, added)
+
+	// Observations contradicting the history are ignored
+	updated, added = DeviceBoardChanges(boards, "d2", 1, day(3))
+	assert.Empty(t, updated)
+	assert.Nil(t, added)
+
+	updated, added = DeviceBoardChanges(boards, "d3", 1, day(8))
+	assert.Empty(t, updated)
+	assert.Nil(t, added)
+}
+
+func TestFindDeviceBoard(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2022, 1, d, 0, 0, 0, 0, time.UTC) }
+	until := func(d int) *time.Time { t := day(d); return &t }
+
+	boards := []DeviceBoard{
+		{ID: 1, DeviceID: "d1", SysID: 1, ValidFrom: day(1), ValidTo: until(10)},
+		{ID: 2, DeviceID: "d1", SysID: 2, ValidFrom: day(10)},
+	}
+
+	assert.Nil(t, FindDeviceBoard(boards, day(0)))
+	assert.Equal(t, int64(1), FindDeviceBoard(boards, day(5)).ID)
+	assert.Equal(t, int64(2), FindDeviceBoard(boards, day(10)).ID)
+	assert.Equal(t, int64(2), FindDeviceBoard(boards, day(20)).ID)
+}
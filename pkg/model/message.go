@@ -8,11 +8,17 @@ package model
 // TODO(borud): firmware version structure needs to be defined
 type Message struct {
 	// Housekeeping
-	ID           int64  `db:"id" json:"id"`                      // Message ID (assigned by persistence layer)
-	DeviceID     string `db:"device_id" json:"deviceID"`         // Span device ID
-	MessageID    string `db:"message_id" json:"messageID"`       // Span message ID
-	ReceivedTime int64  `db:"received_time" json:"receivedTime"` // Received time when Span received he message
-	PacketSize   int    `db:"packetsize" json:"packetSize"`      // Original packet size as received by Span
+	ID           int64  `db:"id" json:"id"`                                // Message ID (assigned by persistence layer)
+	DeviceID     string `db:"device_id" json:"deviceID"`                   // Span device ID
+	MessageID    string `db:"message_id" json:"messageID"`                 // Span message ID
+	ReceivedTime int64  `db:"received_time" json:"receivedTime"`           // Received time when Span received he message
+	PacketSize   int    `db:"packetsize" json:"packetSize"`                // Original packet size as received by Span
+	SourceAddr   string `db:"-" json:"sourceAddr,omitempty"`               // Source address when received directly (not persisted)
+	CollectionID string `db:"collection_id" json:"collectionID,omitempty"` // Span collection the message was received from
+
+	Tags map[string]string `db:"-" json:"tags,omitempty"` // Span device tags (not persisted)
+
+	Payload []byte `db:"payload" json:"-"` // Raw protobuf payload as received, kept so that messages can be reprocessed
 
 	// Board fields
 	SysID            uint64  `db:"sysid" json:"sysID"`                    // System id, CPU id or similar
@@ -42,6 +48,14 @@ type Message struct {
 	O3PPB         float64 `db:"o3_ppb" json:"O3PPB"`                  // O3+NO2 sensor value - NO2 sensor value -> O3 in ppb
 	NOPPB         float64 `db:"no_ppb" json:"NOPPB"`                  // NO sensor value in ppb
 	AFE3TempValue float64 `db:"afe3_temp_value" json:"afe3TempValue"` // Temperature in C.
+	NO2UGM3       float64 `db:"no2_ugm3" json:"NO2UGM3"`              // NO2 in ug/m3
+	O3UGM3        float64 `db:"o3_ugm3" json:"O3UGM3"`                // O3 in ug/m3
+	NOUGM3        float64 `db:"no_ugm3" json:"NOUGM3"`                // NO in ug/m3
+	Uncalibrated  bool    `db:"uncalibrated" json:"uncalibrated"`     // No calibration data applied, calculated values are not set
+
+	// Intermediate values of the calculation.  Only filled in when
+	// CalcDebug is non-nil before the calculation runs.
+	CalcDebug *CalcDebug `db:"-" json:"calcDebug,omitempty"`
 
 	// OPC-N3
 	OPCPMA            uint32  `db:"opcpma" json:"OPCpmA"`                   // OPC PM A (default PM1)
@@ -82,4 +96,33 @@ type Message struct {
 	OPCBin23          uint16  `db:"opcbin_23" json:"OPCBin23"`              // OPC PM bin 23
 
 	OPCSampleValid uint8 `db:"opcsamplevalid" json:"sampleValid"` // OPC Sample valid
+
+	// PM computed from the OPC bins with humidity correction, in ug/m3
+	PM1Corrected  float64 `db:"pm1_corrected" json:"PM1Corrected"`
+	PM25Corrected float64 `db:"pm25_corrected" json:"PM25Corrected"`
+	PM10Corrected float64 `db:"pm10_corrected" json:"PM10Corrected"`
+}
+
+// Copy returns a deep copy of the message, for handing the same
+// message to pipeline stages that may modify it independently.
+func (m *Message) Copy() *Message {
+	c := *m
+
+	if m.Tags != nil {
+		c.Tags = make(map[string]string, len(m.Tags))
+		for k, v := range m.Tags {
+			c.Tags[k] = v
+		}
+	}
+
+	if m.Payload != nil {
+		c.Payload = append([]byte(nil), m.Payload...)
+	}
+
+	if m.CalcDebug != nil {
+		debug := *m.CalcDebug
+		c.CalcDebug = &debug
+	}
+
+	return &c
 }
@@ -0,0 +1,27 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageCopy(t *testing.T) {
+	m := &Message{
+		DeviceID:  "foo",
+		Tags:      map[string]string{"name": "bar"},
+		Payload:   []byte{1, 2, 3},
+		CalcDebug: &CalcDebug{Temperature: 20},
+	}
+
+	c := m.Copy()
+	assert.Equal(t, m, c)
+
+	c.Tags["name"] = "baz"
+	c.Payload[0] = 9
+	c.CalcDebug.Temperature = 30
+
+	assert.Equal(t, "bar", m.Tags["name"])
+	assert.Equal(t, byte(1), m.Payload[0])
+	assert.Equal(t, 20.0, m.CalcDebug.Temperature)
+}
@@ -0,0 +1,152 @@
+package model
+
+import (
+	"errors"
+	"math"
+)
+
+// OPCBinCount is the number of size bins reported by the OPC-N3.
+const OPCBinCount = 24
+
+// Defaults for PM calculation from the OPC-N3 bin histogram.
+const (
+	// DefaultParticleDensity is the assumed particle density in g/cm3.
+	DefaultParticleDensity = 1.65
+
+	// DefaultKappa is the hygroscopicity parameter used for the
+	// kappa-Köhler humidity correction.  0.4 is a commonly used
+	// value for mixed urban aerosol.
+	DefaultKappa = 0.4
+
+	// maxRelHumidity caps the humidity used in the correction since
+	// the growth factor diverges as the humidity approaches 100%.
+	maxRelHumidity = 95.0
+
+	// waterDensity in g/cm3
+	waterDensity = 1.0
+)
+
+// DefaultOPCBinBoundaries are the bin boundaries of the OPC-N3 in µm.
+// There is one more boundary than there are bins.
+var DefaultOPCBinBoundaries = []float64{
+	0.35, 0.46, 0.66, 1.0, 1.3, 1.7, 2.3, 3.0, 4.0, 5.2, 6.5, 8.0,
+	10.0, 12.0, 14.0, 16.0, 18.0, 20.0, 22.0, 25.0, 28.0, 31.0, 34.0, 37.0, 40.0,
+}
+
+// ErrInvalidBinBoundaries indicates that the bin boundaries do not
+// match the number of bins or are not increasing.
+var ErrInvalidBinBoundaries = errors.New("Bin boundaries must be 25 increasing values")
+
+// PMConfig holds the parameters for computing PM mass concentrations
+// from the OPC-N3 bin histogram.
+type PMConfig struct {
+	ParticleDensity float64   // g/cm3
+	Kappa           float64   // Hygroscopicity, 0 disables humidity correction
+	BinBoundaries   []float64 // µm, OPCBinCount+1 increasing values
+}
+
+// DefaultPMConfig returns a PMConfig with the default values.
+func DefaultPMConfig() PMConfig {
+	return PMConfig{
+		ParticleDensity: DefaultParticleDensity,
+		Kappa:           DefaultKappa,
+		BinBoundaries:   DefaultOPCBinBoundaries,
+	}
+}
+
+// Validate ...
+func (c PMConfig) Validate() error {
+	if len(c.BinBoundaries) != OPCBinCount+1 {
+		return ErrInvalidBinBoundaries
+	}
+	for i := 1; i < len(c.BinBoundaries); i++ {
+		if c.BinBoundaries[i] <= c.BinBoundaries[i-1] {
+			return ErrInvalidBinBoundaries
+		}
+	}
+
+	if c.ParticleDensity <= 0 {
+		return errors.New("Particle density must be positive")
+	}
+
+	if c.Kappa < 0 {
+		return errors.New("Kappa must not be negative")
+	}
+	return nil
+}
+
+// OPCBins returns the OPC bin counts as an array.
+func (m *Message) OPCBins() [OPCBinCount]uint16 {
+	return [OPCBinCount]uint16{
+		m.OPCBin0, m.OPCBin1, m.OPCBin2, m.OPCBin3, m.OPCBin4, m.OPCBin5,
+		m.OPCBin6, m.OPCBin7, m.OPCBin8, m.OPCBin9, m.OPCBin10, m.OPCBin11,
+		m.OPCBin12, m.OPCBin13, m.OPCBin14, m.OPCBin15, m.OPCBin16, m.OPCBin17,
+		m.OPCBin18, m.OPCBin19, m.OPCBin20, m.OPCBin21, m.OPCBin22, m.OPCBin23,
+	}
+}
+
+// CalculatePM computes PM1, PM2.5 and PM10 in µg/m3 from the OPC bin
+// histogram and applies the humidity correction, storing the result
+// in the PM*Corrected fields.  Messages without a valid sample volume
+// are left untouched.
+//
+// Each particle is assumed to be a sphere with the diameter at the
+// midpoint of its bin.  Bins that straddle a PM cutoff contribute the
+// fraction of the bin that lies below the cutoff.
+func CalculatePM(m *Message, cfg PMConfig) {
+	// Sample volume in cm3 from flow rate in mL/min and period in ms
+	volume := float64(m.OPCSampleFlowRate) * float64(m.OPCSamplePeriod) / 60000.0
+	if volume <= 0 {
+		return
+	}
+
+	c := HumidityCorrection(float64(m.OPCHum), cfg.Kappa, cfg.ParticleDensity)
+	bins := m.OPCBins()
+
+	m.PM1Corrected = binMass(bins, volume, cfg, 1.0) / c
+	m.PM25Corrected = binMass(bins, volume, cfg, 2.5) / c
+	m.PM10Corrected = binMass(bins, volume, cfg, 10.0) / c
+}
+
+// binMass returns the mass concentration in µg/m3 of particles with a
+// diameter below cutoff µm.
+func binMass(bins [OPCBinCount]uint16, volume float64, cfg PMConfig, cutoff float64) float64 {
+	var mass float64
+	for i, count := range bins {
+		lower := cfg.BinBoundaries[i]
+		upper := cfg.BinBoundaries[i+1]
+		if lower >= cutoff {
+			break
+		}
+
+		fraction := 1.0
+		if upper > cutoff {
+			fraction = (cutoff - lower) / (upper - lower)
+		}
+
+		// Particles per cm3 times the mass of a particle.  With the
+		// diameter in µm and the density in g/cm3 the mass of one
+		// particle is density * pi/6 * d^3 * 1e-6 µg, and there are
+		// 1e6 cm3 in a m3, so the factors cancel out.
+		d := (lower + upper) / 2
+		mass += fraction * (float64(count) / volume) * cfg.ParticleDensity * math.Pi / 6 * d * d * d
+	}
+	return mass
+}
+
+// HumidityCorrection returns the kappa-Köhler correction factor
+//
+//	C = 1 + (kappa * rho_w / rho_p) / (1/aw - 1)
+//
+// where aw is the water activity, approximated by the relative
+// humidity.  The dry mass concentration is the measured concentration
+// divided by C.  The humidity is capped at 95% since C diverges as the
+// humidity approaches 100%.
+func HumidityCorrection(relHumidity float64, kappa float64, particleDensity float64) float64 {
+	if kappa <= 0 || relHumidity <= 0 {
+		return 1.0
+	}
+
+	aw := math.Min(relHumidity, maxRelHumidity) / 100.0
+	return 1 + (kappa*waterDensity/particleDensity)/(1/aw-1)
+}
@@ -0,0 +1,73 @@
+package model
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHumidityCorrection(t *testing.T) {
+	assert.Equal(t, 1.0, HumidityCorrection(0, 0.4, 1.65))
+	assert.Equal(t, 1.0, HumidityCorrection(80, 0, 1.65))
+
+	// At 50% aw = 0.5 so 1/aw - 1 = 1
+	assert.InDelta(t, 1+0.4/1.65, HumidityCorrection(50, 0.4, 1.65), 1e-9)
+
+	// Humidity above the cap is treated as the cap
+	assert.Equal(t, HumidityCorrection(95, 0.4, 1.65), HumidityCorrection(99, 0.4, 1.65))
+	assert.True(t, HumidityCorrection(95, 0.4, 1.65) > HumidityCorrection(80, 0.4, 1.65))
+}
+
+func TestCalculatePM(t *testing.T) {
+	cfg := DefaultPMConfig()
+	cfg.Kappa = 0
+
+	// 60 mL/min for 1000 ms is 1 cm3
+	m := &Message{
+		OPCSampleFlowRate: 60,
+		OPCSamplePeriod:   1000,
+		OPCBin0:           1, // 0.35 - 0.46 um
+		OPCBin6:           7, // 2.3 - 3.0 um, straddles PM2.5
+	}
+	CalculatePM(m, cfg)
+
+	particleMass := func(d float64) float64 {
+		return cfg.ParticleDensity * math.Pi / 6 * d * d * d
+	}
+	small := particleMass((0.35 + 0.46) / 2)
+	large := 7 * particleMass((2.3+3.0)/2)
+
+	assert.InDelta(t, small, m.PM1Corrected, 1e-9)
+	assert.InDelta(t, small+large*(0.2/0.7), m.PM25Corrected, 1e-9)
+	assert.InDelta(t, small+large, m.PM10Corrected, 1e-9)
+
+	// Humidity correction divides all values by the same factor
+	cfg.Kappa = 0.4
+	m.OPCHum = 50
+	CalculatePM(m, cfg)
+	c := HumidityCorrection(50, 0.4, cfg.ParticleDensity)
+	assert.InDelta(t, (small+large)/c, m.PM10Corrected, 1e-9)
+
+	// No sample volume, nothing is computed
+	empty := &Message{OPCBin0: 10}
+	CalculatePM(empty, cfg)
+	assert.Equal(t, 0.0, empty.PM10Corrected)
+}
+
+func TestPMConfigValidate(t *testing.T) {
+	assert.Nil(t, DefaultPMConfig().Validate())
+
+	cfg := DefaultPMConfig()
+	cfg.BinBoundaries = cfg.BinBoundaries[:10]
+	assert.ErrorIs(t, cfg.Validate(), ErrInvalidBinBoundaries)
+
+	cfg = DefaultPMConfig()
+	cfg.BinBoundaries = append([]float64{}, DefaultOPCBinBoundaries...)
+	cfg.BinBoundaries[3] = 0.1
+	assert.ErrorIs(t, cfg.Validate(), ErrInvalidBinBoundaries)
+
+	cfg = DefaultPMConfig()
+	cfg.ParticleDensity = 0
+	assert.NotNil(t, cfg.Validate())
+}
@@ -0,0 +1,85 @@
+package model
+
+import (
+	"errors"
+	"math"
+)
+
+// Molar masses in g/mol
+const (
+	MolarMassNO2 = 46.0055
+	MolarMassO3  = 47.9982
+	MolarMassNO  = 30.0061
+)
+
+// Physical constants and standard conditions.
+const (
+	GasConstant         = 8.314462618 // J/(mol K)
+	StandardPressure    = 101325.0    // Pa
+	StandardTemperature = 293.15      // K, 20C as used for gases in EU air quality reporting
+	zeroCelsius         = 273.15      // K
+)
+
+// Temperature sources for ConversionConfig.
+const (
+	TemperatureAFE3  = "afe3"
+	TemperatureBoard = "board"
+)
+
+// ConversionConfig holds the parameters for converting concentrations
+// from ppb to µg/m3.
+type ConversionConfig struct {
+	Pressure           float64 // Pa
+	StandardConditions bool    // Use StandardTemperature instead of measured temperature
+	TemperatureSource  string  // TemperatureAFE3 or TemperatureBoard
+}
+
+// DefaultConversionConfig returns a ConversionConfig for ambient
+// conditions at standard pressure using the AFE3 temperature.
+func DefaultConversionConfig() ConversionConfig {
+	return ConversionConfig{
+		Pressure:          StandardPressure,
+		TemperatureSource: TemperatureAFE3,
+	}
+}
+
+// Validate ...
+func (c ConversionConfig) Validate() error {
+	if c.Pressure <= 0 {
+		return errors.New("Pressure must be positive")
+	}
+	if c.TemperatureSource != TemperatureAFE3 && c.TemperatureSource != TemperatureBoard {
+		return errors.New("Temperature source must be 'afe3' or 'board'")
+	}
+	return nil
+}
+
+// PPBToUGM3 converts a concentration in ppb to µg/m3 for a gas with the
+// given molar mass (g/mol) at pressure (Pa) and temperature (K).
+//
+//	µg/m3 = ppb * M * P / (R * T) * 1e-3
+func PPBToUGM3(ppb float64, molarMass float64, pressure float64, temperature float64) float64 {
+	return ppb * molarMass * pressure / (GasConstant * temperature) * 1e-3
+}
+
+// ConvertUnits fills in the µg/m3 fields of the message from the ppb
+// values.  If the temperature is not usable the fields are left
+// untouched.
+func ConvertUnits(m *Message, cfg ConversionConfig) {
+	temperature := StandardTemperature
+	if !cfg.StandardConditions {
+		celsius := m.AFE3TempValue
+		if cfg.TemperatureSource == TemperatureBoard {
+			celsius = float64(m.BoardTemp)
+		}
+		temperature = celsius + zeroCelsius
+	}
+
+	if math.IsNaN(temperature) || temperature <= 0 {
+		return
+	}
+
+	m.NO2UGM3 = PPBToUGM3(m.NO2PPB, MolarMassNO2, cfg.Pressure, temperature)
+	m.O3UGM3 = PPBToUGM3(m.O3PPB, MolarMassO3, cfg.Pressure, temperature)
+	m.NOUGM3 = PPBToUGM3(m.NOPPB, MolarMassNO, cfg.Pressure, temperature)
+}
@@ -0,0 +1,41 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPPBToUGM3(t *testing.T) {
+	// At 20C and 101.325 kPa one mole of gas takes up 24.055 litres,
+	// so 1 ppb of NO2 is 46.0055 / 24.055 = 1.9125 ug/m3.
+	assert.InDelta(t, 1.9125, PPBToUGM3(1.0, MolarMassNO2, StandardPressure, StandardTemperature), 1e-4)
+
+	// Concentration is inversely proportional to temperature
+	warm := PPBToUGM3(10.0, MolarMassO3, StandardPressure, 313.15)
+	cold := PPBToUGM3(10.0, MolarMassO3, StandardPressure, 273.15)
+	assert.InDelta(t, 313.15/273.15, cold/warm, 1e-9)
+}
+
+func TestConvertUnits(t *testing.T) {
+	m := &Message{NO2PPB: 10, O3PPB: 20, NOPPB: 30, AFE3TempValue: 20, BoardTemp: 40}
+
+	ConvertUnits(m, DefaultConversionConfig())
+	assert.InDelta(t, PPBToUGM3(10, MolarMassNO2, StandardPressure, 293.15), m.NO2UGM3, 1e-9)
+	assert.InDelta(t, PPBToUGM3(20, MolarMassO3, StandardPressure, 293.15), m.O3UGM3, 1e-9)
+	assert.InDelta(t, PPBToUGM3(30, MolarMassNO, StandardPressure, 293.15), m.NOUGM3, 1e-9)
+
+	cfg := DefaultConversionConfig()
+	cfg.TemperatureSource = TemperatureBoard
+	cfg.Pressure = 90000
+	ConvertUnits(m, cfg)
+	assert.InDelta(t, PPBToUGM3(10, MolarMassNO2, 90000, 313.15), m.NO2UGM3, 1e-9)
+
+	cfg.StandardConditions = true
+	ConvertUnits(m, cfg)
+	assert.InDelta(t, PPBToUGM3(10, MolarMassNO2, 90000, StandardTemperature), m.NO2UGM3, 1e-9)
+
+	assert.Nil(t, DefaultConversionConfig().Validate())
+	assert.NotNil(t, ConversionConfig{Pressure: 0, TemperatureSource: TemperatureAFE3}.Validate())
+	assert.NotNil(t, ConversionConfig{Pressure: 1, TemperatureSource: "x"}.Validate())
+}
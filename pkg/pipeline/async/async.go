@@ -0,0 +1,423 @@
+// Package async implements a pipeline step that decouples the stages
+// before it from the stages after it with a bounded queue, so that a
+// slow or blocked stage does not hold up the listeners.
+package async
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+)
+
+// Policy decides what happens to a message published to a full queue.
+type Policy string
+
+// Overflow policies
+const (
+	PolicyBlock      Policy = "block"       // Wait for room in the queue
+	PolicyDropOldest Policy = "drop-oldest" // Drop the oldest message in the queue
+	PolicyDropNewest Policy = "drop-newest" // Drop the message being published
+	PolicySpill      Policy = "spill"       // Write the message to a file until there is room
+)
+
+// Defaults for Config.
+const (
+	DefaultQueueSize = 1000
+	DefaultWorkers   = 1
+	DefaultPolicy    = PolicyBlock
+)
+
+// dropReportInterval limits how often we log about dropped messages.
+const dropReportInterval = 10 * time.Second
+
+// abandonGrace is how long Stop waits for the workers to return after
+// abandoning the messages being published.  Workers stuck in a stage
+// that ignores the context are left behind.
+var abandonGrace = time.Second
+
+// ErrClosed is returned when publishing to a closed stage.
+var ErrClosed = errors.New("async stage is closed")
+
+// metrics holds the stats of all async stages by name and is
+// published as "pipeline" through expvar.
+var metrics = expvar.NewMap("pipeline")
+
+// Config is the configuration of an Async stage.
+type Config struct {
+	Name      string // Name of the stage in metrics and spill file names
+	QueueSize int    // Number of messages held in memory
+	Workers   int    // Number of goroutines passing messages on
+	Policy    Policy // What to do when the queue is full
+	SpillDir  string // Directory of the spill file for PolicySpill
+}
+
+// Stats are the metrics of an Async stage.
+type Stats struct {
+	QueueDepth int    `json:"queueDepth"` // Messages in the memory queue
+	QueueSize  int    `json:"queueSize"`  // Capacity of the memory queue
+	SpillDepth int    `json:"spillDepth"` // Messages in the spill file
+	Policy     Policy `json:"policy"`
+	Workers    int    `json:"workers"`
+	Published  int64  `json:"published"` // Messages accepted by Publish
+	Processed  int64  `json:"processed"` // Messages passed on to the next stage
+	Dropped    int64  `json:"dropped"`   // Messages dropped because the queue was full
+	Spilled    int64  `json:"spilled"`   // Messages written to the spill file
+	Errors     int64  `json:"errors"`    // Errors returned by the next stage
+}
+
+// Async is a pipeline processor that queues messages and passes them
+// on to the next stage from a set of worker goroutines.  Publish only
+// waits for the next stage if the queue is full and the policy is
+// PolicyBlock.
+//
+// With more than one worker the next stages must be safe for
+// concurrent use, and messages may be passed on out of order.
+//
+// The workers run from Start until Stop has drained the queue.
+type Async struct {
+	cfg Config
+
+	// ctx is used when passing messages on.  It is cancelled if Stop
+	// gives up on draining the queue.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	queue    []*model.Message
+	spill    *spillFile
+	started  bool
+	closed   bool
+	next     pipeline.Pipeline
+	stats    Stats
+	lastDrop time.Time
+	wg       sync.WaitGroup
+}
+
+// New creates a new instance of the Async pipeline element.  Zero
+// values in cfg are replaced by the defaults.
+func New(cfg Config) (*Async, error) {
+	if cfg.QueueSize == 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = DefaultWorkers
+	}
+	if cfg.Policy == "" {
+		cfg.Policy = DefaultPolicy
+	}
+
+	if cfg.QueueSize < 1 {
+		return nil, errors.New("queue size must be positive")
+	}
+	if cfg.Workers < 1 {
+		return nil, errors.New("number of workers must be positive")
+	}
+
+	p := &Async{cfg: cfg}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.notEmpty = sync.NewCond(&p.mu)
+	p.notFull = sync.NewCond(&p.mu)
+
+	switch cfg.Policy {
+	case PolicyBlock, PolicyDropOldest, PolicyDropNewest:
+
+	case PolicySpill:
+		if cfg.Name == "" || cfg.SpillDir == "" {
+			return nil, errors.New("spill policy requires a name and a spill directory")
+		}
+
+		var err error
+		p.spill, err = openSpillFile(cfg.SpillDir, cfg.Name)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open spill file: %v", err)
+		}
+		if p.spill.len() > 0 {
+			log.Printf("Async stage '%s' resuming %d spilled messages", cfg.Name, p.spill.len())
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown overflow policy '%s'", cfg.Policy)
+	}
+
+	if cfg.Name != "" {
+		metrics.Set(cfg.Name, expvar.Func(func() interface{} { return p.Stats() }))
+	}
+	return p, nil
+}
+
+// Start starts the workers.
+func (p *Async) Start(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.started || p.closed {
+		return nil
+	}
+	p.started = true
+
+	p.wg.Add(p.cfg.Workers)
+	for i := 0; i < p.cfg.Workers; i++ {
+		go p.worker()
+	}
+	return nil
+}
+
+// Publish queues a message.
+func (p *Async) Publish(ctx context.Context, m *model.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+
+	full := len(p.queue) >= p.cfg.QueueSize
+	switch p.cfg.Policy {
+	case PolicyBlock:
+		if full {
+			err := p.waitForRoom(ctx)
+			if err != nil {
+				return err
+			}
+		}
+
+	case PolicyDropOldest:
+		if full {
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+			p.dropped()
+		}
+
+	case PolicyDropNewest:
+		if full {
+			p.dropped()
+			return nil
+		}
+
+	case PolicySpill:
+		// Once we have started spilling, everything goes to the
+		// spill file until it is empty to keep the messages in order.
+		if full || p.spill.len() > 0 {
+			err := p.spill.write(m)
+			if err != nil {
+				p.dropped()
+				return fmt.Errorf("unable to spill message: %v", err)
+			}
+			p.stats.Published++
+			p.stats.Spilled++
+			p.notEmpty.Signal()
+			return nil
+		}
+	}
+
+	p.queue = append(p.queue, m)
+	p.stats.Published++
+	p.notEmpty.Signal()
+	return nil
+}
+
+// waitForRoom waits until there is room in the queue, the stage is
+// closed or ctx is done.  Must be called with mu held.
+func (p *Async) waitForRoom(ctx context.Context) error {
+	// sync.Cond knows nothing about contexts, so we wake up the
+	// waiters when ctx is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			p.mu.Lock()
+			p.notFull.Broadcast()
+			p.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	for len(p.queue) >= p.cfg.QueueSize {
+		if p.closed {
+			return ErrClosed
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p.notFull.Wait()
+	}
+	return nil
+}
+
+// dropped counts a dropped message.  Must be called with mu held.
+func (p *Async) dropped() {
+	p.stats.Dropped++
+	if time.Since(p.lastDrop) > dropReportInterval {
+		p.lastDrop = time.Now()
+		log.Printf("Async stage '%s' is falling behind, %d messages dropped so far", p.cfg.Name, p.stats.Dropped)
+	}
+}
+
+// take waits for a message and for the next stage to be set.  It
+// returns false when the stage is closed and all queued messages have
+// been taken, or when Stop has given up on draining the queue.
+func (p *Async) take() (*model.Message, pipeline.Pipeline, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for {
+		for (p.next == nil || len(p.queue) == 0 && p.spill.len() == 0) && !p.closed {
+			p.notEmpty.Wait()
+		}
+
+		// Leave the spilled messages for the next start
+		if p.ctx.Err() != nil {
+			return nil, nil, false
+		}
+
+		if len(p.queue) > 0 {
+			m := p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+			p.notFull.Signal()
+			return m, p.next, true
+		}
+
+		if p.spill.len() == 0 {
+			return nil, nil, false
+		}
+
+		m, err := p.spill.read()
+		if err != nil {
+			log.Printf("Async stage '%s' skipping unreadable spilled message: %v", p.cfg.Name, err)
+			continue
+		}
+		return m, p.next, true
+	}
+}
+
+func (p *Async) worker() {
+	defer p.wg.Done()
+
+	for {
+		m, next, ok := p.take()
+		if !ok {
+			return
+		}
+
+		err := p.publish(next, m)
+
+		p.mu.Lock()
+		p.stats.Processed++
+		if err != nil {
+			p.stats.Errors++
+		}
+		p.mu.Unlock()
+	}
+}
+
+// publish passes a message on to the next stage.  A panic in the next
+// stage is logged rather than taking down the worker.
+func (p *Async) publish(next pipeline.Pipeline, m *model.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+			log.Printf("Async stage '%s': %v", p.cfg.Name, err)
+		}
+	}()
+
+	if next == nil {
+		return nil
+	}
+
+	err = next.Publish(p.ctx, m)
+	if err != nil {
+		log.Printf("Error in stage after async stage '%s': %v", p.cfg.Name, err)
+	}
+	return err
+}
+
+// Stats returns the current metrics of the stage.
+func (p *Async) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.stats
+	s.QueueDepth = len(p.queue)
+	s.QueueSize = p.cfg.QueueSize
+	s.SpillDepth = p.spill.len()
+	s.Policy = p.cfg.Policy
+	s.Workers = p.cfg.Workers
+	return s
+}
+
+// Stop stops accepting messages and waits for the workers to pass on
+// the messages already queued, including any spilled messages.  If ctx
+// is done first the messages still queued in memory are lost, while
+// spilled messages are kept for the next start, and Stop waits at most
+// abandonGrace for the workers to return.
+func (p *Async) Stop(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.notEmpty.Broadcast()
+	p.notFull.Broadcast()
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		stats := p.Stats()
+		err = fmt.Errorf("async stage '%s' gave up draining with %d messages queued: %v", p.cfg.Name, stats.QueueDepth, ctx.Err())
+
+		// Abandon the messages being published and give the
+		// workers a moment to notice.
+		p.cancel()
+		select {
+		case <-done:
+		case <-time.After(abandonGrace):
+			log.Printf("Async stage '%s' is stuck in the next stage, leaving it behind", p.cfg.Name)
+		}
+	}
+	p.cancel()
+
+	if p.spill != nil {
+		closeErr := p.spill.close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// AddNext ...
+func (p *Async) AddNext(pe pipeline.Pipeline) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.next = pe
+	p.notEmpty.Broadcast()
+}
+
+// Next ...
+func (p *Async) Next() pipeline.Pipeline {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.next
+}
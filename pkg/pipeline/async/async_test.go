@@ -0,0 +1,348 @@
+package async
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+var ctx = context.Background()
+
+// sink is a pipeline element that records the messages it gets and
+// blocks until release is closed or the context is done.
+type sink struct {
+	active   int32 // Publish calls in progress, accessed atomically
+	mu       sync.Mutex
+	release  chan struct{}
+	messages []*model.Message
+}
+
+func newSink() *sink {
+	return &sink{release: make(chan struct{})}
+}
+
+func (s *sink) Publish(ctx context.Context, m *model.Message) error {
+	atomic.AddInt32(&s.active, 1)
+	defer atomic.AddInt32(&s.active, -1)
+
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, m)
+	return nil
+}
+
+func (s *sink) AddNext(pipeline.Pipeline) {}
+
+func (s *sink) Next() pipeline.Pipeline { return nil }
+
+func (s *sink) deviceIDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var ids []string
+	for _, m := range s.messages {
+		ids = append(ids, m.DeviceID)
+	}
+	return ids
+}
+
+func publish(t *testing.T, p *Async, from int, to int) {
+	for i := from; i < to; i++ {
+		assert.Nil(t, p.Publish(ctx, &model.Message{DeviceID: fmt.Sprintf("d%d", i), Payload: []byte{byte(i)}}))
+	}
+}
+
+func ids(from int, to int) []string {
+	var ids []string
+	for i := from; i < to; i++ {
+		ids = append(ids, fmt.Sprintf("d%d", i))
+	}
+	return ids
+}
+
+// waitForDepth waits until a worker has taken a message and is blocked
+// in the sink, so that the queue holds exactly what we publish next.
+func waitForDepth(t *testing.T, p *Async, depth int) {
+	assert.Eventually(t, func() bool { return p.Stats().QueueDepth == depth }, time.Second, time.Millisecond)
+}
+
+func TestDropNewest(t *testing.T) {
+	s := newSink()
+	p, err := New(Config{Name: t.Name(), QueueSize: 3, Policy: PolicyDropNewest})
+	assert.Nil(t, err)
+	p.AddNext(s)
+	assert.Nil(t, p.Start(ctx))
+
+	publish(t, p, 0, 1)
+	waitForDepth(t, p, 0)
+	publish(t, p, 1, 10)
+
+	close(s.release)
+	assert.Nil(t, p.Stop(ctx))
+	assert.Equal(t, ids(0, 4), s.deviceIDs())
+
+	stats := p.Stats()
+	assert.Equal(t, int64(4), stats.Published)
+	assert.Equal(t, int64(6), stats.Dropped)
+	assert.Equal(t, int64(4), stats.Processed)
+}
+
+func TestDropOldest(t *testing.T) {
+	s := newSink()
+	p, err := New(Config{Name: t.Name(), QueueSize: 3, Policy: PolicyDropOldest})
+	assert.Nil(t, err)
+	p.AddNext(s)
+	assert.Nil(t, p.Start(ctx))
+
+	publish(t, p, 0, 1)
+	waitForDepth(t, p, 0)
+	publish(t, p, 1, 10)
+
+	close(s.release)
+	assert.Nil(t, p.Stop(ctx))
+	assert.Equal(t, append(ids(0, 1), ids(7, 10)...), s.deviceIDs())
+	assert.Equal(t, int64(6), p.Stats().Dropped)
+}
+
+func TestBlock(t *testing.T) {
+	s := newSink()
+	p, err := New(Config{Name: t.Name(), QueueSize: 2, Workers: 1})
+	assert.Nil(t, err)
+	p.AddNext(s)
+	assert.Nil(t, p.Start(ctx))
+
+	done := make(chan struct{})
+	go func() {
+		publish(t, p, 0, 10)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("publish did not block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(t, 2, p.Stats().QueueDepth)
+
+	close(s.release)
+	<-done
+	assert.Nil(t, p.Stop(ctx))
+	assert.Equal(t, ids(0, 10), s.deviceIDs())
+	assert.Equal(t, int64(0), p.Stats().Dropped)
+
+	assert.Equal(t, ErrClosed, p.Publish(ctx, &model.Message{}))
+}
+
+func TestSpill(t *testing.T) {
+	dir := t.TempDir()
+
+	s := newSink()
+	p, err := New(Config{Name: "spill", QueueSize: 2, Policy: PolicySpill, SpillDir: dir})
+	assert.Nil(t, err)
+	p.AddNext(s)
+	assert.Nil(t, p.Start(ctx))
+
+	publish(t, p, 0, 1)
+	waitForDepth(t, p, 0)
+	publish(t, p, 1, 10)
+
+	stats := p.Stats()
+	assert.Equal(t, 2, stats.QueueDepth)
+	assert.Equal(t, 7, stats.SpillDepth)
+	assert.Equal(t, int64(7), stats.Spilled)
+
+	// Messages come out in order, payload included
+	close(s.release)
+	assert.Nil(t, p.Stop(ctx))
+	assert.Equal(t, ids(0, 10), s.deviceIDs())
+	assert.Equal(t, []byte{9}, s.messages[9].Payload)
+	assert.Equal(t, 0, p.Stats().SpillDepth)
+}
+
+func TestSpillResume(t *testing.T) {
+	dir := t.TempDir()
+
+	// Leave messages in the spill file as if the server died, with
+	// the last one cut short.
+	sf, err := openSpillFile(dir, "resume")
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, sf.write(&model.Message{DeviceID: fmt.Sprintf("d%d", i)}))
+	}
+	_, err = sf.w.Write([]byte(`{"deviceID":`))
+	assert.Nil(t, err)
+	assert.Nil(t, sf.close())
+
+	p, err := New(Config{Name: "resume", QueueSize: 1, Policy: PolicySpill, SpillDir: dir})
+	assert.Nil(t, err)
+	assert.Nil(t, p.Start(ctx))
+	assert.Equal(t, 4, p.Stats().SpillDepth)
+
+	// Nothing is passed on before the next stage is set
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 4, p.Stats().SpillDepth)
+
+	s := newSink()
+	close(s.release)
+	p.AddNext(s)
+	publish(t, p, 3, 5)
+	assert.Nil(t, p.Stop(ctx))
+	assert.Equal(t, ids(0, 5), s.deviceIDs())
+}
+
+func TestSpillReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	sf, err := openSpillFile(dir, "reopen")
+	assert.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, sf.write(&model.Message{DeviceID: fmt.Sprintf("d%d", i)}))
+	}
+	for i := 0; i < 2; i++ {
+		m, err := sf.read()
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprintf("d%d", i), m.DeviceID)
+	}
+	assert.Nil(t, sf.close())
+
+	// Messages that were read are not read again
+	sf, err = openSpillFile(dir, "reopen")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, sf.len())
+	m, err := sf.read()
+	assert.Nil(t, err)
+	assert.Equal(t, "d2", m.DeviceID)
+	assert.Nil(t, sf.close())
+
+	// An invalid offset means everything is read again
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "reopen.spill.offset"), []byte("garbage"), 0644))
+	sf, err = openSpillFile(dir, "reopen")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, sf.len())
+	m, err = sf.read()
+	assert.Nil(t, err)
+	assert.Equal(t, "d0", m.DeviceID)
+
+	// Reading to the end starts over with an empty file
+	for sf.len() > 0 {
+		_, err = sf.read()
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, sf.close())
+
+	sf, err = openSpillFile(dir, "reopen")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, sf.len())
+	assert.Nil(t, sf.write(&model.Message{DeviceID: "d5"}))
+	m, err = sf.read()
+	assert.Nil(t, err)
+	assert.Equal(t, "d5", m.DeviceID)
+	assert.Nil(t, sf.close())
+}
+
+func TestStopTimeout(t *testing.T) {
+	s := newSink()
+	p, err := New(Config{Name: t.Name(), QueueSize: 1})
+	assert.Nil(t, err)
+	p.AddNext(s)
+	assert.Nil(t, p.Start(ctx))
+
+	publish(t, p, 0, 1)
+	waitForDepth(t, p, 0)
+	publish(t, p, 1, 2)
+
+	// A publish waiting for room gives up when its context is done
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, p.Publish(shortCtx, &model.Message{}))
+
+	// The sink is stuck, so Stop gives up, abandoning the message
+	// being published and the ones queued
+	stopCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, p.Stop(stopCtx))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&s.active))
+
+	close(s.release)
+	time.Sleep(10 * time.Millisecond)
+	assert.Empty(t, s.deviceIDs())
+}
+
+// stuckSink is a pipeline element that ignores the context and blocks
+// until release is closed.
+type stuckSink struct {
+	release chan struct{}
+}
+
+func (s *stuckSink) Publish(ctx context.Context, m *model.Message) error {
+	<-s.release
+	return nil
+}
+
+func (s *stuckSink) AddNext(pipeline.Pipeline) {}
+
+func (s *stuckSink) Next() pipeline.Pipeline { return nil }
+
+func TestStopStuck(t *testing.T) {
+	abandonGrace = 10 * time.Millisecond
+	defer func() { abandonGrace = time.Second }()
+
+	s := &stuckSink{release: make(chan struct{})}
+	defer close(s.release)
+
+	p, err := New(Config{Name: t.Name(), QueueSize: 1})
+	assert.Nil(t, err)
+	p.AddNext(s)
+	assert.Nil(t, p.Start(ctx))
+	publish(t, p, 0, 1)
+	waitForDepth(t, p, 0)
+
+	// Stop returns even though the next stage ignores the context
+	stopCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.NotNil(t, p.Stop(stopCtx))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestWorkers(t *testing.T) {
+	s := newSink()
+	close(s.release)
+
+	p, err := New(Config{Name: t.Name(), Workers: 4})
+	assert.Nil(t, err)
+	p.AddNext(s)
+	assert.Nil(t, p.Start(ctx))
+	publish(t, p, 0, 100)
+	assert.Nil(t, p.Stop(ctx))
+
+	assert.ElementsMatch(t, ids(0, 100), s.deviceIDs())
+	assert.Equal(t, int64(100), p.Stats().Processed)
+}
+
+func TestConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{QueueSize: -1},
+		{Workers: -1},
+		{Policy: "nonexistent"},
+		{Policy: PolicySpill},
+	} {
+		_, err := New(cfg)
+		assert.NotNil(t, err, cfg)
+	}
+}
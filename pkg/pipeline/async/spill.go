@@ -0,0 +1,198 @@
+package async
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/lab5e/aqserver/pkg/model"
+)
+
+// spillFile is a FIFO of messages on disk, one JSON document per line.
+// The file is truncated whenever it has been read to the end.  Messages
+// left in the file when the server stops are picked up when it starts
+// again.  The offset of the first unread message is kept in a separate
+// file so that messages that were read are not passed on again after a
+// restart.
+type spillFile struct {
+	w          *os.File
+	r          *os.File
+	br         *bufio.Reader
+	count      int
+	offset     int64
+	offsetName string
+}
+
+// spilledMessage wraps a message so that the payload, which is not
+// part of the JSON representation of messages, is kept.
+type spilledMessage struct {
+	*model.Message
+	Payload []byte `json:"payload,omitempty"`
+}
+
+func openSpillFile(dir string, name string) (*spillFile, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	filename := filepath.Join(dir, name+".spill")
+	w, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := os.Open(filename)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	s := &spillFile{w: w, r: r, br: bufio.NewReader(r), offsetName: filename + ".offset"}
+
+	// Skip the messages that were read last time.  If the offset is
+	// missing or does not make sense, all the messages are read again.
+	s.offset = s.readOffset()
+	err = s.rewind()
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	// Count the messages left from last time
+	for {
+		line, err := s.br.ReadBytes('\n')
+		if err == io.EOF {
+			// Terminate a line cut short by a crash so that it does
+			// not run into the next message.  It will be skipped as
+			// unreadable.
+			if len(line) > 0 {
+				_, err = w.Write([]byte{'\n'})
+				if err != nil {
+					s.close()
+					return nil, err
+				}
+				s.count++
+			}
+			break
+		}
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s.count++
+	}
+	if s.count == 0 {
+		return s, s.truncate()
+	}
+	return s, s.rewind()
+}
+
+// readOffset returns the offset stored in the offset file, or 0 if the
+// offset file is missing or invalid.
+func (s *spillFile) readOffset() int64 {
+	data, err := os.ReadFile(s.offsetName)
+	if err != nil {
+		return 0
+	}
+	offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || offset < 0 {
+		return 0
+	}
+	info, err := s.r.Stat()
+	if err != nil || offset > info.Size() {
+		return 0
+	}
+	return offset
+}
+
+func (s *spillFile) writeOffset() error {
+	return os.WriteFile(s.offsetName, []byte(strconv.FormatInt(s.offset, 10)), 0644)
+}
+
+// len returns the number of unread messages.  A nil spillFile is empty.
+func (s *spillFile) len() int {
+	if s == nil {
+		return 0
+	}
+	return s.count
+}
+
+func (s *spillFile) write(m *model.Message) error {
+	data, err := json.Marshal(spilledMessage{Message: m, Payload: m.Payload})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.w.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+func (s *spillFile) read() (*model.Message, error) {
+	line, err := s.br.ReadBytes('\n')
+	if err != nil {
+		// The count and the file disagree, start over
+		s.count = 0
+		truncErr := s.truncate()
+		if truncErr != nil {
+			return nil, truncErr
+		}
+		return nil, errors.New("spill file is shorter than expected")
+	}
+
+	s.count--
+	s.offset += int64(len(line))
+	if s.count == 0 {
+		err = s.truncate()
+	} else {
+		err = s.writeOffset()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sm := spilledMessage{Message: &model.Message{}}
+	err = json.Unmarshal(line, &sm)
+	if err != nil {
+		return nil, err
+	}
+	sm.Message.Payload = sm.Payload
+	return sm.Message, nil
+}
+
+func (s *spillFile) truncate() error {
+	err := s.w.Truncate(0)
+	if err != nil {
+		return err
+	}
+	s.offset = 0
+	err = s.writeOffset()
+	if err != nil {
+		return err
+	}
+	return s.rewind()
+}
+
+// rewind moves the read position back to the first unread message.
+func (s *spillFile) rewind() error {
+	_, err := s.r.Seek(s.offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	s.br.Reset(s.r)
+	return nil
+}
+
+func (s *spillFile) close() error {
+	s.r.Close()
+	return s.w.Close()
+}
@@ -0,0 +1,191 @@
+package builder
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/store"
+)
+
+// Env holds what the stages of a pipeline share, and the defaults for
+// stage options that are usually given on the command line.  Options
+// in the pipeline description override the defaults.
+type Env struct {
+	DB         store.Store
+	CalcDebug  bool
+	PM         model.PMConfig
+	Conversion model.ConversionConfig
+	MQTT       MQTTOptions
+	SpillDir   string // Default directory for async stage spill files
+}
+
+// Factory creates a pipeline stage from its options.
+type Factory func(env *Env, opts Options) (pipeline.Pipeline, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+	fanOut      = map[string]bool{}
+)
+
+// Register registers the factory for a stage type.  Registering the
+// same type twice is a programming error and panics.
+func Register(stageType string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, exists := factories[stageType]; exists {
+		panic(fmt.Sprintf("pipeline stage type '%s' registered twice", stageType))
+	}
+	factories[stageType] = f
+}
+
+// RegisterFanOut registers the factory for a stage type that can pass
+// messages on to more than one next stage.  Only fan-out stages may have
+// more than one next stage in a pipeline description.
+func RegisterFanOut(stageType string, f Factory) {
+	Register(stageType, f)
+
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	fanOut[stageType] = true
+}
+
+func isFanOut(stageType string) bool {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	return fanOut[stageType]
+}
+
+// linker is implemented by stages that need more than AddNext to be
+// linked to their next stages.  next holds the names of the next
+// stages, whether they are enabled or not.  resolve maps a stage name to the
+// enabled stages it stands for, which may be none if the stage and the
+// stages following it are disabled.
+type linker interface {
+	link(next Names, resolve func(name string) []pipeline.Pipeline) error
+}
+
+func lookupFactory(stageType string) (Factory, bool) {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	f, ok := factories[stageType]
+	return f, ok
+}
+
+// Built is a pipeline built from a Config.
+type Built struct {
+	Root   *pipeline.Root
+	Stages map[string]pipeline.Pipeline // Enabled stages by name
+
+	order []string // Enabled stages, each before the stages it leads to
+}
+
+// Build validates the config, creates the stages and links them
+// together.
+func Build(cfg *Config, env *Env) (*Built, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	b := &Built{
+		Root:   pipeline.New(env.DB),
+		Stages: make(map[string]pipeline.Pipeline),
+		order:  cfg.order(),
+	}
+
+	for i := range cfg.Stages {
+		s := &cfg.Stages[i]
+		if s.Disabled {
+			continue
+		}
+
+		f, _ := lookupFactory(s.Type)
+		stage, err := f(env, Options{name: s.Name, node: &s.Options})
+		if err != nil {
+			return nil, fmt.Errorf("unable to create stage '%s': %v", s.Name, err)
+		}
+		b.Stages[s.Name] = stage
+	}
+
+	resolve := func(name string) []pipeline.Pipeline {
+		var ret []pipeline.Pipeline
+		for _, n := range dedup(cfg.resolve([]string{name}, len(cfg.Stages))) {
+			ret = append(ret, b.Stages[n])
+		}
+		return ret
+	}
+
+	b.Root.AddNext(b.Stages[cfg.first()])
+	for i := range cfg.Stages {
+		s := &cfg.Stages[i]
+		if s.Disabled {
+			continue
+		}
+
+		stage := b.Stages[s.Name]
+		if l, ok := stage.(linker); ok {
+			err := l.link(cfg.targets(s.Name), resolve)
+			if err != nil {
+				return nil, fmt.Errorf("unable to link stage '%s': %v", s.Name, err)
+			}
+			continue
+		}
+
+		for _, next := range cfg.nexts(s.Name) {
+			stage.AddNext(b.Stages[next])
+		}
+	}
+
+	return b, nil
+}
+
+// Start starts the stages that implement pipeline.Lifecycle, from the
+// end of the pipeline towards the start.  If a stage fails to start,
+// the stages already started are stopped again.
+func (b *Built) Start(ctx context.Context) error {
+	for i := len(b.order) - 1; i >= 0; i-- {
+		name := b.order[i]
+		l, ok := b.Stages[name].(pipeline.Lifecycle)
+		if !ok {
+			continue
+		}
+
+		err := l.Start(ctx)
+		if err != nil {
+			b.stop(ctx, b.order[i+1:])
+			return fmt.Errorf("unable to start stage '%s': %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Stop stops the stages that implement pipeline.Lifecycle, from the
+// start of the pipeline towards the end, so that each stage drains into
+// stages that are still running.  All stages are stopped even if some
+// of them fail, and the first error is returned.
+func (b *Built) Stop(ctx context.Context) error {
+	return b.stop(ctx, b.order)
+}
+
+func (b *Built) stop(ctx context.Context, names []string) error {
+	var first error
+	for _, name := range names {
+		l, ok := b.Stages[name].(pipeline.Lifecycle)
+		if !ok {
+			continue
+		}
+
+		err := l.Stop(ctx)
+		if err != nil && first == nil {
+			first = fmt.Errorf("unable to stop stage '%s': %v", name, err)
+		}
+	}
+	return first
+}
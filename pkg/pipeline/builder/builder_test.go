@@ -0,0 +1,349 @@
+package builder
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/pipeline/circular"
+	"github.com/lab5e/aqserver/pkg/pipeline/pipelog"
+	"github.com/lab5e/aqserver/pkg/pipeline/pmcalc"
+	"github.com/lab5e/aqserver/pkg/pipeline/router"
+	"github.com/lab5e/aqserver/pkg/pipeline/stream"
+	"github.com/lab5e/aqserver/pkg/pipeline/tee"
+	"github.com/stretchr/testify/assert"
+)
+
+func testEnv() *Env {
+	return &Env{
+		PM:         model.DefaultPMConfig(),
+		Conversion: model.DefaultConversionConfig(),
+	}
+}
+
+func TestBuild(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+stages:
+  - type: pmcalc
+    options:
+      kappa: 0.2
+  - type: log
+    disabled: true
+  - name: buffer
+    type: circular
+    next: stream
+    options:
+      size: 10
+  - name: unused
+    type: log
+    disabled: true
+  - type: stream
+`))
+	assert.Nil(t, err)
+
+	b, err := Build(cfg, testEnv())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(b.Stages))
+
+	pm, ok := b.Root.Next().(*pmcalc.PMCalc)
+	assert.True(t, ok)
+	buffer, ok := pm.Next().(*circular.Buffer)
+	assert.True(t, ok)
+	broker, ok := buffer.Next().(*stream.Broker)
+	assert.True(t, ok)
+	assert.Nil(t, broker.Next())
+
+	assert.Nil(t, b.Root.Publish(context.Background(), &model.Message{DeviceID: "foo"}))
+	assert.Equal(t, 1, len(buffer.GetContents()))
+}
+
+func TestBuildJSON(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{"stages": [{"type": "log", "next": "none"}, {"type": "circular", "disabled": true}]}`))
+	assert.Nil(t, err)
+
+	b, err := Build(cfg, testEnv())
+	assert.Nil(t, err)
+
+	l, ok := b.Root.Next().(*pipelog.Log)
+	assert.True(t, ok)
+	assert.Nil(t, l.Next())
+}
+
+func TestBuildBranches(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+stages:
+  - type: router
+    next: [indoor, outdoor, unused]
+    options:
+      routes:
+        - collectionIDs: [c1]
+          next: indoor
+        - deviceIDs: [d2]
+          next: unused
+      default: outdoor
+  - name: indoor
+    type: circular
+    next: none
+  - name: outdoor
+    type: tee
+    next: [buffer, stream]
+  - name: unused
+    type: log
+    disabled: true
+    next: none
+  - name: buffer
+    type: circular
+    next: none
+  - type: stream
+`))
+	assert.Nil(t, err)
+
+	b, err := Build(cfg, testEnv())
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(b.Stages))
+
+	indoor := b.Stages["indoor"].(*circular.Buffer)
+	buffer := b.Stages["buffer"].(*circular.Buffer)
+	fanout := b.Stages["outdoor"].(*teeStage)
+	assert.Equal(t, 2, len(fanout.Branches()))
+	assert.Equal(t, []tee.Policy{tee.PolicyDrop, tee.PolicyDrop}, fanout.Policies())
+
+	ctx := context.Background()
+	assert.Nil(t, b.Start(ctx))
+	assert.Nil(t, b.Root.Publish(context.Background(), &model.Message{DeviceID: "d1", CollectionID: "c1"}))
+	assert.Nil(t, b.Root.Publish(context.Background(), &model.Message{DeviceID: "d2", CollectionID: "c2"}))
+	assert.Nil(t, b.Root.Publish(context.Background(), &model.Message{DeviceID: "d3", CollectionID: "c2"}))
+	assert.Nil(t, b.Stop(ctx))
+
+	assert.Equal(t, 1, len(indoor.GetContents()))
+	assert.Equal(t, "d1", indoor.GetContents()[0].DeviceID)
+	assert.Equal(t, 1, len(buffer.GetContents()))
+	assert.Equal(t, "d3", buffer.GetContents()[0].DeviceID)
+}
+
+func TestRouterLink(t *testing.T) {
+	indoor := circular.New(10)
+	outdoor := circular.New(10)
+	stages := map[string][]pipeline.Pipeline{
+		"indoor":   {indoor},
+		"outdoor":  {outdoor},
+		"disabled": nil,
+		"fanout":   {indoor, outdoor},
+	}
+	resolve := func(name string) []pipeline.Pipeline {
+		return stages[name]
+	}
+	next := Names{"indoor", "outdoor", "disabled", "fanout"}
+
+	link := func(opts routerOptions) (*routerStage, error) {
+		r := &routerStage{Router: router.New(), opts: opts}
+		return r, r.link(next, resolve)
+	}
+
+	// Route targets must be listed as next stages
+	_, err := link(routerOptions{Routes: []routeOptions{{Next: "elsewhere"}}})
+	assert.NotNil(t, err)
+	_, err = link(routerOptions{Default: "elsewhere"})
+	assert.NotNil(t, err)
+
+	// Route targets must lead to a single stage
+	_, err = link(routerOptions{Routes: []routeOptions{{Next: "fanout"}}})
+	assert.NotNil(t, err)
+	_, err = link(routerOptions{Default: "fanout"})
+	assert.NotNil(t, err)
+
+	// Messages routed to a disabled stage are dropped
+	r, err := link(routerOptions{
+		Routes: []routeOptions{
+			{DeviceIDs: []string{"d1"}, Next: "disabled"},
+			{CollectionIDs: []string{"c1"}, Next: "indoor"},
+		},
+		Default: "outdoor",
+	})
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	assert.Nil(t, r.Publish(ctx, &model.Message{DeviceID: "d1", CollectionID: "c1"}))
+	assert.Nil(t, r.Publish(ctx, &model.Message{DeviceID: "d2", CollectionID: "c1"}))
+	assert.Nil(t, r.Publish(ctx, &model.Message{DeviceID: "d3", CollectionID: "c2"}))
+
+	assert.Equal(t, 1, len(indoor.GetContents()))
+	assert.Equal(t, "d2", indoor.GetContents()[0].DeviceID)
+	assert.Equal(t, 1, len(outdoor.GetContents()))
+	assert.Equal(t, "d3", outdoor.GetContents()[0].DeviceID)
+}
+
+func TestBuildTeeBlock(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+stages:
+  - type: tee
+    next: [stream, buffer]
+    options:
+      block: [buffer]
+  - type: stream
+    next: none
+  - name: buffer
+    type: log
+    disabled: true
+  - type: circular
+`))
+	assert.Nil(t, err)
+
+	b, err := Build(cfg, testEnv())
+	assert.Nil(t, err)
+
+	// Blocking applies to the stages a disabled stage stands for
+	fanout := b.Stages[TypeTee].(*teeStage)
+	assert.Equal(t, []tee.Policy{tee.PolicyDrop, tee.PolicyBlock}, fanout.Policies())
+	_, ok := fanout.Branches()[1].(*circular.Buffer)
+	assert.True(t, ok)
+}
+
+func TestBuildRetry(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`stages: [{type: retry, options: {initialBackoff: 500ms, maxBackoff: 1m}}, {type: persist}]`))
+	assert.Nil(t, err)
+
+	_, err = Build(cfg, testEnv())
+	assert.Nil(t, err)
+}
+
+func TestDefaultConfig(t *testing.T) {
+	assert.Nil(t, DefaultConfig(false).Validate())
+	assert.Nil(t, DefaultConfig(true).Validate())
+
+	cfg := DefaultConfig(true)
+
+	// Messages are stored before they are fanned out
+	assert.Equal(t, Names{"persist-retry"}, Names(cfg.nexts(TypeConvert)))
+	assert.Equal(t, Names{TypePersist}, Names(cfg.nexts("persist-retry")))
+	assert.Equal(t, Names{TypeLog}, Names(cfg.nexts(TypePersist)))
+	assert.Equal(t, Names{TypeTee}, Names(cfg.nexts(TypeLog)))
+	assert.Equal(t, Names{TypeStream, TypeCircular, "mqtt-retry"}, Names(cfg.nexts(TypeTee)))
+	assert.Equal(t, Names{TypeMQTT}, Names(cfg.nexts("mqtt-retry")))
+	assert.Empty(t, cfg.nexts(TypeStream))
+	assert.Empty(t, cfg.nexts(TypeCircular))
+	assert.Empty(t, cfg.nexts(TypeMQTT))
+}
+
+func TestValidate(t *testing.T) {
+	invalid := map[string]string{
+		"empty":           `stages: []`,
+		"all disabled":    `stages: [{type: log, disabled: true}]`,
+		"unknown type":    `stages: [{type: nonexistent}]`,
+		"duplicate name":  `stages: [{type: log}, {type: log}]`,
+		"reserved name":   `stages: [{name: none, type: log}]`,
+		"unknown next":    `stages: [{type: log, next: nonexistent}]`,
+		"cycle":           `stages: [{type: log}, {type: stream, next: log}]`,
+		"unreachable":     `stages: [{type: log, next: none}, {type: stream}]`,
+		"unknown field":   `stages: [{type: log, colour: blue}]`,
+		"unknown option":  `stages: [{type: circular, options: {colour: blue}}]`,
+		"no options":      `stages: [{type: log, options: {size: 10}}]`,
+		"invalid options": `stages: [{type: circular, options: {size: 0}}]`,
+		"not fan-out":     `stages: [{type: log, next: [stream, circular]}, {type: stream, next: none}, {type: circular}]`,
+		"none and others": `stages: [{type: tee, next: [none, stream]}, {type: stream}]`,
+		"tee cycle":       `stages: [{type: tee, next: [log, stream]}, {type: log, next: none}, {type: stream, next: tee}]`,
+		"queue size":      `stages: [{type: tee, options: {queueSize: 0}}, {type: log}]`,
+		"block not next":  `stages: [{type: tee, next: log, options: {block: [stream]}}, {type: log, next: none}, {type: stream}]`,
+		"route not next":  `stages: [{type: router, next: log, options: {routes: [{next: stream}]}}, {type: log, next: none}, {type: stream}]`,
+		"route no next":   `stages: [{type: router, options: {routes: [{deviceIDs: [d1]}]}}, {type: log}]`,
+		"async overflow":  `stages: [{type: async, options: {overflow: sometimes}}, {type: log}]`,
+		"async spill dir": `stages: [{type: async, options: {overflow: spill}}, {type: log}]`,
+		"retry attempts":  `stages: [{type: retry, options: {maxAttempts: -1}}, {type: log}]`,
+		"retry backoff":   `stages: [{type: retry, options: {initialBackoff: 2s, maxBackoff: 1s}}, {type: log}]`,
+		"retry duration":  `stages: [{type: retry, options: {initialBackoff: soon}}, {type: log}]`,
+		"route fans out":  `stages: [{type: router, next: log, options: {routes: [{next: log}]}}, {type: log, disabled: true, next: [stream, circular]}, {type: stream, next: none}, {type: circular}]`,
+	}
+
+	for name, config := range invalid {
+		cfg, err := ParseConfig([]byte(config))
+		if err != nil {
+			continue
+		}
+
+		_, err = Build(cfg, testEnv())
+		assert.NotNil(t, err, name)
+	}
+}
+
+// lifecycleStage records when it is started and stopped in events.
+type lifecycleStage struct {
+	name   string
+	fail   bool
+	events *[]string
+	next   pipeline.Pipeline
+}
+
+func (l *lifecycleStage) Start(ctx context.Context) error {
+	if l.fail {
+		return errors.New("failed")
+	}
+	*l.events = append(*l.events, "start "+l.name)
+	return nil
+}
+
+func (l *lifecycleStage) Stop(ctx context.Context) error {
+	*l.events = append(*l.events, "stop "+l.name)
+	return nil
+}
+
+func (l *lifecycleStage) Publish(ctx context.Context, m *model.Message) error { return nil }
+
+func (l *lifecycleStage) AddNext(pe pipeline.Pipeline) { l.next = pe }
+
+func (l *lifecycleStage) Next() pipeline.Pipeline { return l.next }
+
+var lifecycleEvents []string
+
+func init() {
+	RegisterFanOut("lifecycle", func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		var o struct {
+			Fail bool `yaml:"fail"`
+		}
+		err := opts.Decode(&o)
+		if err != nil {
+			return nil, err
+		}
+		return &lifecycleStage{name: opts.Name(), fail: o.Fail, events: &lifecycleEvents}, nil
+	})
+}
+
+func TestStartStop(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`
+stages:
+  - name: a
+    type: lifecycle
+    next: [c, b]
+  - name: b
+    type: lifecycle
+    next: d
+  - name: c
+    type: lifecycle
+    next: b
+  - name: d
+    type: lifecycle
+`))
+	assert.Nil(t, err)
+
+	b, err := Build(cfg, testEnv())
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	lifecycleEvents = nil
+	assert.Nil(t, b.Start(ctx))
+	assert.Nil(t, b.Stop(ctx))
+	assert.Equal(t, []string{
+		"start d", "start b", "start c", "start a",
+		"stop a", "stop c", "stop b", "stop d",
+	}, lifecycleEvents)
+
+	// Stages already started are stopped if one fails to start
+	assert.Nil(t, cfg.Stages[2].Options.Encode(map[string]bool{"fail": true}))
+	b, err = Build(cfg, testEnv())
+	assert.Nil(t, err)
+
+	lifecycleEvents = nil
+	assert.NotNil(t, b.Start(ctx))
+	assert.Equal(t, []string{"start d", "start b", "stop b", "stop d"}, lifecycleEvents)
+}
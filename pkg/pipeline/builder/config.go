@@ -0,0 +1,363 @@
+// Package builder builds pipelines from a declarative description of
+// the stages, so that deployments can enable, disable and reorder
+// stages without recompiling.
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// NextNone is used as the next stage to end a chain before the end of
+// the stage list.
+const NextNone = "none"
+
+// Config describes a pipeline.  Config files may be YAML or JSON.
+//
+//	stages:
+//	  - name: calc
+//	    type: calculate
+//	    options:
+//	      debug: true
+//	  - name: persist
+//	    type: persist
+//
+// Messages enter the pipeline at the first enabled stage.  Each stage
+// passes messages on to the stage named by next, or to the following
+// enabled stage in the list if next is not set.  Fan-out stages like
+// tee and router can have a list of next stages:
+//
+//	stages:
+//	  - name: fanout
+//	    type: tee
+//	    next: [stream, mqtt]
+//
+// If next names a disabled stage, its next stages are used instead.
+type Config struct {
+	Stages []StageConfig `yaml:"stages"`
+}
+
+// StageConfig describes a pipeline stage.
+type StageConfig struct {
+	Name     string    `yaml:"name"`     // Unique name of the stage, defaults to the type
+	Type     string    `yaml:"type"`     // Stage type, as registered with Register
+	Disabled bool      `yaml:"disabled"` // Disabled stages are skipped
+	Next     Names     `yaml:"next"`     // Names of the next stages or NextNone
+	Options  yaml.Node `yaml:"options"`  // Stage specific options
+}
+
+// Names is a list of stage names.  In pipeline descriptions a single
+// name can be given without making it a list.
+type Names []string
+
+// UnmarshalYAML ...
+func (n *Names) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*n = Names{value.Value}
+		return nil
+	}
+
+	var names []string
+	err := value.Decode(&names)
+	*n = names
+	return err
+}
+
+func (n Names) contains(name string) bool {
+	for _, s := range n {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Options holds the stage specific options of a stage.
+type Options struct {
+	name string
+	node *yaml.Node
+}
+
+// Name returns the name of the stage the options belong to.
+func (o Options) Name() string {
+	return o.name
+}
+
+// Decode decodes the options into v.  Options that do not correspond
+// to a field in v are reported as errors so that spelling mistakes
+// are caught at startup.  Fields in v that are not given in the
+// options are left untouched, so v should hold the defaults.
+func (o Options) Decode(v interface{}) error {
+	if o.node == nil || o.node.Kind == 0 {
+		return nil
+	}
+
+	// yaml.Node.Decode does not check for unknown fields, so we
+	// have to go through a Decoder.
+	data, err := yaml.Marshal(o.node)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(v)
+}
+
+// ParseConfig parses a YAML or JSON pipeline description.  Environment
+// variables in the description are expanded, which is useful for
+// keeping secrets out of the file.
+func ParseConfig(data []byte) (*Config, error) {
+	var cfg Config
+
+	dec := yaml.NewDecoder(bytes.NewReader([]byte(os.ExpandEnv(string(data)))))
+	dec.KnownFields(true)
+	err := dec.Decode(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range cfg.Stages {
+		if cfg.Stages[i].Name == "" {
+			cfg.Stages[i].Name = cfg.Stages[i].Type
+		}
+	}
+	return &cfg, nil
+}
+
+// ReadConfig reads a YAML or JSON pipeline description from a file.
+func ReadConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse pipeline config '%s': %v", filename, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks that the stages are well formed and that they form
+// a graph without cycles where every stage can be reached from the
+// first enabled stage.
+func (c *Config) Validate() error {
+	stages := make(map[string]*StageConfig)
+	for i := range c.Stages {
+		s := &c.Stages[i]
+
+		if s.Name == "" {
+			return fmt.Errorf("stage %d has no name", i+1)
+		}
+		if s.Name == NextNone {
+			return fmt.Errorf("stage %d: '%s' is reserved and cannot be used as a stage name", i+1, NextNone)
+		}
+		if _, exists := stages[s.Name]; exists {
+			return fmt.Errorf("duplicate stage name '%s'", s.Name)
+		}
+		if _, ok := lookupFactory(s.Type); !ok {
+			return fmt.Errorf("stage '%s' has unknown type '%s'", s.Name, s.Type)
+		}
+		stages[s.Name] = s
+	}
+
+	for _, s := range c.Stages {
+		for _, next := range s.Next {
+			if next == NextNone {
+				if len(s.Next) > 1 {
+					return fmt.Errorf("stage '%s' cannot have '%s' together with other next stages", s.Name, NextNone)
+				}
+				continue
+			}
+			if stages[next] == nil {
+				return fmt.Errorf("stage '%s' refers to unknown next stage '%s'", s.Name, next)
+			}
+		}
+	}
+
+	first := c.first()
+	if first == "" {
+		return errors.New("pipeline has no enabled stages")
+	}
+
+	for _, s := range c.Stages {
+		if s.Disabled || isFanOut(s.Type) {
+			continue
+		}
+		if next := c.nexts(s.Name); len(next) > 1 {
+			return fmt.Errorf("stage '%s' of type '%s' can only have one next stage, has %v", s.Name, s.Type, next)
+		}
+	}
+
+	// Depth first search from every stage finds any cycle
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("stage '%s' is part of a cycle", name)
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		for _, next := range c.nexts(name) {
+			err := visit(next)
+			if err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, s := range c.Stages {
+		if !s.Disabled {
+			err := visit(s.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	reachable := map[string]bool{}
+	queue := []string{first}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if reachable[name] {
+			continue
+		}
+		reachable[name] = true
+		queue = append(queue, c.nexts(name)...)
+	}
+	for _, s := range c.Stages {
+		if !s.Disabled && !reachable[s.Name] {
+			return fmt.Errorf("stage '%s' is not reachable from the first stage '%s'", s.Name, first)
+		}
+	}
+
+	return nil
+}
+
+// order returns the names of the enabled stages so that every stage
+// comes before the stages it leads to.  The config must be valid.
+func (c *Config) order() []string {
+	var (
+		visited = make(map[string]bool)
+		post    []string
+		visit   func(name string)
+	)
+	visit = func(name string) {
+		if visited[name] {
+			return
+		}
+		visited[name] = true
+		for _, next := range c.nexts(name) {
+			visit(next)
+		}
+		post = append(post, name)
+	}
+	for _, s := range c.Stages {
+		if !s.Disabled {
+			visit(s.Name)
+		}
+	}
+
+	// Reversed post order is a topological order
+	for i, j := 0, len(post)-1; i < j; i, j = i+1, j-1 {
+		post[i], post[j] = post[j], post[i]
+	}
+	return post
+}
+
+// first returns the name of the first enabled stage.
+func (c *Config) first() string {
+	for _, s := range c.Stages {
+		if !s.Disabled {
+			return s.Name
+		}
+	}
+	return ""
+}
+
+// nexts returns the names of the enabled stages that follow the stage
+// called name.  Disabled stages are skipped.
+func (c *Config) nexts(name string) []string {
+	return dedup(c.resolve(c.targets(name), len(c.Stages)))
+}
+
+// targets returns the names of the stages that follow the stage
+// called name, whether they are enabled or not.
+func (c *Config) targets(name string) []string {
+	i := c.index(name)
+	if i < 0 {
+		return nil
+	}
+
+	s := c.Stages[i]
+	switch {
+	case len(s.Next) == 1 && s.Next[0] == NextNone:
+		return nil
+
+	case len(s.Next) > 0:
+		return s.Next
+
+	case i+1 < len(c.Stages):
+		return []string{c.Stages[i+1].Name}
+	}
+	return nil
+}
+
+// resolve replaces disabled stages in names with the stages that
+// follow them.  depth guards against cycles among disabled stages.
+func (c *Config) resolve(names []string, depth int) []string {
+	var resolved []string
+	for _, name := range names {
+		i := c.index(name)
+		if i < 0 {
+			continue
+		}
+
+		if !c.Stages[i].Disabled {
+			resolved = append(resolved, name)
+			continue
+		}
+
+		if depth > 0 {
+			resolved = append(resolved, c.resolve(c.targets(name), depth-1)...)
+		}
+	}
+	return resolved
+}
+
+// dedup removes repeated names, which can happen when several disabled
+// stages lead to the same stage.
+func dedup(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	ret := names[:0]
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+func (c *Config) index(name string) int {
+	for i := range c.Stages {
+		if c.Stages[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,437 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/pipeline/async"
+	"github.com/lab5e/aqserver/pkg/pipeline/calculate"
+	"github.com/lab5e/aqserver/pkg/pipeline/circular"
+	"github.com/lab5e/aqserver/pkg/pipeline/convert"
+	"github.com/lab5e/aqserver/pkg/pipeline/persist"
+	"github.com/lab5e/aqserver/pkg/pipeline/pipelog"
+	"github.com/lab5e/aqserver/pkg/pipeline/pipemqtt"
+	"github.com/lab5e/aqserver/pkg/pipeline/pmcalc"
+	"github.com/lab5e/aqserver/pkg/pipeline/registry"
+	"github.com/lab5e/aqserver/pkg/pipeline/retry"
+	"github.com/lab5e/aqserver/pkg/pipeline/router"
+	"github.com/lab5e/aqserver/pkg/pipeline/stream"
+	"github.com/lab5e/aqserver/pkg/pipeline/tee"
+)
+
+// Stage types provided by this repository.
+const (
+	TypeRegistry  = "registry"
+	TypeCalculate = "calculate"
+	TypePMCalc    = "pmcalc"
+	TypeConvert   = "convert"
+	TypePersist   = "persist"
+	TypeLog       = "log"
+	TypeStream    = "stream"
+	TypeCircular  = "circular"
+	TypeMQTT      = "mqtt"
+	TypeTee       = "tee"
+	TypeRouter    = "router"
+	TypeAsync     = "async"
+	TypeRetry     = "retry"
+)
+
+// DefaultCircularBufferSize is the number of messages kept by the
+// circular buffer stage unless configured otherwise.
+const DefaultCircularBufferSize = 1000
+
+// MQTTOptions are the options of the MQTT stage.
+type MQTTOptions struct {
+	Address     string `yaml:"address"`
+	ClientID    string `yaml:"clientID"`
+	Password    string `yaml:"password"`
+	TopicPrefix string `yaml:"topicPrefix"`
+}
+
+// calculateOptions are the options of the calculate stage.
+type calculateOptions struct {
+	Debug            bool `yaml:"debug"`
+	ApplyCorrections bool `yaml:"applyCorrections"`
+}
+
+// pmCalcOptions are the options of the PM calculation stage.
+type pmCalcOptions struct {
+	ParticleDensity float64   `yaml:"particleDensity"`
+	Kappa           float64   `yaml:"kappa"`
+	BinBoundaries   []float64 `yaml:"binBoundaries"`
+}
+
+// convertOptions are the options of the unit conversion stage.
+type convertOptions struct {
+	Pressure           float64 `yaml:"pressure"`
+	StandardConditions bool    `yaml:"standardConditions"`
+	TemperatureSource  string  `yaml:"temperatureSource"`
+}
+
+// circularOptions are the options of the circular buffer stage.
+type circularOptions struct {
+	Size int `yaml:"size"`
+}
+
+// teeOptions are the options of the tee stage.  The branches leading
+// to the next stages listed in block wait for room in their queue
+// instead of dropping messages when they fall behind.
+//
+//	stages:
+//	  - type: tee
+//	    next: [persist, stream]
+//	    options:
+//	      block: [persist]
+type teeOptions struct {
+	QueueSize int      `yaml:"queueSize"`
+	Block     []string `yaml:"block"`
+}
+
+// teeStage adds the branches of a tee with the policy given by its
+// options.
+type teeStage struct {
+	*tee.Tee
+	opts teeOptions
+}
+
+func (t *teeStage) link(next Names, resolve func(name string) []pipeline.Pipeline) error {
+	block := Names(t.opts.Block)
+	for _, name := range block {
+		if !next.contains(name) {
+			return fmt.Errorf("'%s' is not listed as a next stage", name)
+		}
+	}
+
+	added := make(map[pipeline.Pipeline]bool)
+	for _, name := range next {
+		policy := tee.PolicyDrop
+		if block.contains(name) {
+			policy = tee.PolicyBlock
+		}
+
+		for _, pe := range resolve(name) {
+			if !added[pe] {
+				added[pe] = true
+				t.AddBranch(pe, policy)
+			}
+		}
+	}
+	return nil
+}
+
+// asyncOptions are the options of the async stage.
+type asyncOptions struct {
+	QueueSize int          `yaml:"queueSize"`
+	Workers   int          `yaml:"workers"`
+	Overflow  async.Policy `yaml:"overflow"`
+	SpillDir  string       `yaml:"spillDir"`
+}
+
+// retryOptions are the options of the retry stage.
+type retryOptions struct {
+	MaxAttempts    int           `yaml:"maxAttempts"`
+	InitialBackoff time.Duration `yaml:"initialBackoff"`
+	MaxBackoff     time.Duration `yaml:"maxBackoff"`
+	DeadLetters    bool          `yaml:"deadLetters"`
+}
+
+// routerOptions are the options of the router stage.  The stages named
+// by the routes and the default must also be listed as next stages of
+// the router.
+//
+//	stages:
+//	  - name: route
+//	    type: router
+//	    next: [indoor, outdoor]
+//	    options:
+//	      routes:
+//	        - collectionIDs: [17dh0cf43jg007]
+//	          next: indoor
+//	      default: outdoor
+type routerOptions struct {
+	Routes  []routeOptions `yaml:"routes"`
+	Default string         `yaml:"default"`
+}
+
+type routeOptions struct {
+	DeviceIDs     []string `yaml:"deviceIDs"`
+	CollectionIDs []string `yaml:"collectionIDs"`
+	Next          string   `yaml:"next"`
+}
+
+// routerStage links a router to its next stages according to its
+// options.
+type routerStage struct {
+	*router.Router
+	opts routerOptions
+}
+
+func (r *routerStage) link(next Names, resolve func(name string) []pipeline.Pipeline) error {
+	target := func(name string) (pipeline.Pipeline, error) {
+		if !next.contains(name) {
+			return nil, fmt.Errorf("'%s' is not listed as a next stage", name)
+		}
+
+		stages := resolve(name)
+		switch len(stages) {
+		case 0:
+			// The stage is disabled and nothing follows it
+			return nil, nil
+		case 1:
+			return stages[0], nil
+		}
+		return nil, fmt.Errorf("'%s' leads to more than one stage, use a tee to fan out", name)
+	}
+
+	for i, route := range r.opts.Routes {
+		pe, err := target(route.Next)
+		if err != nil {
+			return fmt.Errorf("route %d: %v", i+1, err)
+		}
+
+		// Messages matching a route to a disabled stage are dropped
+		// rather than passed on to the next route.
+		r.AddRoute(router.Match{DeviceIDs: route.DeviceIDs, CollectionIDs: route.CollectionIDs}, pe)
+	}
+
+	if r.opts.Default != "" {
+		pe, err := target(r.opts.Default)
+		if err != nil {
+			return fmt.Errorf("default: %v", err)
+		}
+		if pe != nil {
+			r.AddNext(pe)
+		}
+	}
+	return nil
+}
+
+// noOptions is used for stages that have no options, so that any
+// options given are reported as errors.
+type noOptions struct{}
+
+func init() {
+	Register(TypeRegistry, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		err := opts.Decode(&noOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return registry.New(env.DB)
+	})
+
+	Register(TypeCalculate, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		o := calculateOptions{Debug: env.CalcDebug, ApplyCorrections: true}
+		err := opts.Decode(&o)
+		if err != nil {
+			return nil, err
+		}
+
+		c := calculate.New(env.DB)
+		c.SetDebug(o.Debug)
+		c.SetApplyCorrections(o.ApplyCorrections)
+		return c, nil
+	})
+
+	Register(TypePMCalc, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		o := pmCalcOptions{
+			ParticleDensity: env.PM.ParticleDensity,
+			Kappa:           env.PM.Kappa,
+			BinBoundaries:   env.PM.BinBoundaries,
+		}
+		err := opts.Decode(&o)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := env.PM
+		cfg.ParticleDensity = o.ParticleDensity
+		cfg.Kappa = o.Kappa
+		cfg.BinBoundaries = o.BinBoundaries
+		return pmcalc.New(cfg)
+	})
+
+	Register(TypeConvert, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		o := convertOptions{
+			Pressure:           env.Conversion.Pressure,
+			StandardConditions: env.Conversion.StandardConditions,
+			TemperatureSource:  env.Conversion.TemperatureSource,
+		}
+		err := opts.Decode(&o)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := env.Conversion
+		cfg.Pressure = o.Pressure
+		cfg.StandardConditions = o.StandardConditions
+		cfg.TemperatureSource = o.TemperatureSource
+		return convert.New(cfg)
+	})
+
+	Register(TypePersist, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		err := opts.Decode(&noOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return persist.New(env.DB), nil
+	})
+
+	Register(TypeLog, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		err := opts.Decode(&noOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return pipelog.New(), nil
+	})
+
+	Register(TypeStream, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		err := opts.Decode(&noOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return stream.NewBroker(), nil
+	})
+
+	Register(TypeCircular, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		o := circularOptions{Size: DefaultCircularBufferSize}
+		err := opts.Decode(&o)
+		if err != nil {
+			return nil, err
+		}
+
+		if o.Size < 1 {
+			return nil, errors.New("size must be positive")
+		}
+		return circular.New(o.Size), nil
+	})
+
+	Register(TypeMQTT, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		o := env.MQTT
+		err := opts.Decode(&o)
+		if err != nil {
+			return nil, err
+		}
+
+		if o.Address == "" {
+			return nil, errors.New("address is required")
+		}
+		return pipemqtt.New(o.ClientID, o.Password, o.Address, o.TopicPrefix), nil
+	})
+
+	RegisterFanOut(TypeTee, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		o := teeOptions{QueueSize: tee.DefaultQueueSize}
+		err := opts.Decode(&o)
+		if err != nil {
+			return nil, err
+		}
+
+		if o.QueueSize < 1 {
+			return nil, errors.New("queueSize must be positive")
+		}
+		return &teeStage{Tee: tee.New(o.QueueSize), opts: o}, nil
+	})
+
+	Register(TypeAsync, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		o := asyncOptions{
+			QueueSize: async.DefaultQueueSize,
+			Workers:   async.DefaultWorkers,
+			Overflow:  async.DefaultPolicy,
+			SpillDir:  env.SpillDir,
+		}
+		err := opts.Decode(&o)
+		if err != nil {
+			return nil, err
+		}
+
+		return async.New(async.Config{
+			Name:      opts.Name(),
+			QueueSize: o.QueueSize,
+			Workers:   o.Workers,
+			Policy:    o.Overflow,
+			SpillDir:  o.SpillDir,
+		})
+	})
+
+	Register(TypeRetry, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		o := retryOptions{
+			MaxAttempts:    retry.DefaultMaxAttempts,
+			InitialBackoff: retry.DefaultInitialBackoff,
+			MaxBackoff:     retry.DefaultMaxBackoff,
+			DeadLetters:    true,
+		}
+		err := opts.Decode(&o)
+		if err != nil {
+			return nil, err
+		}
+
+		cfg := retry.Config{
+			Name:           opts.Name(),
+			MaxAttempts:    o.MaxAttempts,
+			InitialBackoff: o.InitialBackoff,
+			MaxBackoff:     o.MaxBackoff,
+		}
+		if o.DeadLetters && env.DB != nil {
+			cfg.DeadLetters = env.DB
+		}
+		return retry.New(cfg)
+	})
+
+	RegisterFanOut(TypeRouter, func(env *Env, opts Options) (pipeline.Pipeline, error) {
+		var o routerOptions
+		err := opts.Decode(&o)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, route := range o.Routes {
+			if route.Next == "" {
+				return nil, fmt.Errorf("route %d has no next stage", i+1)
+			}
+		}
+		return &routerStage{Router: router.New(), opts: o}, nil
+	})
+}
+
+// DefaultConfig returns the pipeline the server uses unless it is
+// given a pipeline description.  Messages are queued on entry so that
+// the listeners are not held up by the rest of the pipeline.  Messages
+// are stored before they are passed on, so that the other sinks see
+// the storage ID and messages that were already stored are not passed
+// on again.  The other sinks run as branches of a tee so that a slow
+// sink does not hold up the others.  If mqtt is set, MQTT is one of
+// the branches.  Storing and publishing to MQTT are retried, and
+// messages that fail are kept as dead letters.
+func DefaultConfig(mqtt bool) *Config {
+	const (
+		persistRetry = "persist-retry"
+		mqttRetry    = "mqtt-retry"
+	)
+
+	cfg := &Config{
+		Stages: []StageConfig{
+			{Name: TypeAsync, Type: TypeAsync},
+			{Name: TypeRegistry, Type: TypeRegistry},
+			{Name: TypeCalculate, Type: TypeCalculate},
+			{Name: TypePMCalc, Type: TypePMCalc},
+			{Name: TypeConvert, Type: TypeConvert},
+			{Name: persistRetry, Type: TypeRetry},
+			{Name: TypePersist, Type: TypePersist},
+			{Name: TypeLog, Type: TypeLog},
+			{Name: TypeTee, Type: TypeTee, Next: Names{TypeStream, TypeCircular}},
+			{Name: TypeStream, Type: TypeStream, Next: Names{NextNone}},
+			{Name: TypeCircular, Type: TypeCircular, Next: Names{NextNone}},
+		},
+	}
+
+	if mqtt {
+		fanout := &cfg.Stages[cfg.index(TypeTee)]
+		fanout.Next = append(fanout.Next, mqttRetry)
+		cfg.Stages = append(cfg.Stages,
+			StageConfig{Name: mqttRetry, Type: TypeRetry},
+			StageConfig{Name: TypeMQTT, Type: TypeMQTT},
+		)
+	}
+	return cfg
+}
@@ -2,8 +2,10 @@
 package calculate
 
 import (
+	"context"
 	"log"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/lab5e/aqserver/pkg/model"
@@ -15,9 +17,26 @@ import (
 type Calculate struct {
 	next             pipeline.Pipeline
 	db               store.Store
-	calibrationCache map[uint64][]model.Cal
 	cacheRefreshChan chan bool
+	debug            bool
+	applyCorrections bool
+
+	// mu protects the cached data below, which is replaced as a
+	// whole when the cache is reloaded.
+	mu               sync.RWMutex
+	calibrationCache map[uint64][]model.Cal
+	boardsByDevice   map[string][]model.DeviceBoard
+	boardsBySysID    map[uint64][]model.DeviceBoard
 	lastCacheUpdate  time.Time
+
+	// Corrections by device ID and component, sorted in descending
+	// order by date.
+	corrections map[correctionKey][]model.Correction
+}
+
+type correctionKey struct {
+	deviceID  string
+	component string
 }
 
 const (
@@ -30,6 +49,7 @@ func New(db store.Store) *Calculate {
 	c := &Calculate{
 		db:               db,
 		cacheRefreshChan: make(chan bool),
+		applyCorrections: true,
 	}
 
 	err := c.loadCache()
@@ -39,17 +59,90 @@ func New(db store.Store) *Calculate {
 	return c
 }
 
+// Reload reloads the calibration data, device board registry and
+// corrections from the database.  Messages being calculated while the
+// cache is reloaded see either the old or the new data, never a mix.
+func (p *Calculate) Reload() error {
+	err := p.loadCache()
+	if err != nil {
+		return err
+	}
+	log.Print("Reloaded calibration data cache")
+	return nil
+}
+
 func (p *Calculate) loadCache() error {
 	cals, err := p.db.ListCals(0, maxint)
 	if err != nil {
 		return err
 	}
 
+	boards, err := p.db.ListDeviceBoards()
+	if err != nil {
+		return err
+	}
+
+	corrections, err := p.db.ListCorrections()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.populateCache(cals)
+	p.populateBoards(boards)
+	p.populateCorrections(corrections)
 
 	return nil
 }
 
+// The populate functions replace parts of the cache and must be
+// called with p.mu held.
+
+func (p *Calculate) populateCorrections(corrections []model.Correction) {
+	m := make(map[correctionKey][]model.Correction)
+	for _, c := range corrections {
+		key := correctionKey{deviceID: c.DeviceID, component: c.Component}
+		m[key] = append(m[key], c)
+	}
+
+	for _, v := range m {
+		sort.Slice(v, func(i, j int) bool {
+			return v[i].ValidFrom.After(v[j].ValidFrom)
+		})
+	}
+
+	p.corrections = m
+}
+
+func (p *Calculate) populateBoards(boards []model.DeviceBoard) {
+	byDevice := make(map[string][]model.DeviceBoard)
+	bySysID := make(map[uint64][]model.DeviceBoard)
+	for _, b := range boards {
+		byDevice[b.DeviceID] = append(byDevice[b.DeviceID], b)
+		bySysID[b.SysID] = append(bySysID[b.SysID], b)
+	}
+
+	p.boardsByDevice = byDevice
+	p.boardsBySysID = bySysID
+}
+
+// findCorrection returns the newest correction for the device and
+// component that is valid at t, or nil if there is none.
+func (p *Calculate) findCorrection(deviceID string, component string, t int64) *model.Correction {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	date := time.UnixMilli(t)
+	for _, c := range p.corrections[correctionKey{deviceID: deviceID, component: component}] {
+		if !date.Before(c.ValidFrom) {
+			return &c
+		}
+	}
+	return nil
+}
+
 func (p *Calculate) populateCache(cals []model.Cal) {
 	m := make(map[uint64][]model.Cal)
 
@@ -72,16 +165,28 @@ func (p *Calculate) populateCache(cals []model.Cal) {
 	p.lastCacheUpdate = time.Now()
 }
 
-// findCacheEntry assumes that the calibration entries are sorted in
-// descending order by date in the cache.
-func (p *Calculate) findCacheEntry(sysID uint64, t int64) *model.Cal {
+// findCal looks up the calibration entry for a message from deviceID
+// with the board sysID received at t.  Calibration data follows the
+// board, so it is looked up by sysID.  If the message does not carry
+// the sysID, or there is no calibration data for it, we look up which
+// board was installed in the device at t in the device board registry.
+func (p *Calculate) findCal(sysID uint64, deviceID string, collectionID string, t int64) *model.Cal {
 	// Somewhat hokey caching logic.  Replace this nonsense with a
 	// proper caching layer that uses the Store interface.
+	var board uint64
 	refreshedCache := false
-	var deviceCalEntries []model.Cal
 	for {
-		deviceCalEntries = p.calibrationCache[sysID]
-		if deviceCalEntries != nil {
+		board = p.boardForDevice(deviceID, t)
+		if sysID == 0 {
+			sysID = board
+		}
+
+		p.mu.RLock()
+		found := p.calibrationCache[sysID] != nil || (board != 0 && p.calibrationCache[board] != nil)
+		lastCacheUpdate := p.lastCacheUpdate
+		p.mu.RUnlock()
+
+		if found {
 			// We found cache entry so bail out
 			break
 		}
@@ -89,13 +194,13 @@ func (p *Calculate) findCacheEntry(sysID uint64, t int64) *model.Cal {
 		// We did not find a cached entry.  If we have already
 		// refreshed, we bail and accept the consequences.
 		if refreshedCache {
-			log.Printf("Missing calibration data for '%d' (will only report every %.2f seconds)", sysID, minCacheUpdateDelay.Seconds())
+			log.Printf("Missing calibration data for '%d' device='%s' (will only report every %.2f seconds)", sysID, deviceID, minCacheUpdateDelay.Seconds())
 			break
 		}
 
 		// Check when we last updated cache.  If it is less than
 		// minCacheUpdateDelay we skip the update
-		if time.Now().Before(p.lastCacheUpdate.Add(minCacheUpdateDelay)) {
+		if time.Now().Before(lastCacheUpdate.Add(minCacheUpdateDelay)) {
 			break
 		}
 
@@ -108,34 +213,134 @@ func (p *Calculate) findCacheEntry(sysID uint64, t int64) *model.Cal {
 		log.Print("Refreshed calibration data cache")
 	}
 
+	cal := p.findCacheEntry(sysID, collectionID, t)
+	if cal == nil && board != 0 && board != sysID {
+		cal = p.findCacheEntry(board, collectionID, t)
+	}
+	return cal
+}
+
+// boardForDevice returns the sysID of the board that was installed in
+// deviceID at t according to the device board registry, or 0 if it
+// is not known.
+func (p *Calculate) boardForDevice(deviceID string, t int64) uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	b := model.FindDeviceBoard(p.boardsByDevice[deviceID], time.UnixMilli(t))
+	if b == nil {
+		return 0
+	}
+	return b.SysID
+}
+
+// deviceForBoard returns the ID of the device that the board sysID
+// was installed in at t according to the device board registry, or
+// the empty string if it is not known.
+func (p *Calculate) deviceForBoard(sysID uint64, t int64) string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	b := model.FindDeviceBoard(p.boardsBySysID[sysID], time.UnixMilli(t))
+	if b == nil {
+		return ""
+	}
+	return b.DeviceID
+}
+
+// findCacheEntry assumes that the calibration entries are sorted in
+// descending order by date in the cache.  It returns the newest entry
+// for sysID that covers t, or nil if there is none.  If collectionID
+// is set, calibration entries belonging to other collections are
+// ignored.  Entries without a collection ID match any collection.
+func (p *Calculate) findCacheEntry(sysID uint64, collectionID string, t int64) *model.Cal {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
 	date := time.Unix(0, t*int64(time.Millisecond))
 
-	var cal model.Cal
-	for i := 0; i < len(deviceCalEntries); i++ {
-		cal = deviceCalEntries[i]
-		if !date.Before(cal.ValidFrom) {
-			break
+	for _, entry := range p.calibrationCache[sysID] {
+		if collectionID != "" && entry.CollectionID != "" && entry.CollectionID != collectionID {
+			continue
+		}
+
+		if entry.Covers(date) {
+			cal := entry
+			return &cal
 		}
 	}
 
-	return &cal
+	return nil
+}
+
+// SetDebug turns on recording of the intermediate calculation values
+// in the CalcDebug field of the messages.
+func (p *Calculate) SetDebug(debug bool) {
+	p.debug = debug
+}
+
+// SetApplyCorrections controls whether co-location corrections are
+// applied to the calculated values.  They are applied by default.
+func (p *Calculate) SetApplyCorrections(apply bool) {
+	p.applyCorrections = apply
 }
 
 // Publish ...
-func (p *Calculate) Publish(m *model.Message) error {
-	cal := p.findCacheEntry(m.SysID, m.ReceivedTime)
+func (p *Calculate) Publish(ctx context.Context, m *model.Message) error {
+	if p.debug && m.CalcDebug == nil {
+		m.CalcDebug = &model.CalcDebug{}
+	}
+
+	cal := p.findCal(m.SysID, m.DeviceID, m.CollectionID, m.ReceivedTime)
+
+	// Without calibration data any values we calculate are garbage,
+	// so we mark the message and pass it on without them.
+	m.Uncalibrated = cal == nil
+	if cal == nil {
+		uncalibrated(m)
+		return p.publishNext(ctx, m)
+	}
 
 	// This is a workaround for when we use MIC and we do not get
-	// access to the underlying DeviceID. We use the deviceID from the
-	// calibration data to populate the DeviceID field.
+	// access to the underlying DeviceID.  We use the device board
+	// registry, or the deviceID from the calibration data if the
+	// board is not in the registry, to populate the DeviceID field.
+	if m.DeviceID == "" {
+		m.DeviceID = p.deviceForBoard(cal.SysID, m.ReceivedTime)
+	}
 	if m.DeviceID == "" {
 		m.DeviceID = cal.DeviceID
 	}
 
-	model.CalculateSensorValues(m, cal)
+	err := model.Calculate(m, cal)
+	if err != nil {
+		log.Printf("Error calculating values for device='%s': %v", m.DeviceID, err)
+		uncalibrated(m)
+		return p.publishNext(ctx, m)
+	}
+
+	if p.applyCorrections {
+		model.ApplyCorrections(m,
+			p.findCorrection(m.DeviceID, model.ComponentNO2, m.ReceivedTime),
+			p.findCorrection(m.DeviceID, model.ComponentO3, m.ReceivedTime),
+			p.findCorrection(m.DeviceID, model.ComponentNO, m.ReceivedTime))
+	}
+
+	return p.publishNext(ctx, m)
+}
+
+// uncalibrated marks a message we could not calculate values for and
+// clears any values it carries.
+func uncalibrated(m *model.Message) {
+	m.Uncalibrated = true
+	m.NO2PPB = 0
+	m.O3PPB = 0
+	m.NOPPB = 0
+}
 
+func (p *Calculate) publishNext(ctx context.Context, m *model.Message) error {
 	if p.next != nil {
-		return p.next.Publish(m)
+		return p.next.Publish(ctx, m)
 	}
 	return nil
 }
@@ -1,6 +1,7 @@
 package calculate
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -18,21 +19,142 @@ func TestFindCacheEntry(t *testing.T) {
 	c := &Calculate{}
 	c.populateCache(cals)
 
-	assert.Equal(t, int64(1), c.findCacheEntry(1, ms(time.Date(2000, 2, 30, 0, 0, 0, 0, time.UTC))).ID)
-	assert.Equal(t, int64(2), c.findCacheEntry(1, ms(time.Date(2001, 2, 30, 0, 0, 0, 0, time.UTC))).ID)
-	assert.Equal(t, int64(3), c.findCacheEntry(1, ms(time.Date(2003, 1, 1, 0, 0, 0, 0, time.UTC))).ID)
+	assert.Equal(t, int64(1), c.findCacheEntry(1, "", ms(time.Date(2000, 2, 30, 0, 0, 0, 0, time.UTC))).ID)
+	assert.Equal(t, int64(2), c.findCacheEntry(1, "", ms(time.Date(2001, 2, 30, 0, 0, 0, 0, time.UTC))).ID)
+	assert.Equal(t, int64(3), c.findCacheEntry(1, "", ms(time.Date(2003, 1, 1, 0, 0, 0, 0, time.UTC))).ID)
 
-	// We want the oldest entry if the data precedes calibration data.
-	// This is defined behavior but not necessarily smart behavior.
-	assert.Equal(t, int64(1), c.findCacheEntry(1, ms(time.Date(1999, 2, 30, 0, 0, 0, 0, time.UTC))).ID)
+	// Data that precedes calibration data has no calibration
+	assert.Nil(t, c.findCacheEntry(1, "", ms(time.Date(1999, 2, 30, 0, 0, 0, 0, time.UTC))))
 
 	// Check for exact coincidence
-	assert.Equal(t, int64(1), c.findCacheEntry(1, ms(time.Date(2000, 1, 30, 0, 0, 0, 0, time.UTC))).ID)
-	assert.Equal(t, int64(2), c.findCacheEntry(1, ms(time.Date(2001, 1, 30, 0, 0, 0, 0, time.UTC))).ID)
-	assert.Equal(t, int64(3), c.findCacheEntry(1, ms(time.Date(2003, 1, 30, 0, 0, 0, 0, time.UTC))).ID)
+	assert.Equal(t, int64(1), c.findCacheEntry(1, "", ms(time.Date(2000, 1, 30, 0, 0, 0, 0, time.UTC))).ID)
+	assert.Equal(t, int64(2), c.findCacheEntry(1, "", ms(time.Date(2001, 1, 30, 0, 0, 0, 0, time.UTC))).ID)
+	assert.Equal(t, int64(3), c.findCacheEntry(1, "", ms(time.Date(2003, 1, 30, 0, 0, 0, 0, time.UTC))).ID)
 }
 
 // Convert time.Time to milliseconds since epoch
 func ms(t time.Time) int64 {
 	return t.UnixNano() / int64(time.Millisecond)
 }
+
+func TestFindCacheEntryByCollection(t *testing.T) {
+	c := &Calculate{}
+	c.populateCache([]model.Cal{
+		{DeviceID: "foo", SysID: 1, ID: 3, CollectionID: "pilot", ValidFrom: time.Date(2002, 1, 30, 0, 0, 0, 0, time.UTC)},
+		{DeviceID: "foo", SysID: 1, ID: 2, CollectionID: "production", ValidFrom: time.Date(2001, 1, 30, 0, 0, 0, 0, time.UTC)},
+		{DeviceID: "foo", SysID: 1, ID: 1, ValidFrom: time.Date(2000, 1, 30, 0, 0, 0, 0, time.UTC)},
+	})
+
+	when := ms(time.Date(2003, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, int64(3), c.findCacheEntry(1, "", when).ID)
+	assert.Equal(t, int64(3), c.findCacheEntry(1, "pilot", when).ID)
+	assert.Equal(t, int64(2), c.findCacheEntry(1, "production", when).ID)
+
+	// Entries without collection ID match any collection
+	assert.Equal(t, int64(1), c.findCacheEntry(1, "other", when).ID)
+}
+
+func TestFindCorrection(t *testing.T) {
+	c := &Calculate{}
+	c.populateCorrections([]model.Correction{
+		{ID: 1, DeviceID: "foo", Component: model.ComponentNO2, ValidFrom: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: 2, DeviceID: "foo", Component: model.ComponentNO2, ValidFrom: time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{ID: 3, DeviceID: "foo", Component: model.ComponentO3, ValidFrom: time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)},
+	})
+
+	assert.Nil(t, c.findCorrection("foo", model.ComponentNO2, ms(time.Date(2000, 6, 1, 0, 0, 0, 0, time.UTC))))
+	assert.Equal(t, int64(1), c.findCorrection("foo", model.ComponentNO2, ms(time.Date(2001, 6, 1, 0, 0, 0, 0, time.UTC))).ID)
+	assert.Equal(t, int64(2), c.findCorrection("foo", model.ComponentNO2, ms(time.Date(2003, 6, 1, 0, 0, 0, 0, time.UTC))).ID)
+	assert.Equal(t, int64(3), c.findCorrection("foo", model.ComponentO3, ms(time.Date(2003, 6, 1, 0, 0, 0, 0, time.UTC))).ID)
+	assert.Nil(t, c.findCorrection("foo", model.ComponentNO, ms(time.Date(2003, 6, 1, 0, 0, 0, 0, time.UTC))))
+	assert.Nil(t, c.findCorrection("bar", model.ComponentNO2, ms(time.Date(2003, 6, 1, 0, 0, 0, 0, time.UTC))))
+}
+
+func TestFindCacheEntryValidTo(t *testing.T) {
+	end := time.Date(2001, 1, 30, 0, 0, 0, 0, time.UTC)
+
+	c := &Calculate{}
+	c.populateCache([]model.Cal{
+		{DeviceID: "foo", SysID: 1, ID: 2, ValidFrom: time.Date(2002, 1, 30, 0, 0, 0, 0, time.UTC)},
+		{DeviceID: "foo", SysID: 1, ID: 1, ValidFrom: time.Date(2000, 1, 30, 0, 0, 0, 0, time.UTC), ValidTo: &end},
+	})
+
+	assert.Equal(t, int64(1), c.findCacheEntry(1, "", ms(time.Date(2000, 6, 1, 0, 0, 0, 0, time.UTC))).ID)
+
+	// ValidTo is exclusive and there is a gap until the next entry
+	assert.Nil(t, c.findCacheEntry(1, "", ms(end)))
+	assert.Nil(t, c.findCacheEntry(1, "", ms(time.Date(2001, 6, 1, 0, 0, 0, 0, time.UTC))))
+	assert.Equal(t, int64(2), c.findCacheEntry(1, "", ms(time.Date(2003, 1, 1, 0, 0, 0, 0, time.UTC))).ID)
+
+	// No calibration data for the device at all
+	assert.Nil(t, c.findCacheEntry(2, "", ms(time.Date(2003, 1, 1, 0, 0, 0, 0, time.UTC))))
+}
+
+func TestPublishUncalibrated(t *testing.T) {
+	c := &Calculate{}
+	c.populateCache(cals)
+
+	m := &model.Message{SysID: 1, ReceivedTime: ms(time.Date(1999, 1, 1, 0, 0, 0, 0, time.UTC)), NO2PPB: 12.3}
+	assert.Nil(t, c.Publish(context.Background(), m))
+	assert.True(t, m.Uncalibrated)
+	assert.Equal(t, 0.0, m.NO2PPB)
+
+	m.ReceivedTime = ms(time.Date(2003, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Nil(t, c.Publish(context.Background(), m))
+	assert.False(t, m.Uncalibrated)
+
+	// Calculation errors leave the message uncalibrated
+	c = &Calculate{}
+	c.populateCache([]model.Cal{{SysID: 1, BoardType: "no-such-board", ValidFrom: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}})
+	m = &model.Message{SysID: 1, ReceivedTime: ms(time.Date(2003, 1, 1, 0, 0, 0, 0, time.UTC)), NO2PPB: 12.3, O3PPB: 4.5, NOPPB: 6.7}
+	assert.NotNil(t, c.findCal(m.SysID, m.DeviceID, m.CollectionID, m.ReceivedTime))
+	assert.Nil(t, c.Publish(context.Background(), m))
+	assert.True(t, m.Uncalibrated)
+	assert.Equal(t, 0.0, m.NO2PPB)
+	assert.Equal(t, 0.0, m.O3PPB)
+	assert.Equal(t, 0.0, m.NOPPB)
+}
+
+func TestFindCalByDevice(t *testing.T) {
+	moved := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	c := &Calculate{}
+	c.populateCache([]model.Cal{
+		{DeviceID: "foo", SysID: 1, ID: 1, ValidFrom: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{DeviceID: "bar", SysID: 2, ID: 2, ValidFrom: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)},
+	})
+
+	// Board 1 was moved from foo to bar, replacing board 2
+	c.populateBoards([]model.DeviceBoard{
+		{DeviceID: "foo", SysID: 1, ValidFrom: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), ValidTo: &moved},
+		{DeviceID: "bar", SysID: 2, ValidFrom: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), ValidTo: &moved},
+		{DeviceID: "bar", SysID: 1, ValidFrom: moved},
+	})
+	c.lastCacheUpdate = time.Now()
+
+	before := ms(time.Date(2000, 6, 1, 0, 0, 0, 0, time.UTC))
+	after := ms(time.Date(2001, 6, 1, 0, 0, 0, 0, time.UTC))
+
+	// The calibration data follows the board
+	assert.Equal(t, int64(1), c.findCal(1, "bar", "", after).ID)
+
+	// Without sysID the board is looked up in the registry
+	assert.Equal(t, int64(2), c.findCal(0, "bar", "", before).ID)
+	assert.Equal(t, int64(1), c.findCal(0, "bar", "", after).ID)
+	assert.Equal(t, int64(1), c.findCal(0, "foo", "", before).ID)
+	assert.Nil(t, c.findCal(0, "foo", "", after))
+
+	// A sysID without calibration data falls back to the registry
+	assert.Equal(t, int64(1), c.findCal(3, "bar", "", after).ID)
+	assert.Equal(t, int64(2), c.findCal(3, "bar", "", before).ID)
+	assert.Nil(t, c.findCal(3, "baz", "", after))
+
+	// Without device ID the device is looked up in the registry
+	m := &model.Message{SysID: 1, ReceivedTime: after}
+	assert.Nil(t, c.Publish(context.Background(), m))
+	assert.Equal(t, "bar", m.DeviceID)
+
+	m = &model.Message{SysID: 1, ReceivedTime: before}
+	assert.Nil(t, c.Publish(context.Background(), m))
+	assert.Equal(t, "foo", m.DeviceID)
+}
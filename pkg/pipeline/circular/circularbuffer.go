@@ -3,6 +3,7 @@ package circular
 
 import (
 	"container/ring"
+	"context"
 	"sync"
 
 	"github.com/lab5e/aqserver/pkg/model"
@@ -24,7 +25,7 @@ func New(size int) *Buffer {
 }
 
 // Publish adds a message to the ring buffer
-func (c *Buffer) Publish(m *model.Message) error {
+func (c *Buffer) Publish(ctx context.Context, m *model.Message) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -32,7 +33,7 @@ func (c *Buffer) Publish(m *model.Message) error {
 	c.ring = c.ring.Next()
 
 	if c.next != nil {
-		return c.next.Publish(m)
+		return c.next.Publish(ctx, m)
 	}
 	return nil
 }
@@ -0,0 +1,46 @@
+// Package convert implements the pipeline step that converts gas
+// concentrations from ppb to µg/m3.
+package convert
+
+import (
+	"context"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+)
+
+// Convert is a pipeline processor that fills in the µg/m3 values of
+// messages.
+type Convert struct {
+	next   pipeline.Pipeline
+	config model.ConversionConfig
+}
+
+// New creates a new instance of Convert pipeline element
+func New(config model.ConversionConfig) (*Convert, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &Convert{config: config}, nil
+}
+
+// Publish ...
+func (p *Convert) Publish(ctx context.Context, m *model.Message) error {
+	model.ConvertUnits(m, p.config)
+
+	if p.next != nil {
+		return p.next.Publish(ctx, m)
+	}
+	return nil
+}
+
+// AddNext ...
+func (p *Convert) AddNext(pe pipeline.Pipeline) {
+	p.next = pe
+}
+
+// Next ...
+func (p *Convert) Next() pipeline.Pipeline {
+	return p.next
+}
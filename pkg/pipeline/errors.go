@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"errors"
+)
+
+// Error is an error from a pipeline stage.  Stages return retryable
+// errors for failures that may go away by themselves, like a database
+// or a broker being unavailable, and permanent errors for messages
+// that will never make it through, like a message that cannot be
+// encoded.  Errors that are not an Error are treated as permanent.
+type Error struct {
+	Stage     string // The stage that failed
+	Err       error
+	Retryable bool
+}
+
+// Error ...
+func (e *Error) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+// Unwrap ...
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Retryable returns a retryable error from a stage.
+func Retryable(stage string, err error) error {
+	return &Error{Stage: stage, Err: err, Retryable: true}
+}
+
+// Permanent returns a permanent error from a stage.
+func Permanent(stage string, err error) error {
+	return &Error{Stage: stage, Err: err}
+}
+
+// IsRetryable returns true if err is, or wraps, a retryable Error.
+func IsRetryable(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Retryable
+}
@@ -0,0 +1,18 @@
+package pipeline
+
+import (
+	"context"
+)
+
+// Lifecycle is implemented by pipeline elements that run goroutines or
+// hold on to messages.  Start is called before messages are published
+// and Stop after the last message has been published.  Stop passes on
+// or flushes what the element holds, and gives up when ctx is done.
+//
+// Elements are started from the end of the pipeline and stopped from
+// the start, so that the elements after a stopping element are still
+// running while it drains.
+type Lifecycle interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
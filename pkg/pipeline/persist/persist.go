@@ -2,7 +2,9 @@
 package persist
 
 import (
-	"log"
+	"context"
+	"errors"
+	"sync/atomic"
 
 	"github.com/lab5e/aqserver/pkg/model"
 	"github.com/lab5e/aqserver/pkg/pipeline"
@@ -11,8 +13,9 @@ import (
 
 // Persist is a pipeline processor that persists incoming messages
 type Persist struct {
-	db   store.Store
-	next pipeline.Pipeline
+	db         store.Store
+	next       pipeline.Pipeline
+	duplicates int64
 }
 
 // New creates new Persist pipeline element
@@ -22,22 +25,37 @@ func New(db store.Store) *Persist {
 	}
 }
 
-// Publish ...
-func (p *Persist) Publish(m *model.Message) error {
+// Publish stores the message.  If the message cannot be stored it is
+// not passed on, so that a retry further up the pipeline does not
+// pass it on twice.
+func (p *Persist) Publish(ctx context.Context, m *model.Message) error {
 	id, err := p.db.PutMessage(m)
+	if errors.Is(err, store.ErrMessageExists) {
+		// We have seen this message before so there is no point in
+		// passing it on.
+		atomic.AddInt64(&p.duplicates, 1)
+		return nil
+	}
+
 	if err != nil {
-		log.Printf("Error logging message: %v", err)
-	} else {
-		// Populate with storage ID
-		m.ID = id
+		return pipeline.Retryable("persist", err)
 	}
 
+	// Populate with storage ID
+	m.ID = id
+
 	if p.next != nil {
-		return p.next.Publish(m)
+		return p.next.Publish(ctx, m)
 	}
 	return nil
 }
 
+// Duplicates returns the number of messages that were skipped
+// because they had already been stored.
+func (p *Persist) Duplicates() int64 {
+	return atomic.LoadInt64(&p.duplicates)
+}
+
 // AddNext ...
 func (p *Persist) AddNext(pe pipeline.Pipeline) {
 	p.next = pe
@@ -2,12 +2,14 @@
 package pipeline
 
 import (
+	"context"
+
 	"github.com/lab5e/aqserver/pkg/model"
 )
 
 // Pipeline defines the interface of processing pipeline elements.
 type Pipeline interface {
-	Publish(m *model.Message) error
+	Publish(ctx context.Context, m *model.Message) error
 	AddNext(pe Pipeline)
 	Next() Pipeline
 }
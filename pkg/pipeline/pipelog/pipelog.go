@@ -2,6 +2,7 @@
 package pipelog
 
 import (
+	"context"
 	"log"
 
 	"github.com/lab5e/aqserver/pkg/model"
@@ -19,11 +20,11 @@ func New() *Log {
 }
 
 // Publish ...
-func (p *Log) Publish(m *model.Message) error {
+func (p *Log) Publish(ctx context.Context, m *model.Message) error {
 	log.Printf("Message: device='%s' id=%d spanMessageID=%s packetSize=%d", m.DeviceID, m.ID, m.MessageID, m.PacketSize)
 
 	if p.next != nil {
-		return p.next.Publish(m)
+		return p.next.Publish(ctx, m)
 	}
 	return nil
 }
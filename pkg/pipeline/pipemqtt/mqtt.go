@@ -4,7 +4,9 @@
 package pipemqtt
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -14,6 +16,10 @@ import (
 	"github.com/lab5e/aqserver/pkg/pipeline"
 )
 
+// publishTimeout is how long to wait for the broker to accept a message
+// before giving up on it.
+const publishTimeout = 5 * time.Second
+
 // MQTTStream ...
 type MQTTStream struct {
 	client      mqtt.Client
@@ -50,26 +56,39 @@ func createCLientOptions(clientID string, password string, address string) *mqtt
 }
 
 // Publish ...
-func (p *MQTTStream) Publish(m *model.Message) error {
+func (p *MQTTStream) Publish(ctx context.Context, m *model.Message) error {
 	json, err := json.Marshal(m)
-	if err == nil {
-		topic := fmt.Sprintf("%s/%s", p.topicPrefix, m.DeviceID)
-		token := p.client.Publish(topic, 0, false, json)
-		if token.Error() != nil {
-			log.Printf("Error publishing to MQTT: %v", token.Error())
-		}
-
-		if !token.WaitTimeout(10 * time.Millisecond) {
-			log.Printf("MQTT publish timed out")
-		}
+	if err != nil {
+		return pipeline.Permanent("mqtt", err)
+	}
+
+	topic := fmt.Sprintf("%s/%s", p.topicPrefix, m.DeviceID)
+	token := p.client.Publish(topic, 0, false, json)
+	if !token.WaitTimeout(publishTimeout) {
+		return pipeline.Retryable("mqtt", errors.New("publish timed out"))
+	}
+	if token.Error() != nil {
+		return pipeline.Retryable("mqtt", token.Error())
 	}
 
 	if p.next != nil {
-		return p.next.Publish(m)
+		return p.next.Publish(ctx, m)
 	}
 	return nil
 }
 
+// Start ...
+func (p *MQTTStream) Start(ctx context.Context) error {
+	return nil
+}
+
+// Stop disconnects from the MQTT broker, waiting a little for
+// messages being sent.
+func (p *MQTTStream) Stop(ctx context.Context) error {
+	p.client.Disconnect(250)
+	return nil
+}
+
 // AddNext ...
 func (p *MQTTStream) AddNext(pe pipeline.Pipeline) {
 	p.next = pe
@@ -0,0 +1,46 @@
+// Package pmcalc implements the pipeline step that computes humidity
+// corrected PM values from the OPC-N3 bin histogram.
+package pmcalc
+
+import (
+	"context"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+)
+
+// PMCalc is a pipeline processor that computes PM mass concentrations
+// from the OPC bin counts.
+type PMCalc struct {
+	next   pipeline.Pipeline
+	config model.PMConfig
+}
+
+// New creates a new instance of PMCalc pipeline element
+func New(config model.PMConfig) (*PMCalc, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &PMCalc{config: config}, nil
+}
+
+// Publish ...
+func (p *PMCalc) Publish(ctx context.Context, m *model.Message) error {
+	model.CalculatePM(m, p.config)
+
+	if p.next != nil {
+		return p.next.Publish(ctx, m)
+	}
+	return nil
+}
+
+// AddNext ...
+func (p *PMCalc) AddNext(pe pipeline.Pipeline) {
+	p.next = pe
+}
+
+// Next ...
+func (p *PMCalc) Next() pipeline.Pipeline {
+	return p.next
+}
@@ -0,0 +1,94 @@
+// Package registry implements the pipeline step that keeps track of
+// which AFE board is installed in which device.
+package registry
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/store"
+)
+
+// Registry is a pipeline processor that records the device board
+// pairings seen in incoming messages in the device board registry.
+type Registry struct {
+	next   pipeline.Pipeline
+	db     store.Store
+	mu     sync.Mutex
+	boards []model.DeviceBoard
+}
+
+// New creates a new instance of the Registry pipeline element
+func New(db store.Store) (*Registry, error) {
+	boards, err := db.ListDeviceBoards()
+	if err != nil {
+		return nil, err
+	}
+	return &Registry{db: db, boards: boards}, nil
+}
+
+// Record records that the board sysID was seen in deviceID at time t.
+// It returns true if the registry changed.
+func (p *Registry) Record(deviceID string, sysID uint64, t time.Time) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	updated, added := model.DeviceBoardChanges(p.boards, deviceID, sysID, t)
+
+	for _, b := range updated {
+		err := p.db.UpdateDeviceBoard(&b)
+		if err != nil {
+			return false, err
+		}
+
+		for i := range p.boards {
+			if p.boards[i].ID == b.ID {
+				p.boards[i] = b
+			}
+		}
+	}
+
+	if added != nil {
+		id, err := p.db.PutDeviceBoard(added)
+		if err != nil {
+			return false, err
+		}
+		added.ID = id
+		p.boards = append(p.boards, *added)
+
+		log.Printf("Board '%d' installed in device='%s' from %s", sysID, deviceID, t.Format(time.RFC3339))
+	}
+
+	return len(updated) > 0 || added != nil, nil
+}
+
+// Publish ...
+func (p *Registry) Publish(ctx context.Context, m *model.Message) error {
+	// Messages that arrive without the device ID, like when using
+	// MIC, cannot tell us where the board is.
+	if m.DeviceID != "" && m.SysID != 0 {
+		_, err := p.Record(m.DeviceID, m.SysID, time.UnixMilli(m.ReceivedTime))
+		if err != nil {
+			log.Printf("Error updating device board registry for device='%s': %v", m.DeviceID, err)
+		}
+	}
+
+	if p.next != nil {
+		return p.next.Publish(ctx, m)
+	}
+	return nil
+}
+
+// AddNext ...
+func (p *Registry) AddNext(pe pipeline.Pipeline) {
+	p.next = pe
+}
+
+// Next ...
+func (p *Registry) Next() pipeline.Pipeline {
+	return p.next
+}
@@ -0,0 +1,168 @@
+// Package retry implements a pipeline step that retries the stages
+// after it when they fail with a retryable error, and keeps the
+// messages that do not make it through as dead letters.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+)
+
+// Defaults for Config.
+const (
+	DefaultMaxAttempts    = 5
+	DefaultInitialBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff     = 10 * time.Second
+)
+
+// DeadLetterStore keeps messages that could not be processed.
+type DeadLetterStore interface {
+	PutDeadLetter(d *model.DeadLetter) (int64, error)
+}
+
+// Config is the configuration of a Retry stage.
+type Config struct {
+	Name           string          // Name of the stage, recorded in dead letters so they can be replayed
+	MaxAttempts    int             // Number of attempts before giving up, including the first
+	InitialBackoff time.Duration   // Wait before the first retry, doubled for each retry
+	MaxBackoff     time.Duration   // Upper limit for the wait between retries
+	DeadLetters    DeadLetterStore // Where to keep failed messages, if nil the error is returned
+}
+
+// Retry is a pipeline processor that passes messages on to the next
+// stage and tries again with exponential backoff if the next stage
+// returns a retryable error.  When the error is permanent, we run out
+// of attempts or the context is done while waiting to try again, the
+// message is stored as a dead letter.
+//
+// Since the whole rest of the pipeline is retried, the stages after a
+// Retry should not pass a message on if they fail.
+type Retry struct {
+	cfg   Config
+	next  pipeline.Pipeline
+	sleep func(ctx context.Context, d time.Duration) error
+
+	retries      int64
+	deadLettered int64
+}
+
+// New creates a new instance of the Retry pipeline element.  Zero
+// values in cfg are replaced by the defaults.
+func New(cfg Config) (*Retry, error) {
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = DefaultMaxAttempts
+	}
+	if cfg.InitialBackoff == 0 {
+		cfg.InitialBackoff = DefaultInitialBackoff
+	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = DefaultMaxBackoff
+	}
+
+	if cfg.MaxAttempts < 1 {
+		return nil, errors.New("max attempts must be positive")
+	}
+	if cfg.InitialBackoff < 0 || cfg.MaxBackoff < cfg.InitialBackoff {
+		return nil, errors.New("backoff must be positive and max backoff at least the initial backoff")
+	}
+
+	return &Retry{
+		cfg:   cfg,
+		sleep: sleep,
+	}, nil
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish ...
+func (p *Retry) Publish(ctx context.Context, m *model.Message) error {
+	if p.next == nil {
+		return nil
+	}
+
+	backoff := p.cfg.InitialBackoff
+	attempt := 1
+	for {
+		err := p.next.Publish(ctx, m)
+		if err == nil {
+			return nil
+		}
+
+		if !pipeline.IsRetryable(err) || attempt >= p.cfg.MaxAttempts {
+			return p.deadLetter(m, err, attempt)
+		}
+
+		// If we are shutting down we keep the message rather than
+		// waiting for the next attempt.
+		atomic.AddInt64(&p.retries, 1)
+		if p.sleep(ctx, backoff) != nil {
+			return p.deadLetter(m, err, attempt)
+		}
+
+		attempt++
+		backoff *= 2
+		if backoff > p.cfg.MaxBackoff {
+			backoff = p.cfg.MaxBackoff
+		}
+	}
+}
+
+// deadLetter stores a message we have given up on.  If it cannot be
+// stored the error is returned so that it is at least reported.
+func (p *Retry) deadLetter(m *model.Message, reason error, attempts int) error {
+	if p.cfg.DeadLetters == nil {
+		return reason
+	}
+
+	d, err := model.NewDeadLetter(p.cfg.Name, m, reason, attempts)
+	if err != nil {
+		return fmt.Errorf("unable to create dead letter: %v (after %v)", err, reason)
+	}
+
+	_, err = p.cfg.DeadLetters.PutDeadLetter(d)
+	if err != nil {
+		return fmt.Errorf("unable to store dead letter: %v (after %v)", err, reason)
+	}
+
+	atomic.AddInt64(&p.deadLettered, 1)
+	log.Printf("Gave up on message from device='%s' after %d attempts, stored as dead letter: %v", m.DeviceID, attempts, reason)
+	return nil
+}
+
+// Retries returns the number of retries so far.
+func (p *Retry) Retries() int64 {
+	return atomic.LoadInt64(&p.retries)
+}
+
+// DeadLettered returns the number of messages stored as dead letters.
+func (p *Retry) DeadLettered() int64 {
+	return atomic.LoadInt64(&p.deadLettered)
+}
+
+// AddNext ...
+func (p *Retry) AddNext(pe pipeline.Pipeline) {
+	p.next = pe
+}
+
+// Next ...
+func (p *Retry) Next() pipeline.Pipeline {
+	return p.next
+}
@@ -0,0 +1,143 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+// failing is a pipeline element that returns the errors in errs, one
+// per call, and then succeeds.
+type failing struct {
+	errs  []error
+	calls int
+}
+
+func (f *failing) Publish(ctx context.Context, m *model.Message) error {
+	f.calls++
+	if len(f.errs) == 0 {
+		return nil
+	}
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+	return err
+}
+
+func (f *failing) AddNext(pipeline.Pipeline) {}
+
+func (f *failing) Next() pipeline.Pipeline { return nil }
+
+type deadLetters struct {
+	letters []*model.DeadLetter
+	err     error
+}
+
+func (d *deadLetters) PutDeadLetter(l *model.DeadLetter) (int64, error) {
+	if d.err != nil {
+		return -1, d.err
+	}
+	d.letters = append(d.letters, l)
+	return int64(len(d.letters)), nil
+}
+
+var ctx = context.Background()
+
+func newRetry(t *testing.T, store DeadLetterStore, next pipeline.Pipeline) (*Retry, *[]time.Duration) {
+	p, err := New(Config{
+		Name:           "retry",
+		MaxAttempts:    4,
+		InitialBackoff: time.Second,
+		MaxBackoff:     3 * time.Second,
+		DeadLetters:    store,
+	})
+	assert.Nil(t, err)
+	p.AddNext(next)
+
+	var waits []time.Duration
+	p.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	return p, &waits
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := pipeline.Retryable("persist", errors.New("database is locked"))
+
+	// Succeeds on the third attempt
+	store := &deadLetters{}
+	next := &failing{errs: []error{unavailable, unavailable}}
+	p, waits := newRetry(t, store, next)
+	assert.Nil(t, p.Publish(ctx, &model.Message{}))
+	assert.Equal(t, 3, next.calls)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, *waits)
+	assert.Equal(t, int64(2), p.Retries())
+	assert.Empty(t, store.letters)
+
+	// Gives up after four attempts, backoff is capped
+	next = &failing{errs: []error{unavailable, unavailable, unavailable, unavailable}}
+	p, waits = newRetry(t, store, next)
+	assert.Nil(t, p.Publish(ctx, &model.Message{DeviceID: "d1"}))
+	assert.Equal(t, 4, next.calls)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, *waits)
+	assert.Equal(t, 1, len(store.letters))
+	assert.Equal(t, "retry", store.letters[0].Stage)
+	assert.Equal(t, "d1", store.letters[0].DeviceID)
+	assert.Equal(t, 4, store.letters[0].Attempts)
+	assert.Equal(t, "persist: database is locked", store.letters[0].Reason)
+	assert.Equal(t, int64(1), p.DeadLettered())
+}
+
+func TestRetryCancelled(t *testing.T) {
+	unavailable := pipeline.Retryable("persist", errors.New("database is locked"))
+
+	store := &deadLetters{}
+	next := &failing{errs: []error{unavailable, unavailable}}
+	p, _ := newRetry(t, store, next)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Nil(t, p.Publish(cancelled, &model.Message{}))
+	assert.Equal(t, 1, next.calls)
+	assert.Equal(t, 1, len(store.letters))
+}
+
+func TestRetryPermanent(t *testing.T) {
+	invalid := pipeline.Permanent("mqtt", errors.New("unable to encode"))
+	untyped := errors.New("something else")
+
+	for _, err := range []error{invalid, untyped} {
+		store := &deadLetters{}
+		next := &failing{errs: []error{err}}
+		p, waits := newRetry(t, store, next)
+		assert.Nil(t, p.Publish(ctx, &model.Message{}))
+		assert.Equal(t, 1, next.calls)
+		assert.Empty(t, *waits)
+		assert.Equal(t, 1, len(store.letters))
+	}
+}
+
+func TestRetryNoDeadLetters(t *testing.T) {
+	invalid := pipeline.Permanent("mqtt", errors.New("unable to encode"))
+
+	p, _ := newRetry(t, nil, &failing{errs: []error{invalid}})
+	assert.Equal(t, invalid, p.Publish(ctx, &model.Message{}))
+
+	p, _ = newRetry(t, &deadLetters{err: errors.New("disk full")}, &failing{errs: []error{invalid}})
+	assert.NotNil(t, p.Publish(ctx, &model.Message{}))
+}
+
+func TestErrors(t *testing.T) {
+	err := pipeline.Retryable("persist", errors.New("database is locked"))
+	assert.True(t, pipeline.IsRetryable(err))
+	assert.True(t, pipeline.IsRetryable(fmt.Errorf("wrapped: %w", err)))
+	assert.False(t, pipeline.IsRetryable(pipeline.Permanent("persist", errors.New("invalid"))))
+	assert.False(t, pipeline.IsRetryable(errors.New("untyped")))
+	assert.False(t, pipeline.IsRetryable(nil))
+}
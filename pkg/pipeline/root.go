@@ -1,6 +1,7 @@
 package pipeline
 
 import (
+	"context"
 	"errors"
 
 	"github.com/lab5e/aqserver/pkg/model"
@@ -25,9 +26,9 @@ func New(db store.Store) *Root {
 }
 
 // Publish ...
-func (p *Root) Publish(m *model.Message) error {
+func (p *Root) Publish(ctx context.Context, m *model.Message) error {
 	if p.next != nil {
-		return p.next.Publish(m)
+		return p.next.Publish(ctx, m)
 	}
 	return nil
 }
@@ -0,0 +1,98 @@
+// Package router implements a pipeline step that routes messages to
+// different pipeline branches based on where they came from.
+package router
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+)
+
+// Match selects messages by device and collection.  Empty lists match
+// anything, so a Match with no lists matches all messages.
+type Match struct {
+	DeviceIDs     []string
+	CollectionIDs []string
+}
+
+// Matches returns true if m is selected.
+func (c Match) Matches(m *model.Message) bool {
+	return matchesAny(c.DeviceIDs, m.DeviceID) && matchesAny(c.CollectionIDs, m.CollectionID)
+}
+
+func matchesAny(values []string, v string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+type route struct {
+	match Match
+	next  pipeline.Pipeline
+}
+
+// Router is a pipeline processor that passes each message on to the
+// first route that matches it.  Messages that match no route go to
+// the default next element, or are dropped if there is none.
+type Router struct {
+	mu     sync.RWMutex
+	routes []route
+	next   pipeline.Pipeline
+}
+
+// New creates a new instance of the Router pipeline element
+func New() *Router {
+	return &Router{}
+}
+
+// AddRoute adds a route.  Routes are tried in the order they were
+// added.
+func (p *Router) AddRoute(match Match, pe pipeline.Pipeline) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.routes = append(p.routes, route{match: match, next: pe})
+}
+
+// Publish ...
+func (p *Router) Publish(ctx context.Context, m *model.Message) error {
+	p.mu.RLock()
+	next := p.next
+	for _, r := range p.routes {
+		if r.match.Matches(m) {
+			next = r.next
+			break
+		}
+	}
+	p.mu.RUnlock()
+
+	if next != nil {
+		return next.Publish(ctx, m)
+	}
+	return nil
+}
+
+// AddNext sets the default next element, which gets the messages
+// that match no route.
+func (p *Router) AddNext(pe pipeline.Pipeline) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.next = pe
+}
+
+// Next returns the default next element.
+func (p *Router) Next() pipeline.Pipeline {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.next
+}
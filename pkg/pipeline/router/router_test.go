@@ -0,0 +1,86 @@
+package router
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+// sink is a pipeline element that keeps the messages it gets.
+type sink struct {
+	msgs []*model.Message
+}
+
+func (s *sink) Publish(ctx context.Context, m *model.Message) error {
+	s.msgs = append(s.msgs, m)
+	return nil
+}
+
+func (s *sink) AddNext(pipeline.Pipeline) {}
+
+func (s *sink) Next() pipeline.Pipeline { return nil }
+
+func TestMatch(t *testing.T) {
+	m := &model.Message{DeviceID: "d1", CollectionID: "c1"}
+
+	assert.True(t, Match{}.Matches(m))
+	assert.True(t, Match{DeviceIDs: []string{"d2", "d1"}}.Matches(m))
+	assert.True(t, Match{CollectionIDs: []string{"c1"}}.Matches(m))
+	assert.True(t, Match{DeviceIDs: []string{"d1"}, CollectionIDs: []string{"c1"}}.Matches(m))
+	assert.False(t, Match{DeviceIDs: []string{"d2"}}.Matches(m))
+	assert.False(t, Match{CollectionIDs: []string{"c2"}}.Matches(m))
+
+	// Both lists must match
+	assert.False(t, Match{DeviceIDs: []string{"d1"}, CollectionIDs: []string{"c2"}}.Matches(m))
+	assert.False(t, Match{DeviceIDs: []string{"d2"}, CollectionIDs: []string{"c1"}}.Matches(m))
+}
+
+func TestRouter(t *testing.T) {
+	ctx := context.Background()
+
+	byDevice := &sink{}
+	byCollection := &sink{}
+	fallback := &sink{}
+
+	r := New()
+	r.AddRoute(Match{DeviceIDs: []string{"d1"}}, byDevice)
+	r.AddRoute(Match{CollectionIDs: []string{"c1"}}, byCollection)
+	r.AddNext(fallback)
+	assert.Equal(t, fallback, r.Next())
+
+	// d1 in c1 matches both routes, the first one wins
+	assert.Nil(t, r.Publish(ctx, &model.Message{DeviceID: "d1", CollectionID: "c1"}))
+	assert.Nil(t, r.Publish(ctx, &model.Message{DeviceID: "d2", CollectionID: "c1"}))
+	assert.Nil(t, r.Publish(ctx, &model.Message{DeviceID: "d3", CollectionID: "c2"}))
+
+	assert.Equal(t, 1, len(byDevice.msgs))
+	assert.Equal(t, "d1", byDevice.msgs[0].DeviceID)
+	assert.Equal(t, 1, len(byCollection.msgs))
+	assert.Equal(t, "d2", byCollection.msgs[0].DeviceID)
+	assert.Equal(t, 1, len(fallback.msgs))
+	assert.Equal(t, "d3", fallback.msgs[0].DeviceID)
+}
+
+func TestRouterDrop(t *testing.T) {
+	ctx := context.Background()
+
+	fallback := &sink{}
+
+	r := New()
+	r.AddRoute(Match{DeviceIDs: []string{"d1"}}, nil)
+	r.AddNext(fallback)
+
+	// A route without a next element drops the message rather than
+	// trying the later routes or the default
+	assert.Nil(t, r.Publish(ctx, &model.Message{DeviceID: "d1"}))
+	assert.Empty(t, fallback.msgs)
+
+	// Without a default unmatched messages are dropped
+	r = New()
+	r.AddRoute(Match{DeviceIDs: []string{"d1"}}, fallback)
+	assert.Nil(t, r.Publish(ctx, &model.Message{DeviceID: "d2"}))
+	assert.Empty(t, fallback.msgs)
+}
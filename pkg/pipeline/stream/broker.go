@@ -2,8 +2,10 @@
 package stream
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -21,6 +23,8 @@ type Broker struct {
 	list       chan *listRequest
 	next       pipeline.Pipeline
 	quit       chan bool
+	quitOnce   sync.Once
+	done       chan struct{}
 
 	listBlockedCounter      int64
 	clientDroppedCounter    int64
@@ -41,6 +45,7 @@ func NewBroker() *Broker {
 		unregister: make(chan *client),
 		list:       make(chan *listRequest, 10),
 		quit:       make(chan bool),
+		done:       make(chan struct{}),
 	}
 
 	go b.mainLoop()
@@ -49,6 +54,8 @@ func NewBroker() *Broker {
 }
 
 func (b *Broker) mainLoop() {
+	defer close(b.done)
+
 	for {
 		select {
 		case message := <-b.broadcast:
@@ -87,6 +94,12 @@ func (b *Broker) mainLoop() {
 			close(listRequest.responseChannel)
 
 		case <-b.quit:
+			// Closing the send channels makes the clients close
+			// their connections.
+			for client := range b.clients {
+				delete(b.clients, client)
+				close(client.send)
+			}
 			return
 		}
 	}
@@ -94,16 +107,24 @@ func (b *Broker) mainLoop() {
 
 // AddConnection adds a new connection to the message broker.
 func (b *Broker) AddConnection(conn *websocket.Conn) {
-	b.register <- newClient(conn, b)
+	select {
+	case b.register <- newClient(conn, b):
+	case <-b.quit:
+		conn.Close()
+	}
 }
 
 // ListClients lists clients connected via websocket streamer
-func (b Broker) ListClients() []string {
+func (b *Broker) ListClients() []string {
 	request := &listRequest{
 		responseChannel: make(chan *client),
 	}
 
-	b.list <- request
+	select {
+	case b.list <- request:
+	case <-b.quit:
+		return []string{}
+	}
 
 	clients := []string{}
 
@@ -122,20 +143,44 @@ func (b Broker) ListClients() []string {
 }
 
 // Publish ...
-func (b *Broker) Publish(m *model.Message) error {
+func (b *Broker) Publish(ctx context.Context, m *model.Message) error {
 	jsonData, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
 
-	b.broadcast <- jsonData
+	select {
+	case b.broadcast <- jsonData:
+	case <-b.quit:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 
 	if b.next != nil {
-		return b.next.Publish(m)
+		return b.next.Publish(ctx, m)
 	}
 	return nil
 }
 
+// Start ...
+func (b *Broker) Start(ctx context.Context) error {
+	// The main loop is started by NewBroker since the broker is
+	// used by the API whether or not it is part of the pipeline.
+	return nil
+}
+
+// Stop disconnects the clients and stops the broker.
+func (b *Broker) Stop(ctx context.Context) error {
+	b.quitOnce.Do(func() { close(b.quit) })
+
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // AddNext ...
 func (b *Broker) AddNext(pe pipeline.Pipeline) {
 	b.next = pe
@@ -42,7 +42,10 @@ func newClient(conn *websocket.Conn, broker *Broker) *client {
 
 func (c *client) readLoop() {
 	defer func() {
-		c.broker.unregister <- c
+		select {
+		case c.broker.unregister <- c:
+		case <-c.broker.quit:
+		}
 		c.conn.Close()
 	}()
 
@@ -0,0 +1,284 @@
+// Package tee implements a pipeline step that fans messages out to
+// several branches that run independently of each other.
+package tee
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+)
+
+// DefaultQueueSize is the number of messages each branch can fall
+// behind before messages are dropped for that branch.
+const DefaultQueueSize = 1000
+
+// dropReportInterval limits how often we log about dropped messages.
+const dropReportInterval = 10 * time.Second
+
+// abandonGrace is how long Stop waits for the branches to return after
+// abandoning the messages being published.  Branches stuck in a stage
+// that ignores the context are left behind.
+var abandonGrace = time.Second
+
+// Policy decides what happens to a message for a branch whose queue is
+// full.
+type Policy string
+
+// Branch policies
+const (
+	PolicyDrop  Policy = "drop"  // Drop the message for that branch only
+	PolicyBlock Policy = "block" // Wait for room in the queue, holding up the other branches
+)
+
+// Tee is a pipeline processor that passes a copy of each message to
+// every branch.  Each branch has its own queue and goroutine, so a slow
+// or failing branch does not hold up the others.  If a branch falls
+// too far behind, messages are dropped for that branch only, unless the
+// branch was added with PolicyBlock.
+//
+// The branches run from Start until Stop has drained their queues.
+type Tee struct {
+	// ctx is used when passing messages on.  It is cancelled if Stop
+	// gives up on draining the queues.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// stopping is closed when Stop is called so that publishers
+	// waiting for room in a blocking branch give up.
+	stopping     chan struct{}
+	stoppingOnce sync.Once
+
+	mu        sync.RWMutex
+	started   bool
+	closed    bool
+	queueSize int
+	branches  []*branch
+}
+
+type branch struct {
+	// Accessed atomically, keep first for alignment
+	dropped    int64
+	lastReport int64 // When we last logged about dropped messages, ns since epoch
+
+	next   pipeline.Pipeline
+	policy Policy
+	queue  chan *model.Message
+	done   chan struct{}
+}
+
+// New creates a new instance of the Tee pipeline element.  queueSize
+// is the queue length of each branch.
+func New(queueSize int) *Tee {
+	if queueSize < 1 {
+		queueSize = DefaultQueueSize
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Tee{
+		ctx:       ctx,
+		cancel:    cancel,
+		stopping:  make(chan struct{}),
+		queueSize: queueSize,
+	}
+}
+
+// Start starts the branches.
+func (p *Tee) Start(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.started || p.closed {
+		return nil
+	}
+	p.started = true
+
+	for i, b := range p.branches {
+		go b.run(p.ctx, i)
+	}
+	return nil
+}
+
+// Publish queues a copy of the message for each branch.  If a blocking
+// branch is full, Publish waits for room until ctx is done or the tee
+// is stopped.
+func (p *Tee) Publish(ctx context.Context, m *model.Message) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return nil
+	}
+
+	for i, b := range p.branches {
+		if b.policy == PolicyBlock {
+			select {
+			case b.queue <- m.Copy():
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-p.stopping:
+				return nil
+			}
+			continue
+		}
+
+		select {
+		case b.queue <- m.Copy():
+		default:
+			dropped := atomic.AddInt64(&b.dropped, 1)
+			now := time.Now().UnixNano()
+			last := atomic.LoadInt64(&b.lastReport)
+			if now-last > int64(dropReportInterval) && atomic.CompareAndSwapInt64(&b.lastReport, last, now) {
+				log.Printf("Tee branch %d is falling behind, %d messages dropped so far", i, dropped)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *branch) run(ctx context.Context, index int) {
+	defer close(b.done)
+
+	for m := range b.queue {
+		// Once Stop has given up, the rest of the queue is dropped
+		if ctx.Err() != nil {
+			continue
+		}
+		b.publish(ctx, index, m)
+	}
+}
+
+// publish passes a message on to the branch.  A panic in a branch is
+// logged rather than taking down the other branches.
+func (b *branch) publish(ctx context.Context, index int, m *model.Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Tee branch %d panicked: %v", index, r)
+		}
+	}()
+
+	err := b.next.Publish(ctx, m)
+	if err != nil {
+		log.Printf("Error in tee branch %d: %v", index, err)
+	}
+}
+
+// Dropped returns the number of messages dropped for each branch.
+func (p *Tee) Dropped() []int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	dropped := make([]int64, len(p.branches))
+	for i, b := range p.branches {
+		dropped[i] = atomic.LoadInt64(&b.dropped)
+	}
+	return dropped
+}
+
+// Stop stops accepting messages and waits for the branches to pass on
+// the messages already queued.  If ctx is done first the messages still
+// queued are lost, and Stop waits at most abandonGrace for the branches
+// to return.
+func (p *Tee) Stop(ctx context.Context) error {
+	p.stoppingOnce.Do(func() { close(p.stopping) })
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	started := p.started
+	for _, b := range p.branches {
+		close(b.queue)
+	}
+	p.mu.Unlock()
+
+	defer p.cancel()
+	if !started {
+		return nil
+	}
+
+	for i, b := range p.branches {
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			// Abandon the messages being published and give
+			// the branches a moment to notice.
+			p.cancel()
+			graceCtx, cancelGrace := context.WithTimeout(context.Background(), abandonGrace)
+			defer cancelGrace()
+			for j, b := range p.branches {
+				select {
+				case <-b.done:
+				case <-graceCtx.Done():
+					log.Printf("Tee branch %d is stuck, leaving it behind", j)
+				}
+			}
+			return fmt.Errorf("tee gave up draining branch %d: %v", i, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// AddNext adds a branch with PolicyDrop.
+func (p *Tee) AddNext(pe pipeline.Pipeline) {
+	p.AddBranch(pe, PolicyDrop)
+}
+
+// AddBranch adds a branch with the given policy for when its queue is
+// full.
+func (p *Tee) AddBranch(pe pipeline.Pipeline, policy Policy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	b := &branch{
+		next:   pe,
+		policy: policy,
+		queue:  make(chan *model.Message, p.queueSize),
+		done:   make(chan struct{}),
+	}
+	p.branches = append(p.branches, b)
+	if p.started {
+		go b.run(p.ctx, len(p.branches)-1)
+	}
+}
+
+// Next returns the first branch.
+func (p *Tee) Next() pipeline.Pipeline {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(p.branches) == 0 {
+		return nil
+	}
+	return p.branches[0].next
+}
+
+// Policies returns the policy of each branch.
+func (p *Tee) Policies() []Policy {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	policies := make([]Policy, len(p.branches))
+	for i, b := range p.branches {
+		policies[i] = b.policy
+	}
+	return policies
+}
+
+// Branches returns all the branches.
+func (p *Tee) Branches() []pipeline.Pipeline {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	branches := make([]pipeline.Pipeline, len(p.branches))
+	for i, b := range p.branches {
+		branches[i] = b.next
+	}
+	return branches
+}
@@ -0,0 +1,218 @@
+package tee
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/stretchr/testify/assert"
+)
+
+var ctx = context.Background()
+
+// sink is a pipeline element that counts messages, optionally blocking
+// until release is closed or failing every message.
+type sink struct {
+	count   int64
+	active  int64 // Publish calls in progress
+	release chan struct{}
+	stuck   bool // Ignore the context while waiting for release
+	fail    bool
+	panics  bool
+}
+
+func (s *sink) Publish(ctx context.Context, m *model.Message) error {
+	atomic.AddInt64(&s.active, 1)
+	defer atomic.AddInt64(&s.active, -1)
+
+	if s.stuck {
+		<-s.release
+	} else if s.release != nil {
+		select {
+		case <-s.release:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	atomic.AddInt64(&s.count, 1)
+
+	// Branches get their own copy of the message
+	m.DeviceID = "changed"
+
+	if s.panics {
+		panic("sink panic")
+	}
+	if s.fail {
+		return errors.New("sink failure")
+	}
+	return nil
+}
+
+func (s *sink) AddNext(pipeline.Pipeline) {}
+
+func (s *sink) Next() pipeline.Pipeline { return nil }
+
+func TestTee(t *testing.T) {
+	good := &sink{}
+	failing := &sink{fail: true}
+	panicking := &sink{panics: true}
+	stalled := &sink{release: make(chan struct{})}
+
+	p := New(0)
+	p.AddNext(good)
+	p.AddNext(failing)
+	p.AddNext(panicking)
+	p.AddNext(stalled)
+	assert.Nil(t, p.Start(ctx))
+	assert.Equal(t, good, p.Next())
+	assert.Equal(t, 4, len(p.Branches()))
+
+	m := &model.Message{DeviceID: "foo"}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, p.Publish(ctx, m))
+	}
+	assert.Equal(t, "foo", m.DeviceID)
+
+	// The other branches keep going while one is stalled
+	for _, s := range []*sink{good, failing, panicking} {
+		s := s
+		assert.Eventually(t, func() bool { return atomic.LoadInt64(&s.count) == 100 }, time.Second, time.Millisecond)
+	}
+	assert.Equal(t, int64(0), atomic.LoadInt64(&stalled.count))
+
+	close(stalled.release)
+	assert.Nil(t, p.Stop(ctx))
+	assert.Equal(t, int64(100), atomic.LoadInt64(&stalled.count))
+	assert.Equal(t, []int64{0, 0, 0, 0}, p.Dropped())
+
+	// Publishing after Stop is a no-op
+	assert.Nil(t, p.Publish(ctx, m))
+}
+
+func TestTeeDrop(t *testing.T) {
+	stalled := &sink{release: make(chan struct{})}
+
+	p := New(5)
+	assert.Nil(t, p.Start(ctx))
+	p.AddNext(stalled)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, p.Publish(ctx, &model.Message{}))
+	}
+
+	close(stalled.release)
+	assert.Nil(t, p.Stop(ctx))
+
+	// At most one message in flight and a full queue, the rest are dropped
+	count := atomic.LoadInt64(&stalled.count)
+	assert.LessOrEqual(t, count, int64(6))
+	assert.Equal(t, 20-count, p.Dropped()[0])
+}
+
+func TestTeeStopTimeout(t *testing.T) {
+	good := &sink{}
+	stalled := &sink{release: make(chan struct{})}
+
+	p := New(0)
+	p.AddNext(good)
+	p.AddNext(stalled)
+	assert.Nil(t, p.Start(ctx))
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, p.Publish(ctx, &model.Message{}))
+	}
+
+	// The stalled branch is abandoned, and has stopped by the time
+	// Stop returns
+	stopCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, p.Stop(stopCtx))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&stalled.active))
+	assert.Equal(t, int64(10), atomic.LoadInt64(&good.count))
+
+	close(stalled.release)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&stalled.count))
+}
+
+func TestTeeBlock(t *testing.T) {
+	stalled := &sink{release: make(chan struct{})}
+
+	p := New(2)
+	p.AddBranch(stalled, PolicyBlock)
+	assert.Nil(t, p.Start(ctx))
+	assert.Equal(t, []Policy{PolicyBlock}, p.Policies())
+
+	// A full blocking branch holds up the publisher instead of
+	// dropping messages
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, p.Publish(ctx, &model.Message{}))
+		}
+	}()
+	select {
+	case <-published:
+		t.Fatal("publish did not block")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Giving up on waiting
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, p.Publish(shortCtx, &model.Message{}))
+
+	close(stalled.release)
+	<-published
+	assert.Nil(t, p.Stop(ctx))
+	assert.Equal(t, int64(10), atomic.LoadInt64(&stalled.count))
+	assert.Equal(t, []int64{0}, p.Dropped())
+}
+
+func TestTeeBlockStop(t *testing.T) {
+	stalled := &sink{release: make(chan struct{})}
+
+	p := New(1)
+	p.AddBranch(stalled, PolicyBlock)
+	assert.Nil(t, p.Start(ctx))
+
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, p.Publish(ctx, &model.Message{}))
+		}
+	}()
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&stalled.active) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+
+	// Stopping releases the publisher waiting for room
+	stopCtx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, p.Stop(stopCtx))
+	<-published
+}
+
+func TestTeeStopStuck(t *testing.T) {
+	abandonGrace = 10 * time.Millisecond
+	defer func() { abandonGrace = time.Second }()
+
+	stuck := &sink{release: make(chan struct{}), stuck: true}
+	defer close(stuck.release)
+
+	p := New(0)
+	p.AddNext(stuck)
+	assert.Nil(t, p.Start(ctx))
+	assert.Nil(t, p.Publish(ctx, &model.Message{}))
+	assert.Eventually(t, func() bool { return atomic.LoadInt64(&stuck.active) == 1 }, time.Second, time.Millisecond)
+
+	// Stop returns even though the branch ignores the context
+	stopCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.NotNil(t, p.Stop(stopCtx))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+}
@@ -2,10 +2,12 @@
 package pipelinetest
 
 import (
+	"context"
 	"testing"
 
 	"github.com/lab5e/aqserver/pkg/model"
 	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/pipeline/builder"
 	"github.com/lab5e/aqserver/pkg/pipeline/calculate"
 	"github.com/lab5e/aqserver/pkg/pipeline/circular"
 	"github.com/lab5e/aqserver/pkg/pipeline/persist"
@@ -66,7 +68,7 @@ func TestRoot(t *testing.T) {
 	root := pipeline.New(db)
 	assert.NotNil(t, root)
 
-	root.Publish(testMessage)
+	root.Publish(context.Background(), testMessage)
 }
 
 func TestPipeline(t *testing.T) {
@@ -93,7 +95,7 @@ func TestPipeline(t *testing.T) {
 
 	// Ensure the message is modified (new values are calculated)
 	assert.Equal(t, testMessage, &msg)
-	root.Publish(&msg)
+	root.Publish(context.Background(), &msg)
 	assert.NotEqual(t, testMessage, &msg)
 
 	// Make sure that message has been persisted
@@ -106,3 +108,54 @@ func TestPipeline(t *testing.T) {
 	assert.NotNil(t, msgs)
 	assert.Equal(t, 1, len(msgs))
 }
+
+func TestPersistDuplicates(t *testing.T) {
+	db, err := sqlitestore.New(":memory:")
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	root := pipeline.New(db)
+	persist := persist.New(db)
+	circular := circular.New(10)
+
+	root.AddNext(persist)
+	persist.AddNext(circular)
+
+	for i := 0; i < 3; i++ {
+		msg := *testMessage
+		msg.MessageID = "my-message-id"
+		assert.Nil(t, root.Publish(context.Background(), &msg))
+	}
+
+	// Only the first message is stored and passed on
+	assert.Equal(t, int64(2), persist.Duplicates())
+	assert.Equal(t, 1, len(circular.GetContents()))
+}
+
+func TestDefaultPipeline(t *testing.T) {
+	db, err := sqlitestore.New(":memory:")
+	assert.Nil(t, err)
+	defer db.Close()
+
+	built, err := builder.Build(builder.DefaultConfig(false), &builder.Env{
+		DB:         db,
+		PM:         model.DefaultPMConfig(),
+		Conversion: model.DefaultConversionConfig(),
+	})
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+	assert.Nil(t, built.Start(ctx))
+	for i := 0; i < 3; i++ {
+		msg := *testMessage
+		msg.MessageID = "my-message-id"
+		assert.Nil(t, built.Root.Publish(ctx, &msg))
+	}
+	assert.Nil(t, built.Stop(ctx))
+
+	// The sinks after storage see the storage ID, and duplicates are
+	// not passed on
+	msgs := built.Stages[builder.TypeCircular].(*circular.Buffer).GetContents()
+	assert.Equal(t, 1, len(msgs))
+	assert.NotZero(t, msgs[0].ID)
+}
@@ -0,0 +1,106 @@
+package spanlistener
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/go-spanapi/v4"
+	"github.com/lab5e/go-spanapi/v4/apitools"
+)
+
+// fetchPageSize is the number of messages requested per page when
+// fetching stored data from Span.
+const fetchPageSize = 200
+
+// FetchOptions limits which stored messages are fetched.
+type FetchOptions struct {
+	Since  int64  // Only fetch messages received at or after this time (ms since epoch), 0 means no limit
+	Until  int64  // Only fetch messages received before this time (ms since epoch), 0 means no limit
+	Offset string // Continue paging after this message ID
+}
+
+// FetchData pages through the data stored in a Span collection from
+// the newest to the oldest message and calls handler for each
+// message.  Messages that cannot be decoded are logged and skipped.
+// If handler returns an error the fetch is aborted.
+func FetchData(apiToken string, collectionID string, opts FetchOptions, handler func(m *model.Message) error) error {
+	client := spanapi.NewAPIClient(spanapi.NewConfiguration())
+	ctx := apitools.ContextWithAuth(apiToken)
+
+	offset := opts.Offset
+	for {
+		req := client.CollectionsApi.ListCollectionData(ctx, collectionID).
+			Limit(fetchPageSize)
+
+		if opts.Since > 0 {
+			req = req.Start(strconv.FormatInt(opts.Since, 10))
+		}
+		if opts.Until > 0 {
+			req = req.End(strconv.FormatInt(opts.Until, 10))
+		}
+		if offset != "" {
+			req = req.Offset(offset)
+		}
+
+		items, _, err := req.Execute()
+		if err != nil {
+			return fmt.Errorf("list collection data error: %v", err)
+		}
+
+		if len(items.Data) == 0 {
+			return nil
+		}
+
+		for _, item := range items.Data {
+			offset = item.GetMessageId()
+
+			message, err := messageFromOutputData(item)
+			if err != nil {
+				log.Printf("skipping message %s: %v", offset, err)
+				continue
+			}
+
+			err = handler(message)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// messageFromOutputData decodes the payload of a Span output data
+// message and fills in the housekeeping fields.
+func messageFromOutputData(odm spanapi.OutputDataMessage) (*model.Message, error) {
+	payload, err := base64.StdEncoding.DecodeString(odm.GetPayload())
+	if err != nil {
+		return nil, fmt.Errorf("error base64-decoding payload='%s': %v", odm.GetPayload(), err)
+	}
+
+	pb, err := model.ProtobufFromData(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error protobuf-decoding payload='%s': %v", odm.GetPayload(), err)
+	}
+
+	received, err := strconv.ParseInt(odm.GetReceived(), 10, 64)
+	if err != nil {
+		log.Printf("Error converting timestamp string (%s): %v", odm.GetReceived(), err)
+		received = time.Now().UnixMilli()
+	}
+
+	device := odm.GetDevice()
+
+	message := model.MessageFromProtobuf(pb)
+	message.DeviceID = device.GetDeviceId()
+	message.CollectionID = device.GetCollectionId()
+	message.MessageID = odm.GetMessageId()
+	message.ReceivedTime = received
+	message.PacketSize = len(payload)
+	message.Payload = payload
+	message.Tags = device.GetTags()
+
+	return message, nil
+}
@@ -1,103 +1,365 @@
 package spanlistener
 
 import (
-	"encoding/base64"
+	"context"
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
+	"math/rand"
+	"sync"
 	"time"
 
-	aqv1 "github.com/lab5e/aqserver/pkg/aq/v1"
 	"github.com/lab5e/aqserver/pkg/model"
-	"google.golang.org/protobuf/proto"
-
 	"github.com/lab5e/aqserver/pkg/pipeline"
 	"github.com/lab5e/go-spanapi/v4/apitools"
 )
 
 type SpanListener interface {
+	Shutdown()
 	WaitForShutdown()
 }
 
 type spanListener struct {
 	pipeline     pipeline.Pipeline
-	ds           apitools.DataStream
 	collectionID string
 	token        string
 	shutdownCh   chan struct{}
+
+	// ctx is passed on to the pipeline.  It is not cancelled by
+	// Shutdown, so that the message being published can get through.
+	ctx      context.Context
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// mu protects ds, the data stream we are reading from, so that
+	// Shutdown can close it.
+	mu sync.Mutex
+	ds apitools.DataStream
+
+	// dial opens a new data stream and fetch pages through stored
+	// data.  These are fields so they can be replaced in tests.
+	dial  func() (apitools.DataStream, error)
+	fetch func(opts FetchOptions, handler func(m *model.Message) error) error
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+
+	// lastReceived is the time of the newest message we have seen and
+	// seen holds the IDs of the messages received within dedupWindow
+	// of it.  pruned is lastReceived when seen was last pruned.
+	lastReceived int64
+	seen         map[string]int64
+	pruned       int64
+
+	statsMu sync.Mutex
+	stats   Stats
+}
+
+// Stats are the metrics of a Span listener.
+type Stats struct {
+	Reconnects int64 `json:"reconnects"` // Times we have reconnected to Span
+	GapFills   int64 `json:"gapFills"`   // Times we have fetched messages received while disconnected
+	Recovered  int64 `json:"recovered"`  // Messages published from the fetched data
+	Duplicates int64 `json:"duplicates"` // Messages skipped because they were already published
 }
 
+const (
+	defaultMinBackoff = time.Second
+	defaultMaxBackoff = 2 * time.Minute
+
+	// dedupWindow is how far back from the newest message we
+	// remember message IDs.  The messages fetched to fill a gap
+	// overlap with those read from the stream before the connection
+	// was lost and after it was restored.
+	dedupWindow = time.Minute
+)
+
+// metrics holds the stats of all Span listeners by collection ID and
+// is published as "spanlistener" through expvar.
+var metrics = expvar.NewMap("spanlistener")
+
 var (
 	ErrPipelineNil = errors.New("pipeline is nil")
 )
 
-func Create(pipeline pipeline.Pipeline, apiToken string, collectionID string) (SpanListener, error) {
+// Create starts a listener that publishes the messages in a Span
+// collection to the pipeline.  ctx is passed on to the pipeline with
+// each message, so cancelling it abandons the message being published.
+func Create(ctx context.Context, pipeline pipeline.Pipeline, apiToken string, collectionID string) (SpanListener, error) {
 	if pipeline == nil {
 		return nil, ErrPipelineNil
 	}
 
 	listener := &spanListener{
 		pipeline:     pipeline,
+		ctx:          ctx,
 		collectionID: collectionID,
 		token:        apiToken,
 		shutdownCh:   make(chan struct{}),
+		stop:         make(chan struct{}),
+		minBackoff:   defaultMinBackoff,
+		maxBackoff:   defaultMaxBackoff,
+	}
+	listener.dial = func() (apitools.DataStream, error) {
+		clientID := fmt.Sprintf("aqserver-%d", time.Now().UnixMicro())
+		return apitools.NewMQTTStream(
+			apitools.WithAPIToken(apiToken),
+			apitools.WithCollectionID(collectionID),
+			apitools.WithClientID(clientID),
+		)
 	}
 
-	clientID := fmt.Sprintf("aqserver-%d", time.Now().UnixMicro())
+	listener.fetch = func(opts FetchOptions, handler func(m *model.Message) error) error {
+		return FetchData(apiToken, collectionID, opts, handler)
+	}
 
-	var err error
-	listener.ds, err = apitools.NewMQTTStream(
-		apitools.WithAPIToken(apiToken),
-		apitools.WithCollectionID(collectionID),
-		apitools.WithClientID(clientID),
-	)
+	ds, err := listener.dial()
 	if err != nil {
 		return nil, fmt.Errorf("unable to open CollectionDataStream: %v", err)
 	}
 
-	go listener.readDataStream()
+	metrics.Set(collectionID, expvar.Func(func() interface{} { return listener.Stats() }))
+
+	go listener.run(ds)
 
 	return listener, nil
 }
 
+// Stats returns the current metrics of the listener.
+func (s *spanListener) Stats() Stats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	return s.stats
+}
+
+// count updates the metrics of the listener.
+func (s *spanListener) count(f func(stats *Stats)) {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+	f(&s.stats)
+}
+
+// Shutdown closes the connection to Span and stops reconnecting.  The
+// message being published, if any, is allowed to finish.
+func (s *spanListener) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.closeStream()
+	})
+}
+
 func (s *spanListener) WaitForShutdown() {
 	<-s.shutdownCh
 }
 
-func (s *spanListener) readDataStream() {
+// stopped returns true once Shutdown has been called.
+func (s *spanListener) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// run reads from the data stream and reconnects whenever the
+// connection is lost.  After reconnecting, messages that arrived
+// while we were disconnected are fetched from the Span API.
+func (s *spanListener) run(ds apitools.DataStream) {
+	defer close(s.shutdownCh)
+
+	for {
+		s.readDataStream(ds)
+		if s.stopped() {
+			return
+		}
+		disconnected := time.Now().UnixMilli()
+
+		ds = s.reconnect()
+		if ds == nil {
+			return
+		}
+		s.fillGap(disconnected, time.Now().UnixMilli())
+	}
+}
+
+// setStream makes ds the stream Shutdown closes.  It returns false if
+// we are already shutting down.
+func (s *spanListener) setStream(ds apitools.DataStream) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stopped() {
+		return false
+	}
+	s.ds = ds
+	return true
+}
+
+// closeStream closes the current stream, if any.
+func (s *spanListener) closeStream() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ds != nil {
+		s.ds.Close()
+		s.ds = nil
+	}
+}
+
+// reconnect attempts to open a new data stream using exponential
+// backoff with jitter until it succeeds.  It returns nil if we are shut
+// down while reconnecting.
+func (s *spanListener) reconnect() apitools.DataStream {
+	backoff := s.minBackoff
+	for attempt := 1; ; attempt++ {
+		// Sleep somewhere between half and the full backoff
+		// interval so that multiple instances don't reconnect in
+		// lockstep.
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Printf("reconnecting to Span collection='%s' in %v (attempt %d)", s.collectionID, delay, attempt)
+		select {
+		case <-time.After(delay):
+		case <-s.stop:
+			return nil
+		}
+
+		ds, err := s.dial()
+		if err == nil {
+			s.count(func(stats *Stats) { stats.Reconnects++ })
+			log.Printf("reconnected to Span collection='%s' (%d reconnects so far)", s.collectionID, s.Stats().Reconnects)
+			return ds
+		}
+		log.Printf("unable to reconnect to Span: %v", err)
+
+		backoff *= 2
+		if backoff > s.maxBackoff {
+			backoff = s.maxBackoff
+		}
+	}
+}
+
+// fillGap fetches the messages Span received while we were
+// disconnected and publishes them into the pipeline.  Messages
+// received after the reconnect arrive on the new stream.  Messages we
+// have already published, before the connection was lost or from the
+// new stream, are skipped.
+func (s *spanListener) fillGap(disconnected int64, reconnected int64) {
+	since := s.lastReceived
+	if since == 0 {
+		since = disconnected
+	}
+
+	var gap []*model.Message
+	err := s.fetch(FetchOptions{Since: since, Until: reconnected}, func(m *model.Message) error {
+		if m.CollectionID == "" {
+			m.CollectionID = s.collectionID
+		}
+		gap = append(gap, m)
+		return nil
+	})
+	if err != nil {
+		log.Printf("error filling gap after reconnect, data may be missing: %v", err)
+	}
+
+	// The data is listed newest first so we publish in reverse
+	// order to keep the pipeline in chronological order.
+	recovered := 0
+	for i := len(gap) - 1; i >= 0 && !s.stopped(); i-- {
+		if !s.track(gap[i].MessageID, gap[i].ReceivedTime) {
+			continue
+		}
+		s.publish(gap[i])
+		recovered++
+	}
+
+	s.count(func(stats *Stats) {
+		stats.GapFills++
+		stats.Recovered += int64(recovered)
+	})
+	if recovered > 0 {
+		log.Printf("recovered %d messages received while disconnected from Span", recovered)
+	}
+}
+
+// track records a message so we know where to fill gaps from if the
+// connection is lost.  It returns false if the message has already
+// been seen.
+func (s *spanListener) track(messageID string, received int64) bool {
+	if _, ok := s.seen[messageID]; ok {
+		s.count(func(stats *Stats) { stats.Duplicates++ })
+		return false
+	}
+
+	if s.seen == nil {
+		s.seen = make(map[string]int64)
+	}
+	s.seen[messageID] = received
+	if received > s.lastReceived {
+		s.lastReceived = received
+	}
+
+	// Forget the messages that have fallen out of the window, but
+	// only once it has moved on so we don't scan the map for every
+	// message.
+	window := dedupWindow.Milliseconds()
+	if s.lastReceived-s.pruned >= window {
+		for id, t := range s.seen {
+			if t < s.lastReceived-window {
+				delete(s.seen, id)
+			}
+		}
+		s.pruned = s.lastReceived
+	}
+	return true
+}
+
+func (s *spanListener) readDataStream(ds apitools.DataStream) {
+	if !s.setStream(ds) {
+		ds.Close()
+		return
+	}
 	defer func() {
 		log.Printf("connection to Span closed")
-		s.ds.Close()
-		close(s.shutdownCh)
+		s.closeStream()
 	}()
 
-	var sample aqv1.Sample
 	for {
-		odm, err := s.ds.Recv()
+		odm, err := ds.Recv()
 		if err != nil {
 			log.Printf("error reading message: %v", err)
 			return
 		}
 
 		// We only care about messages containing data
-		if *odm.Type != "data" {
+		if odm.GetType() != "data" {
 			continue
 		}
 
-		payload, err := base64.StdEncoding.DecodeString(odm.GetPayload())
+		message, err := messageFromOutputData(odm)
 		if err != nil {
 			log.Printf("payload error: %v", err)
 			continue
 		}
 
-		err = proto.Unmarshal(payload, &sample)
-		if err != nil {
-			log.Printf("payload error: %v", err)
+		if message.CollectionID == "" {
+			message.CollectionID = s.collectionID
+		}
+
+		if !s.track(message.MessageID, message.ReceivedTime) {
+			continue
 		}
+		s.publish(message)
+	}
+}
 
-		message := model.MessageFromProtobuf(&sample)
-		message.MessageID = odm.GetMessageId()
-		message.PacketSize = len(payload)
-		s.pipeline.Publish(message)
+// publish passes a message on to the pipeline.  Stages that want
+// failed messages retried or kept have to do so themselves, all we can
+// do here is to report the error.
+func (s *spanListener) publish(m *model.Message) {
+	err := s.pipeline.Publish(s.ctx, m)
+	if err != nil {
+		log.Printf("error publishing message device='%s' messageID='%s': %v", m.DeviceID, m.MessageID, err)
 	}
 }
@@ -0,0 +1,328 @@
+package spanlistener
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	aqv1 "github.com/lab5e/aqserver/pkg/aq/v1"
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/go-spanapi/v4"
+	"github.com/lab5e/go-spanapi/v4/apitools"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStream implements apitools.DataStream.  Recv returns the
+// queued messages and then fails, or blocks if the stream is kept
+// open.
+type fakeStream struct {
+	messages  chan spanapi.OutputDataMessage
+	keepOpen  bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeStream(keepOpen bool, msgs ...spanapi.OutputDataMessage) *fakeStream {
+	s := &fakeStream{
+		messages: make(chan spanapi.OutputDataMessage, len(msgs)),
+		keepOpen: keepOpen,
+		closed:   make(chan struct{}),
+	}
+	for _, m := range msgs {
+		s.messages <- m
+	}
+	if !keepOpen {
+		close(s.messages)
+	}
+	return s
+}
+
+func (s *fakeStream) Recv() (spanapi.OutputDataMessage, error) {
+	select {
+	case m, ok := <-s.messages:
+		if ok {
+			return m, nil
+		}
+	case <-s.closed:
+	}
+	return spanapi.OutputDataMessage{}, errors.New("connection lost")
+}
+
+func (s *fakeStream) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+// collector is a pipeline element that records what is published.
+type collector struct {
+	mu       sync.Mutex
+	messages []*model.Message
+}
+
+func (c *collector) Publish(ctx context.Context, m *model.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, m)
+	return nil
+}
+
+func (c *collector) AddNext(_ pipeline.Pipeline) {}
+
+func (c *collector) Next() pipeline.Pipeline { return nil }
+
+func (c *collector) waitFor(n int) []*model.Message {
+	for i := 0; i < 200; i++ {
+		c.mu.Lock()
+		if len(c.messages) >= n {
+			msgs := append([]*model.Message{}, c.messages...)
+			c.mu.Unlock()
+			return msgs
+		}
+		c.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	return nil
+}
+
+// outputData creates an output data message the same way the Span
+// client would, by decoding the JSON representation.
+func outputData(t *testing.T, messageID string, received int64, sample *aqv1.Sample) spanapi.OutputDataMessage {
+	payload, err := model.DataFromProtobuf(sample)
+	assert.Nil(t, err)
+
+	var odm spanapi.OutputDataMessage
+	err = json.Unmarshal([]byte(fmt.Sprintf(`{
+		"type": "data",
+		"device": {"deviceId": "dev1", "collectionId": "col1", "tags": {"name": "Elgeseter"}},
+		"payload": "%s",
+		"received": "%d",
+		"messageId": "%s"
+	}`, base64.StdEncoding.EncodeToString(payload), received, messageID)), &odm)
+	assert.Nil(t, err)
+	return odm
+}
+
+func TestReconnectAndFillGap(t *testing.T) {
+	msg1 := outputData(t, "msg1", 1000, &aqv1.Sample{Sysid: 1})
+	msg2 := outputData(t, "msg2", 1500, &aqv1.Sample{Sysid: 2})
+	msg3 := outputData(t, "msg3", 2000, &aqv1.Sample{Sysid: 3})
+
+	sink := &collector{}
+	dials := 0
+
+	s := &spanListener{
+		pipeline:   sink,
+		shutdownCh: make(chan struct{}),
+		stop:       make(chan struct{}),
+		ctx:        context.Background(),
+		minBackoff: time.Millisecond,
+		maxBackoff: 10 * time.Millisecond,
+	}
+
+	s.dial = func() (apitools.DataStream, error) {
+		dials++
+		if dials == 1 {
+			return nil, errors.New("still down")
+		}
+		return newFakeStream(true, msg3), nil
+	}
+
+	var fetchOpts FetchOptions
+	s.fetch = func(opts FetchOptions, handler func(m *model.Message) error) error {
+		fetchOpts = opts
+		for _, odm := range []spanapi.OutputDataMessage{msg2, msg1} {
+			m, err := messageFromOutputData(odm)
+			assert.Nil(t, err)
+			handler(m)
+		}
+		return nil
+	}
+
+	go s.run(newFakeStream(false, msg1))
+
+	msgs := sink.waitFor(3)
+	assert.Equal(t, 3, len(msgs))
+	assert.Equal(t, "msg1", msgs[0].MessageID)
+	assert.Equal(t, "msg2", msgs[1].MessageID)
+	assert.Equal(t, "msg3", msgs[2].MessageID)
+
+	assert.Equal(t, int64(1000), fetchOpts.Since)
+	assert.Equal(t, 2, dials)
+	assert.Equal(t, Stats{Reconnects: 1, GapFills: 1, Recovered: 1, Duplicates: 1}, s.Stats())
+}
+
+func TestFillGapOverlap(t *testing.T) {
+	// msg1 and msg2 are received in the same millisecond, and msg3
+	// arrives on the new stream as well as in the fetched data.
+	msg1 := outputData(t, "msg1", 1000, &aqv1.Sample{Sysid: 1})
+	msg2 := outputData(t, "msg2", 1000, &aqv1.Sample{Sysid: 2})
+	msg3 := outputData(t, "msg3", 1500, &aqv1.Sample{Sysid: 3})
+	msg4 := outputData(t, "msg4", 2000, &aqv1.Sample{Sysid: 4})
+
+	sink := &collector{}
+	s := &spanListener{
+		pipeline:   sink,
+		shutdownCh: make(chan struct{}),
+		stop:       make(chan struct{}),
+		ctx:        context.Background(),
+		minBackoff: time.Millisecond,
+		maxBackoff: 10 * time.Millisecond,
+	}
+	s.dial = func() (apitools.DataStream, error) {
+		return newFakeStream(true, msg3, msg4), nil
+	}
+	s.fetch = func(opts FetchOptions, handler func(m *model.Message) error) error {
+		for _, odm := range []spanapi.OutputDataMessage{msg3, msg2, msg1} {
+			m, err := messageFromOutputData(odm)
+			assert.Nil(t, err)
+			handler(m)
+		}
+		return nil
+	}
+
+	go s.run(newFakeStream(false, msg1, msg2))
+
+	msgs := sink.waitFor(4)
+	assert.Equal(t, 4, len(msgs))
+	for i, id := range []string{"msg1", "msg2", "msg3", "msg4"} {
+		assert.Equal(t, id, msgs[i].MessageID)
+	}
+
+	s.Shutdown()
+	s.WaitForShutdown()
+	assert.Equal(t, 4, len(sink.messages))
+	assert.Equal(t, Stats{Reconnects: 1, GapFills: 1, Recovered: 1, Duplicates: 3}, s.Stats())
+}
+
+func TestTrackPrune(t *testing.T) {
+	s := &spanListener{}
+	window := dedupWindow.Milliseconds()
+
+	assert.True(t, s.track("msg1", 1000))
+	assert.True(t, s.track("msg2", 1000+window/2))
+	assert.False(t, s.track("msg1", 1000))
+
+	// msg1 falls out of the window once we are a full window past it
+	assert.True(t, s.track("msg3", 1001+window))
+	assert.NotContains(t, s.seen, "msg1")
+	assert.Contains(t, s.seen, "msg2")
+	assert.Equal(t, 1001+window, s.lastReceived)
+}
+
+func TestReadDataStream(t *testing.T) {
+	var keepalive spanapi.OutputDataMessage
+	err := json.Unmarshal([]byte(`{"type": "keepalive"}`), &keepalive)
+	assert.Nil(t, err)
+
+	sink := &collector{}
+	s := &spanListener{pipeline: sink, ctx: context.Background()}
+
+	s.readDataStream(newFakeStream(false,
+		outputData(t, "msg1", 1681726200000, &aqv1.Sample{Sysid: 42, Sensor_1Work: 1234}),
+		keepalive,
+		outputData(t, "msg2", 1681726260000, &aqv1.Sample{Sysid: 42}),
+	))
+
+	msgs := sink.waitFor(2)
+	assert.Equal(t, 2, len(msgs))
+
+	m := msgs[0]
+	assert.Equal(t, "dev1", m.DeviceID)
+	assert.Equal(t, "msg1", m.MessageID)
+	assert.Equal(t, int64(1681726200000), m.ReceivedTime)
+	assert.Equal(t, "Elgeseter", m.Tags["name"])
+	assert.Equal(t, uint64(42), m.SysID)
+	assert.Equal(t, uint32(1234), m.Sensor1Work)
+	assert.NotZero(t, m.PacketSize)
+
+	assert.Equal(t, int64(1681726260000), s.lastReceived)
+	assert.Contains(t, s.seen, "msg1")
+	assert.Contains(t, s.seen, "msg2")
+}
+
+// gate is a pipeline element that holds up each message until release
+// is closed, and then passes it on to next.
+type gate struct {
+	started chan struct{}
+	release chan struct{}
+	next    pipeline.Pipeline
+}
+
+func (g *gate) Publish(ctx context.Context, m *model.Message) error {
+	g.started <- struct{}{}
+	select {
+	case <-g.release:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return g.next.Publish(ctx, m)
+}
+
+func (g *gate) AddNext(pe pipeline.Pipeline) { g.next = pe }
+
+func (g *gate) Next() pipeline.Pipeline { return g.next }
+
+func TestShutdown(t *testing.T) {
+	sink := &collector{}
+	g := &gate{started: make(chan struct{}, 1), release: make(chan struct{}), next: sink}
+	s := &spanListener{
+		pipeline:   g,
+		shutdownCh: make(chan struct{}),
+		stop:       make(chan struct{}),
+		ctx:        context.Background(),
+		minBackoff: time.Hour,
+		maxBackoff: time.Hour,
+	}
+
+	stream := newFakeStream(true, outputData(t, "msg1", 1000, &aqv1.Sample{Sysid: 1}))
+	go s.run(stream)
+	<-g.started
+
+	// The message being published is not abandoned by Shutdown
+	s.Shutdown()
+	select {
+	case <-s.shutdownCh:
+		t.Fatal("listener shut down while publishing")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(g.release)
+	s.WaitForShutdown()
+	assert.Equal(t, 1, len(sink.waitFor(1)))
+
+	// Cancelling the context abandons the message being published
+	sink = &collector{}
+	ctx, cancel := context.WithCancel(context.Background())
+	g = &gate{started: make(chan struct{}, 1), release: make(chan struct{}), next: sink}
+	s = &spanListener{
+		pipeline:   g,
+		shutdownCh: make(chan struct{}),
+		stop:       make(chan struct{}),
+		ctx:        ctx,
+		minBackoff: time.Hour,
+		maxBackoff: time.Hour,
+	}
+	go s.run(newFakeStream(true, outputData(t, "msg1", 1000, &aqv1.Sample{Sysid: 1})))
+	<-g.started
+	s.Shutdown()
+	cancel()
+	s.WaitForShutdown()
+	assert.Empty(t, sink.messages)
+
+	// Shutting down while waiting to reconnect
+	s = &spanListener{
+		pipeline:   sink,
+		shutdownCh: make(chan struct{}),
+		stop:       make(chan struct{}),
+		ctx:        context.Background(),
+		minBackoff: time.Hour,
+		maxBackoff: time.Hour,
+	}
+	go s.run(newFakeStream(false))
+	s.Shutdown()
+	s.WaitForShutdown()
+}
@@ -14,12 +14,20 @@ INSERT INTO cal
   sysid,
   collection_id,
   valid_from,
+  valid_to,
+  board_type,
   afe_serial,
   circuit_type,
   afe_type,
   sensor1_serial,
   sensor2_serial,
   sensor3_serial,
+  sensor1_type,
+  sensor2_type,
+  sensor3_type,
+  sensor1_algorithm,
+  sensor2_algorithm,
+  sensor3_algorithm,
   afe_cal_date,
   vt20_offset,
   sensor1_we_e,
@@ -46,12 +54,20 @@ VALUES(
   :sysid,
   :collection_id,
   :valid_from,
+  :valid_to,
+  :board_type,
   :afe_serial,
   :circuit_type,
   :afe_type,
   :sensor1_serial,
   :sensor2_serial,
   :sensor3_serial,
+  :sensor1_type,
+  :sensor2_type,
+  :sensor3_type,
+  :sensor1_algorithm,
+  :sensor2_algorithm,
+  :sensor3_algorithm,
   :afe_cal_date,
   :vt20_offset,
   :sensor1_we_e,
@@ -81,6 +97,52 @@ VALUES(
 	return r.LastInsertId()
 }
 
+// UpdateCal ...
+func (s *MySQLStore) UpdateCal(c *model.Cal) error {
+	_, err := s.db.NamedExec(`
+UPDATE cal SET
+  device_id = :device_id,
+  sysid = :sysid,
+  collection_id = :collection_id,
+  valid_from = :valid_from,
+  valid_to = :valid_to,
+  board_type = :board_type,
+  afe_serial = :afe_serial,
+  circuit_type = :circuit_type,
+  afe_type = :afe_type,
+  sensor1_serial = :sensor1_serial,
+  sensor2_serial = :sensor2_serial,
+  sensor3_serial = :sensor3_serial,
+  sensor1_type = :sensor1_type,
+  sensor2_type = :sensor2_type,
+  sensor3_type = :sensor3_type,
+  sensor1_algorithm = :sensor1_algorithm,
+  sensor2_algorithm = :sensor2_algorithm,
+  sensor3_algorithm = :sensor3_algorithm,
+  afe_cal_date = :afe_cal_date,
+  vt20_offset = :vt20_offset,
+  sensor1_we_e = :sensor1_we_e,
+  sensor1_we_0 = :sensor1_we_0,
+  sensor1_ae_e = :sensor1_ae_e,
+  sensor1_ae_0 = :sensor1_ae_0,
+  sensor1_pcb_gain = :sensor1_pcb_gain,
+  sensor1_we_sensitivity = :sensor1_we_sensitivity,
+  sensor2_we_e = :sensor2_we_e,
+  sensor2_we_0 = :sensor2_we_0,
+  sensor2_ae_e = :sensor2_ae_e,
+  sensor2_ae_0 = :sensor2_ae_0,
+  sensor2_pcb_gain = :sensor2_pcb_gain,
+  sensor2_we_sensitivity = :sensor2_we_sensitivity,
+  sensor3_we_e = :sensor3_we_e,
+  sensor3_we_0 = :sensor3_we_0,
+  sensor3_ae_e = :sensor3_ae_e,
+  sensor3_ae_0 = :sensor3_ae_0,
+  sensor3_pcb_gain = :sensor3_pcb_gain,
+  sensor3_we_sensitivity = :sensor3_we_sensitivity
+WHERE id = :id`, c)
+	return err
+}
+
 // GetCal ...
 func (s *MySQLStore) GetCal(id int64) (*model.Cal, error) {
 	var c model.Cal
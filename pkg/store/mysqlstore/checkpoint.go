@@ -0,0 +1,31 @@
+package mysqlstore
+
+import (
+	"github.com/lab5e/aqserver/pkg/model"
+)
+
+// PutFetchCheckpoint ...
+func (s *MySQLStore) PutFetchCheckpoint(cp *model.FetchCheckpoint) error {
+	_, err := s.db.NamedExec(`
+INSERT INTO fetch_checkpoints
+  (collection_id, since_time, until_time, offset_message_id, high_water, updated_time)
+VALUES
+  (:collection_id, :since_time, :until_time, :offset_message_id, :high_water, :updated_time)
+ON DUPLICATE KEY UPDATE
+  since_time = VALUES(since_time),
+  until_time = VALUES(until_time),
+  offset_message_id = VALUES(offset_message_id),
+  high_water = VALUES(high_water),
+  updated_time = VALUES(updated_time)`, cp)
+	return err
+}
+
+// GetFetchCheckpoint ...
+func (s *MySQLStore) GetFetchCheckpoint(collectionID string) (*model.FetchCheckpoint, error) {
+	var cp model.FetchCheckpoint
+	err := s.db.QueryRowx("SELECT * FROM fetch_checkpoints WHERE collection_id = ?", collectionID).StructScan(&cp)
+	if err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
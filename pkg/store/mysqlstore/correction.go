@@ -0,0 +1,25 @@
+package mysqlstore
+
+import (
+	"github.com/lab5e/aqserver/pkg/model"
+)
+
+// PutCorrection ...
+func (s *MySQLStore) PutCorrection(c *model.Correction) (int64, error) {
+	r, err := s.db.NamedExec(`
+INSERT INTO corrections
+  (device_id, component, valid_from, intercept, ppb_coef, temp_coef, hum_coef, r2, samples, created)
+VALUES
+  (:device_id, :component, :valid_from, :intercept, :ppb_coef, :temp_coef, :hum_coef, :r2, :samples, :created)`, c)
+	if err != nil {
+		return -1, err
+	}
+	return r.LastInsertId()
+}
+
+// ListCorrections ...
+func (s *MySQLStore) ListCorrections() ([]model.Correction, error) {
+	var corrections []model.Correction
+	err := s.db.Select(&corrections, "SELECT * FROM corrections ORDER BY device_id, component, valid_from ASC")
+	return corrections, err
+}
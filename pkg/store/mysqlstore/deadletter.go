@@ -0,0 +1,31 @@
+package mysqlstore
+
+import (
+	"github.com/lab5e/aqserver/pkg/model"
+)
+
+// PutDeadLetter ...
+func (s *MySQLStore) PutDeadLetter(d *model.DeadLetter) (int64, error) {
+	r, err := s.db.NamedExec(`
+INSERT INTO dead_letters
+  (created, stage, reason, attempts, device_id, message, payload)
+VALUES
+  (:created, :stage, :reason, :attempts, :device_id, :message, :payload)`, d)
+	if err != nil {
+		return -1, err
+	}
+	return r.LastInsertId()
+}
+
+// ListDeadLetters ...
+func (s *MySQLStore) ListDeadLetters() ([]model.DeadLetter, error) {
+	var letters []model.DeadLetter
+	err := s.db.Select(&letters, "SELECT * FROM dead_letters ORDER BY id ASC")
+	return letters, err
+}
+
+// DeleteDeadLetter ...
+func (s *MySQLStore) DeleteDeadLetter(id int64) error {
+	_, err := s.db.Exec("DELETE FROM dead_letters WHERE id = ?", id)
+	return err
+}
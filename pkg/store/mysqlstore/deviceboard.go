@@ -0,0 +1,31 @@
+package mysqlstore
+
+import (
+	"github.com/lab5e/aqserver/pkg/model"
+)
+
+// PutDeviceBoard ...
+func (s *MySQLStore) PutDeviceBoard(b *model.DeviceBoard) (int64, error) {
+	r, err := s.db.NamedExec(`
+INSERT INTO device_boards
+  (device_id, sysid, valid_from, valid_to)
+VALUES
+  (:device_id, :sysid, :valid_from, :valid_to)`, b)
+	if err != nil {
+		return -1, err
+	}
+	return r.LastInsertId()
+}
+
+// UpdateDeviceBoard ...
+func (s *MySQLStore) UpdateDeviceBoard(b *model.DeviceBoard) error {
+	_, err := s.db.NamedExec("UPDATE device_boards SET valid_from = :valid_from, valid_to = :valid_to WHERE id = :id", b)
+	return err
+}
+
+// ListDeviceBoards ...
+func (s *MySQLStore) ListDeviceBoards() ([]model.DeviceBoard, error) {
+	var boards []model.DeviceBoard
+	err := s.db.Select(&boards, "SELECT * FROM device_boards ORDER BY device_id, valid_from ASC")
+	return boards, err
+}
@@ -4,6 +4,7 @@ import (
 	"math"
 
 	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/store"
 )
 
 // cleanFloat takes care of normalizing floats that are infinite or
@@ -29,11 +30,15 @@ func (s *MySQLStore) PutMessage(m *model.Message) (int64, error) {
 	cleanFloat(&m.O3PPB)
 	cleanFloat(&m.NOPPB)
 	cleanFloat(&m.AFE3TempValue)
+	cleanFloat(&m.NO2UGM3)
+	cleanFloat(&m.O3UGM3)
+	cleanFloat(&m.NOUGM3)
 
 	// Pretty it ain't :-)
 	r, err := s.db.NamedExec(`
   INSERT INTO messages
     (device_id,
+     message_id,
      received_time,
      packetsize,
      sysid,
@@ -95,8 +100,18 @@ func (s *MySQLStore) PutMessage(m *model.Message) (int64, error) {
      opcbin_21,
      opcbin_22,
      opcbin_23,
-     opcsamplevalid)
+     opcsamplevalid,
+     pm1_corrected,
+     pm25_corrected,
+     pm10_corrected,
+     no2_ugm3,
+     o3_ugm3,
+     no_ugm3,
+     uncalibrated,
+     collection_id,
+     payload)
     VALUES (:device_id,
+            :message_id,
             :received_time,
             :packetsize,
             :sysid,
@@ -156,13 +171,140 @@ func (s *MySQLStore) PutMessage(m *model.Message) (int64, error) {
             :opcbin_21,
             :opcbin_22,
             :opcbin_23,
-            :opcsamplevalid)`, m)
+            :opcsamplevalid,
+            :pm1_corrected,
+            :pm25_corrected,
+            :pm10_corrected,
+            :no2_ugm3,
+            :o3_ugm3,
+            :no_ugm3,
+            :uncalibrated,
+            :collection_id,
+            :payload)
+    ON DUPLICATE KEY UPDATE id = id`, m)
 	if err != nil {
 		return -1, err
 	}
+
+	// Duplicates leave the existing row untouched so no rows are
+	// affected.
+	n, err := r.RowsAffected()
+	if err != nil {
+		return -1, err
+	}
+	if n == 0 {
+		return -1, store.ErrMessageExists
+	}
 	return r.LastInsertId()
 }
 
+// updateMessageStatement updates everything except the identity of
+// a message.
+const updateMessageStatement = `
+UPDATE messages SET
+  received_time     = :received_time,
+  packetsize        = :packetsize,
+  sysid             = :sysid,
+  firmware_ver      = :firmware_ver,
+  uptime            = :uptime,
+  boardtemp         = :boardtemp,
+  board_rel_hum     = :board_rel_hum,
+  status            = :status,
+  gpstimestamp      = :gpstimestamp,
+  lon               = :lon,
+  lat               = :lat,
+  alt               = :alt,
+  sensor1work       = :sensor1work,
+  sensor1aux        = :sensor1aux,
+  sensor2work       = :sensor2work,
+  sensor2aux        = :sensor2aux,
+  sensor3work       = :sensor3work,
+  sensor3aux        = :sensor3aux,
+  afe3_temp_raw     = :afe3_temp_raw,
+  no2_ppb           = :no2_ppb,
+  o3_ppb            = :o3_ppb,
+  no_ppb            = :no_ppb,
+  afe3_temp_value   = :afe3_temp_value,
+  opcpma            = :opcpma,
+  opcpmb            = :opcpmb,
+  opcpmc            = :opcpmc,
+  pm1               = :pm1,
+  pm10              = :pm10,
+  pm25              = :pm25,
+  opcsampleperiod   = :opcsampleperiod,
+  opcsampleflowrate = :opcsampleflowrate,
+  opctemp           = :opctemp,
+  opchum            = :opchum,
+  opcfanrevcount    = :opcfanrevcount,
+  opclaserstatus    = :opclaserstatus,
+  opcbin_0          = :opcbin_0,
+  opcbin_1          = :opcbin_1,
+  opcbin_2          = :opcbin_2,
+  opcbin_3          = :opcbin_3,
+  opcbin_4          = :opcbin_4,
+  opcbin_5          = :opcbin_5,
+  opcbin_6          = :opcbin_6,
+  opcbin_7          = :opcbin_7,
+  opcbin_8          = :opcbin_8,
+  opcbin_9          = :opcbin_9,
+  opcbin_10         = :opcbin_10,
+  opcbin_11         = :opcbin_11,
+  opcbin_12         = :opcbin_12,
+  opcbin_13         = :opcbin_13,
+  opcbin_14         = :opcbin_14,
+  opcbin_15         = :opcbin_15,
+  opcbin_16         = :opcbin_16,
+  opcbin_17         = :opcbin_17,
+  opcbin_18         = :opcbin_18,
+  opcbin_19         = :opcbin_19,
+  opcbin_20         = :opcbin_20,
+  opcbin_21         = :opcbin_21,
+  opcbin_22         = :opcbin_22,
+  opcbin_23         = :opcbin_23,
+  opcsamplevalid    = :opcsamplevalid,
+  pm1_corrected     = :pm1_corrected,
+  pm25_corrected    = :pm25_corrected,
+  pm10_corrected    = :pm10_corrected,
+  no2_ugm3          = :no2_ugm3,
+  o3_ugm3           = :o3_ugm3,
+  no_ugm3           = :no_ugm3,
+  uncalibrated      = :uncalibrated,
+  collection_id     = :collection_id,
+  payload           = :payload
+WHERE id = :id`
+
+// UpdateMessages ...
+func (s *MySQLStore) UpdateMessages(msgs []*model.Message) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.PrepareNamed(updateMessageStatement)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, m := range msgs {
+		cleanFloat(&m.NO2PPB)
+		cleanFloat(&m.O3PPB)
+		cleanFloat(&m.NOPPB)
+		cleanFloat(&m.AFE3TempValue)
+		cleanFloat(&m.NO2UGM3)
+		cleanFloat(&m.O3UGM3)
+		cleanFloat(&m.NOUGM3)
+
+		_, err := stmt.Exec(m)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 // GetMessage ...
 func (s *MySQLStore) GetMessage(id int64) (*model.Message, error) {
 	var m model.Message
@@ -193,3 +335,10 @@ func (s *MySQLStore) ListDeviceMessagesByDate(deviceID string, from int64, to in
 	err := s.db.Select(&msgs, "SELECT * FROM messages WHERE device_id = ? AND received_time >= ? AND received_time < ? ORDER BY received_time", deviceID, from, to)
 	return msgs, err
 }
+
+// MessageExists ...
+func (s *MySQLStore) MessageExists(deviceID string, messageID string) (bool, error) {
+	var count int
+	err := s.db.Get(&count, "SELECT COUNT(*) FROM messages WHERE device_id = ? AND message_id = ?", deviceID, messageID)
+	return count > 0, err
+}
@@ -0,0 +1,217 @@
+package mysqlstore
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// migration is a change to the schema of an existing database.  The
+// schema itself only creates missing tables, so any change to
+// existing tables must be done through a migration.  Note that
+// MySQL commits DDL statements implicitly, so a failing migration
+// may be partially applied and must be safe to run again.  Migrations are
+// applied in order and the version is recorded in schema_migrations.
+// Never change or reorder existing migrations, only add new ones at
+// the end.
+type migration struct {
+	description string
+	apply       func(tx *sqlx.Tx) error
+}
+
+var migrations = []migration{
+	{
+		description: "remove duplicate messages and make (device_id, message_id) unique",
+		apply: func(tx *sqlx.Tx) error {
+			// Early versions of the MySQL schema lacked the
+			// message_id column.
+			err := addColumnIfMissing(tx, "messages", "message_id", "VARCHAR(255) NOT NULL DEFAULT '' AFTER device_id")
+			if err != nil {
+				return err
+			}
+
+			// NULLIF makes messages without message ID distinct
+			// since NULLs never collide in a unique index.
+			return execAll(
+				`DELETE m FROM messages m
+                   JOIN messages d ON m.device_id = d.device_id AND m.message_id = d.message_id AND m.id > d.id
+                  WHERE m.message_id <> ''`,
+				`CREATE UNIQUE INDEX messages_device_message ON messages (device_id, (NULLIF(message_id, '')))`,
+			)(tx)
+		},
+	},
+	{
+		description: "add raw payload to messages",
+		apply: func(tx *sqlx.Tx) error {
+			return addColumnIfMissing(tx, "messages", "payload", "BLOB")
+		},
+	},
+	{
+		description: "add sensor types to cal",
+		apply: func(tx *sqlx.Tx) error {
+			for _, column := range []string{"sensor1_type", "sensor2_type", "sensor3_type"} {
+				err := addColumnIfMissing(tx, "cal", column, "VARCHAR(255) NOT NULL DEFAULT ''")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		description: "add compensation algorithms to cal",
+		apply: func(tx *sqlx.Tx) error {
+			for _, column := range []string{"sensor1_algorithm", "sensor2_algorithm", "sensor3_algorithm"} {
+				err := addColumnIfMissing(tx, "cal", column, "INT NOT NULL DEFAULT 0")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		description: "add board type to cal",
+		apply: func(tx *sqlx.Tx) error {
+			return addColumnIfMissing(tx, "cal", "board_type", "VARCHAR(255) NOT NULL DEFAULT ''")
+		},
+	},
+	{
+		description: "add humidity corrected PM to messages",
+		apply: func(tx *sqlx.Tx) error {
+			for _, column := range []string{"pm1_corrected", "pm25_corrected", "pm10_corrected"} {
+				err := addColumnIfMissing(tx, "messages", column, "DOUBLE NOT NULL DEFAULT 0")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		description: "add ug/m3 concentrations to messages",
+		apply: func(tx *sqlx.Tx) error {
+			for _, column := range []string{"no2_ugm3", "o3_ugm3", "no_ugm3"} {
+				err := addColumnIfMissing(tx, "messages", column, "DOUBLE NOT NULL DEFAULT 0")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		description: "add end of validity to cal",
+		apply: func(tx *sqlx.Tx) error {
+			return addColumnIfMissing(tx, "cal", "valid_to", "DATETIME NULL")
+		},
+	},
+	{
+		description: "add uncalibrated flag to messages",
+		apply: func(tx *sqlx.Tx) error {
+			for _, column := range []string{"uncalibrated"} {
+				err := addColumnIfMissing(tx, "messages", column, "BOOLEAN NOT NULL DEFAULT FALSE")
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		description: "add collection ID to messages",
+		apply: func(tx *sqlx.Tx) error {
+			return addColumnIfMissing(tx, "messages", "collection_id", "VARCHAR(255) NOT NULL DEFAULT ''")
+		},
+	},
+}
+
+const migrationsTable = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+  version       INTEGER PRIMARY KEY,
+  description   VARCHAR(255) NOT NULL,
+  applied_time  BIGINT NOT NULL
+)`
+
+// migrate applies the migrations that have not been applied yet.
+func migrate(db *sqlx.DB) error {
+	_, err := db.Exec(migrationsTable)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = db.Get(&version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations")
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		m := migrations[version]
+
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+
+		err = m.apply(tx)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d (%s) failed: %v", version+1, m.description, err)
+		}
+
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, description, applied_time) VALUES (?, ?, ?)", version+1, m.description, time.Now().UnixMilli())
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d: %s", version+1, m.description)
+	}
+	return nil
+}
+
+// execAll returns a migration function that executes the statements
+// in order.
+func execAll(statements ...string) func(tx *sqlx.Tx) error {
+	return func(tx *sqlx.Tx) error {
+		for _, statement := range statements {
+			r, err := tx.Exec(statement)
+			if err != nil {
+				return err
+			}
+
+			n, _ := r.RowsAffected()
+			if n > 0 {
+				log.Printf("Migration: %d rows affected by \"%s\"", n, firstLine(statement))
+			}
+		}
+		return nil
+	}
+}
+
+// addColumnIfMissing adds a column to a table unless it already exists.
+func addColumnIfMissing(tx *sqlx.Tx, table string, column string, definition string) error {
+	var count int
+	err := tx.Get(&count, `
+SELECT COUNT(*) FROM information_schema.columns
+ WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?`, table, column)
+	if err != nil || count > 0 {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
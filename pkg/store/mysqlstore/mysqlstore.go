@@ -27,6 +27,11 @@ func New(connectString string) (*MySQLStore, error) {
 	}
 	createSchema(d)
 
+	err = migrate(d)
+	if err != nil {
+		return nil, err
+	}
+
 	return &MySQLStore{
 		db:            d,
 		connectString: connectString,
@@ -11,6 +11,7 @@ const schema = `
 CREATE TABLE IF NOT EXISTS messages (
   id             BIGINT PRIMARY KEY auto_increment,
   device_id      VARCHAR(255) NOT NULL,
+  message_id     VARCHAR(255) NOT NULL DEFAULT '',
   received_time  BIGINT NOT NULL,
   packetsize     INTEGER NOT NULL,
   sysid          BIGINT NOT NULL,
@@ -122,6 +123,48 @@ CREATE TABLE IF NOT EXISTS cal (
 
   UNIQUE(device_id, collection_id, afe_serial, valid_from)
 );
+
+CREATE TABLE IF NOT EXISTS fetch_checkpoints (
+  collection_id      VARCHAR(255) PRIMARY KEY,
+  since_time         BIGINT NOT NULL,
+  until_time         BIGINT NOT NULL,
+  offset_message_id  VARCHAR(255) NOT NULL,
+  high_water         BIGINT NOT NULL,
+  updated_time       BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS corrections (
+  id          BIGINT PRIMARY KEY auto_increment,
+  device_id   VARCHAR(255) NOT NULL,
+  component   VARCHAR(255) NOT NULL,
+  valid_from  DATETIME NOT NULL,
+  intercept   DOUBLE NOT NULL,
+  ppb_coef    DOUBLE NOT NULL,
+  temp_coef   DOUBLE NOT NULL,
+  hum_coef    DOUBLE NOT NULL,
+  r2          DOUBLE NOT NULL,
+  samples     INTEGER NOT NULL,
+  created     DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS device_boards (
+  id          BIGINT PRIMARY KEY auto_increment,
+  device_id   VARCHAR(255) NOT NULL,
+  sysid       BIGINT NOT NULL,
+  valid_from  DATETIME NOT NULL,
+  valid_to    DATETIME NULL
+);
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+  id          BIGINT PRIMARY KEY auto_increment,
+  created     DATETIME NOT NULL,
+  stage       VARCHAR(255) NOT NULL,
+  reason      TEXT NOT NULL,
+  attempts    INTEGER NOT NULL,
+  device_id   VARCHAR(255) NOT NULL,
+  message     MEDIUMBLOB NOT NULL,
+  payload     BLOB
+);
 `
 
 func createSchema(db *sqlx.DB) {
@@ -0,0 +1,37 @@
+package sqlitestore
+
+import (
+	"github.com/lab5e/aqserver/pkg/model"
+)
+
+// PutFetchCheckpoint ...
+func (s *SqliteStore) PutFetchCheckpoint(cp *model.FetchCheckpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.NamedExec(`
+INSERT INTO fetch_checkpoints
+  (collection_id, since_time, until_time, offset_message_id, high_water, updated_time)
+VALUES
+  (:collection_id, :since_time, :until_time, :offset_message_id, :high_water, :updated_time)
+ON CONFLICT(collection_id) DO UPDATE SET
+  since_time = excluded.since_time,
+  until_time = excluded.until_time,
+  offset_message_id = excluded.offset_message_id,
+  high_water = excluded.high_water,
+  updated_time = excluded.updated_time`, cp)
+	return err
+}
+
+// GetFetchCheckpoint ...
+func (s *SqliteStore) GetFetchCheckpoint(collectionID string) (*model.FetchCheckpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var cp model.FetchCheckpoint
+	err := s.db.QueryRowx("SELECT * FROM fetch_checkpoints WHERE collection_id = ?", collectionID).StructScan(&cp)
+	if err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
@@ -0,0 +1,40 @@
+package sqlitestore
+
+import (
+	"github.com/lab5e/aqserver/pkg/model"
+)
+
+// PutDeadLetter ...
+func (s *SqliteStore) PutDeadLetter(d *model.DeadLetter) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.db.NamedExec(`
+INSERT INTO dead_letters
+  (created, stage, reason, attempts, device_id, message, payload)
+VALUES
+  (:created, :stage, :reason, :attempts, :device_id, :message, :payload)`, d)
+	if err != nil {
+		return -1, err
+	}
+	return r.LastInsertId()
+}
+
+// ListDeadLetters ...
+func (s *SqliteStore) ListDeadLetters() ([]model.DeadLetter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var letters []model.DeadLetter
+	err := s.db.Select(&letters, "SELECT * FROM dead_letters ORDER BY id ASC")
+	return letters, err
+}
+
+// DeleteDeadLetter ...
+func (s *SqliteStore) DeleteDeadLetter(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.Exec("DELETE FROM dead_letters WHERE id = ?", id)
+	return err
+}
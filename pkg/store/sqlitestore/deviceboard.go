@@ -0,0 +1,40 @@
+package sqlitestore
+
+import (
+	"github.com/lab5e/aqserver/pkg/model"
+)
+
+// PutDeviceBoard ...
+func (s *SqliteStore) PutDeviceBoard(b *model.DeviceBoard) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, err := s.db.NamedExec(`
+INSERT INTO device_boards
+  (device_id, sysid, valid_from, valid_to)
+VALUES
+  (:device_id, :sysid, :valid_from, :valid_to)`, b)
+	if err != nil {
+		return -1, err
+	}
+	return r.LastInsertId()
+}
+
+// UpdateDeviceBoard ...
+func (s *SqliteStore) UpdateDeviceBoard(b *model.DeviceBoard) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.NamedExec("UPDATE device_boards SET valid_from = :valid_from, valid_to = :valid_to WHERE id = :id", b)
+	return err
+}
+
+// ListDeviceBoards ...
+func (s *SqliteStore) ListDeviceBoards() ([]model.DeviceBoard, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var boards []model.DeviceBoard
+	err := s.db.Select(&boards, "SELECT * FROM device_boards ORDER BY device_id, valid_from ASC")
+	return boards, err
+}
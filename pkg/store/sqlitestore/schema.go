@@ -129,6 +129,48 @@ CREATE TABLE IF NOT EXISTS cal (
 
   UNIQUE(device_id, collection_id, afe_serial, valid_from)
 );
+
+CREATE TABLE IF NOT EXISTS fetch_checkpoints (
+  collection_id      TEXT PRIMARY KEY,
+  since_time         BIGINT NOT NULL,
+  until_time         BIGINT NOT NULL,
+  offset_message_id  TEXT NOT NULL,
+  high_water         BIGINT NOT NULL,
+  updated_time       BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS corrections (
+  id          INTEGER PRIMARY KEY AUTOINCREMENT,
+  device_id   TEXT NOT NULL,
+  component   TEXT NOT NULL,
+  valid_from  DATETIME NOT NULL,
+  intercept   REAL NOT NULL,
+  ppb_coef    REAL NOT NULL,
+  temp_coef   REAL NOT NULL,
+  hum_coef    REAL NOT NULL,
+  r2          REAL NOT NULL,
+  samples     INTEGER NOT NULL,
+  created     DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS device_boards (
+  id          INTEGER PRIMARY KEY AUTOINCREMENT,
+  device_id   TEXT NOT NULL,
+  sysid       INTEGER NOT NULL,
+  valid_from  DATETIME NOT NULL,
+  valid_to    DATETIME NULL
+);
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+  id          INTEGER PRIMARY KEY AUTOINCREMENT,
+  created     DATETIME NOT NULL,
+  stage       TEXT NOT NULL,
+  reason      TEXT NOT NULL,
+  attempts    INTEGER NOT NULL,
+  device_id   TEXT NOT NULL,
+  message     BLOB NOT NULL,
+  payload     BLOB
+);
 `
 
 func createSchema(db *sqlx.DB) {
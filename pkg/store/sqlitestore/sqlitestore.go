@@ -35,9 +35,17 @@ func New(dbFile string) (*SqliteStore, error) {
 		return nil, err
 	}
 
+	// The schema only creates what is missing so we always run it
+	// in order to pick up tables added after the database was
+	// created.
 	if !databaseFileExisted {
 		log.Printf("Creating database schema in %s", dbFile)
-		createSchema(d)
+	}
+	createSchema(d)
+
+	err = migrate(d)
+	if err != nil {
+		return nil, err
 	}
 
 	return &SqliteStore{db: d}, nil
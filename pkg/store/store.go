@@ -10,6 +10,10 @@ import (
 // ErrCalExists indicates that calibration entry already exists
 var ErrCalExists = errors.New("Calibration entry already exists")
 
+// ErrMessageExists indicates that a message with the same device ID
+// and Span message ID has already been stored.
+var ErrMessageExists = errors.New("Message already exists")
+
 // Store defines the persistence interface.
 type Store interface {
 	// ############################################################
@@ -20,6 +24,9 @@ type Store interface {
 	// referred to must already exist in the database.
 	PutCal(c *model.Cal) (int64, error)
 
+	// UpdateCal updates a calibration entry, identified by its ID.
+	UpdateCal(c *model.Cal) error
+
 	// GetCal gets a calibration entry by id
 	GetCal(id int64) (*model.Cal, error)
 
@@ -37,9 +44,16 @@ type Store interface {
 	//                     Message
 	// ############################################################
 
-	// PutMessage adds a new message to database
+	// PutMessage adds a new message to database.  Messages are
+	// unique on DeviceID and MessageID, so if the message has already
+	// been stored nothing is written and ErrMessageExists is
+	// returned.  Messages without a MessageID are always stored.
 	PutMessage(m *model.Message) (int64, error)
 
+	// UpdateMessages updates stored messages in place, identified by
+	// their ID.  All messages are updated in a single transaction.
+	UpdateMessages(msgs []*model.Message) error
+
 	// GetMessage gets a message by id
 	GetMessage(id int64) (*model.Message, error)
 
@@ -52,6 +66,61 @@ type Store interface {
 	// ListDeviceMessagesByDate lists messages by device and date [from:to>
 	ListDeviceMessagesByDate(deviceID string, from int64, to int64) ([]model.Message, error)
 
+	// MessageExists checks if a message with the given Span message ID
+	// has been stored for the device.
+	MessageExists(deviceID string, messageID string) (bool, error)
+
+	// ############################################################
+	//                     Fetch checkpoints
+	// ############################################################
+
+	// PutFetchCheckpoint creates or updates the fetch checkpoint
+	// for a collection.
+	PutFetchCheckpoint(cp *model.FetchCheckpoint) error
+
+	// GetFetchCheckpoint gets the fetch checkpoint for a collection.
+	// Returns sql.ErrNoRows if there is no checkpoint.
+	GetFetchCheckpoint(collectionID string) (*model.FetchCheckpoint, error)
+
+	// ############################################################
+	//                     Corrections
+	// ############################################################
+
+	// PutCorrection adds a new correction.
+	PutCorrection(c *model.Correction) (int64, error)
+
+	// ListCorrections lists all corrections ordered by DeviceID,
+	// Component and ValidFrom in ascending order.
+	ListCorrections() ([]model.Correction, error)
+
+	// ############################################################
+	//                     Device boards
+	// ############################################################
+
+	// PutDeviceBoard adds a new entry to the device board registry.
+	PutDeviceBoard(b *model.DeviceBoard) (int64, error)
+
+	// UpdateDeviceBoard updates the validity period of a device
+	// board registry entry, identified by its ID.
+	UpdateDeviceBoard(b *model.DeviceBoard) error
+
+	// ListDeviceBoards lists the device board registry ordered by
+	// DeviceID and ValidFrom in ascending order.
+	ListDeviceBoards() ([]model.DeviceBoard, error)
+
+	// ############################################################
+	//                     Dead letters
+	// ############################################################
+
+	// PutDeadLetter adds a message that a pipeline stage gave up on.
+	PutDeadLetter(d *model.DeadLetter) (int64, error)
+
+	// ListDeadLetters lists dead letters in the order they were added.
+	ListDeadLetters() ([]model.DeadLetter, error)
+
+	// DeleteDeadLetter deletes a dead letter.
+	DeleteDeadLetter(id int64) error
+
 	// Close the database
 	Close() error
 }
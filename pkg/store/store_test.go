@@ -1,13 +1,17 @@
-package store
+package store_test
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/store"
 	"github.com/lab5e/aqserver/pkg/store/sqlitestore"
 	"github.com/stretchr/testify/assert"
 )
@@ -17,6 +21,7 @@ var testCal = model.Cal{
 	CollectionID:         "mycollection",
 	ValidFrom:            time.Now().Add(-24 * time.Hour),
 	AFESerial:            "some-serial-character-sequence",
+	Sensor1Type:          "NO2-B4",
 	AFECalDate:           time.Now().Add(-24 * time.Hour),
 	Vt20Offset:           0.3195,
 	Sensor1WEe:           312,
@@ -42,7 +47,7 @@ var testCal = model.Cal{
 func TestSqlitestore(t *testing.T) {
 	// Cal tests
 	{
-		var db Store
+		var db store.Store
 
 		db, err := sqlitestore.New(":memory:")
 		assert.Nil(t, err, "Error instantiating new sqlitestore")
@@ -53,7 +58,7 @@ func TestSqlitestore(t *testing.T) {
 
 	// Message tests
 	{
-		var db Store
+		var db store.Store
 
 		db, err := sqlitestore.New(":memory:")
 		assert.Nil(t, err, "Error instantiating new sqlitestore")
@@ -62,10 +67,53 @@ func TestSqlitestore(t *testing.T) {
 		db.Close()
 	}
 
+	// Checkpoint tests
+	{
+		var db store.Store
+
+		db, err := sqlitestore.New(":memory:")
+		assert.Nil(t, err, "Error instantiating new sqlitestore")
+		assert.NotNil(t, db)
+		checkpointTests(t, db)
+		db.Close()
+	}
+
+	// Correction tests
+	{
+		var db store.Store
+
+		db, err := sqlitestore.New(":memory:")
+		assert.Nil(t, err, "Error instantiating new sqlitestore")
+		assert.NotNil(t, db)
+		correctionTests(t, db)
+		db.Close()
+	}
+
+	// Device board tests
+	{
+		var db store.Store
+
+		db, err := sqlitestore.New(":memory:")
+		assert.Nil(t, err, "Error instantiating new sqlitestore")
+		assert.NotNil(t, db)
+		deviceBoardTests(t, db)
+		db.Close()
+	}
+
+	// Dead letter tests
+	{
+		var db store.Store
+
+		db, err := sqlitestore.New(":memory:")
+		assert.Nil(t, err, "Error instantiating new sqlitestore")
+		assert.NotNil(t, db)
+		deadLetterTests(t, db)
+		db.Close()
+	}
 }
 
 // calTests performs CRUD tests on Cal
-func calTests(t *testing.T, db Store) {
+func calTests(t *testing.T, db store.Store) {
 
 	{
 		// Put
@@ -79,6 +127,8 @@ func calTests(t *testing.T, db Store) {
 		c, err := db.GetCal(id)
 		assert.Nil(t, err)
 		assert.NotNil(t, c)
+		assert.Equal(t, "NO2-B4", c.Sensor1Type)
+		assert.Nil(t, c.ValidTo)
 
 		// TODO(borud): date returned from SQLite3 has different
 		// precision and timezone that what we put in, so this has to
@@ -97,6 +147,19 @@ func calTests(t *testing.T, db Store) {
 		assert.Nil(t, c)
 	}
 
+	// ValidTo
+	{
+		validTo := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+		id, err := db.PutCal(&model.Cal{DeviceID: "valid-to-device", ValidFrom: validTo.Add(-24 * time.Hour), ValidTo: &validTo})
+		assert.Nil(t, err)
+
+		c, err := db.GetCal(id)
+		assert.Nil(t, err)
+		assert.NotNil(t, c.ValidTo)
+		assert.True(t, validTo.Equal(*c.ValidTo))
+		assert.Nil(t, db.DeleteCal(id))
+	}
+
 	// ListCals
 	{
 		var devices []string
@@ -127,7 +190,7 @@ func calTests(t *testing.T, db Store) {
 }
 
 // messageTests performs CRUD tests on Messages
-func messageTests(t *testing.T, db Store) {
+func messageTests(t *testing.T, db store.Store) {
 
 	numDevices := 3
 	numMessagesPerDevice := (60 * 24)
@@ -142,6 +205,7 @@ func messageTests(t *testing.T, db Store) {
 		for j := 0; j < numMessagesPerDevice; j++ {
 			msg := &model.Message{
 				DeviceID:     deviceID,
+				MessageID:    fmt.Sprintf("msg-%d", j),
 				ReceivedTime: ms(t0.Add(time.Duration(j) * time.Minute)),
 			}
 			id, err := db.PutMessage(msg)
@@ -195,8 +259,244 @@ func messageTests(t *testing.T, db Store) {
 			assert.Equal(t, 10, len(msgs))
 		}
 	}
+
+	// Duplicates are rejected, but messages without message ID are not
+	{
+		_, err := db.PutMessage(&model.Message{DeviceID: "msg-device-0", MessageID: "msg-10"})
+		assert.ErrorIs(t, err, store.ErrMessageExists)
+
+		for i := 0; i < 2; i++ {
+			id, err := db.PutMessage(&model.Message{DeviceID: "msg-device-0"})
+			assert.Nil(t, err)
+			assert.True(t, id > 0)
+		}
+	}
+
+	// MessageExists
+	{
+		exists, err := db.MessageExists("msg-device-0", "msg-10")
+		assert.Nil(t, err)
+		assert.True(t, exists)
+
+		exists, err = db.MessageExists("msg-device-0", "no-such-message")
+		assert.Nil(t, err)
+		assert.False(t, exists)
+	}
+
+	// Raw payload is stored and messages can be updated in place
+	{
+		payload := []byte{0x08, 0x2a, 0x10, 0x01}
+		id, err := db.PutMessage(&model.Message{DeviceID: "payload-device", MessageID: "p1", CollectionID: "c1", Payload: payload, NO2PPB: 1.0})
+		assert.Nil(t, err)
+
+		m, err := db.GetMessage(id)
+		assert.Nil(t, err)
+		assert.Equal(t, payload, m.Payload)
+		assert.Equal(t, "c1", m.CollectionID)
+
+		m.NO2PPB = 2.5
+		m.O3PPB = 3.5
+		m.NO2UGM3 = 4.5
+		m.PM25Corrected = 5.5
+		assert.Nil(t, db.UpdateMessages([]*model.Message{m}))
+
+		updated, err := db.GetMessage(id)
+		assert.Nil(t, err)
+		assert.Equal(t, 2.5, updated.NO2PPB)
+		assert.Equal(t, 3.5, updated.O3PPB)
+		assert.Equal(t, 4.5, updated.NO2UGM3)
+		assert.Equal(t, 5.5, updated.PM25Corrected)
+		assert.Equal(t, "p1", updated.MessageID)
+		assert.Equal(t, "c1", updated.CollectionID)
+		assert.Equal(t, payload, updated.Payload)
+	}
+}
+
+// checkpointTests checks that fetch checkpoints can be created and updated
+func checkpointTests(t *testing.T, db store.Store) {
+	_, err := db.GetFetchCheckpoint("collection1")
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	cp := &model.FetchCheckpoint{
+		CollectionID: "collection1",
+		Since:        1000,
+		Until:        2000,
+		Offset:       "msg-1",
+	}
+	assert.Nil(t, db.PutFetchCheckpoint(cp))
+
+	cp.Offset = ""
+	cp.HighWater = 1999
+	assert.Nil(t, db.PutFetchCheckpoint(cp))
+
+	c, err := db.GetFetchCheckpoint("collection1")
+	assert.Nil(t, err)
+	assert.Equal(t, cp, c)
+}
+
+// correctionTests checks that corrections can be stored and listed
+func correctionTests(t *testing.T, db store.Store) {
+	for i, component := range []string{model.ComponentO3, model.ComponentNO2} {
+		id, err := db.PutCorrection(&model.Correction{
+			DeviceID:  "device1",
+			Component: component,
+			ValidFrom: time.Date(2022, 1, i+1, 0, 0, 0, 0, time.UTC),
+			Intercept: 1.5,
+			PPBCoef:   0.9,
+			Samples:   100,
+			Created:   time.Now(),
+		})
+		assert.Nil(t, err)
+		assert.True(t, id > 0)
+	}
+
+	corrections, err := db.ListCorrections()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(corrections))
+	assert.Equal(t, model.ComponentNO2, corrections[0].Component)
+	assert.Equal(t, 1.5, corrections[0].Intercept)
+	assert.Equal(t, 100, corrections[1].Samples)
+}
+
+// deviceBoardTests checks that the device board registry can be
+// stored, updated and listed
+func deviceBoardTests(t *testing.T, db store.Store) {
+	b := &model.DeviceBoard{
+		DeviceID:  "device1",
+		SysID:     1,
+		ValidFrom: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	id, err := db.PutDeviceBoard(b)
+	assert.Nil(t, err)
+	assert.True(t, id > 0)
+
+	_, err = db.PutDeviceBoard(&model.DeviceBoard{
+		DeviceID:  "device0",
+		SysID:     2,
+		ValidFrom: time.Date(2022, 1, 2, 0, 0, 0, 0, time.UTC),
+	})
+	assert.Nil(t, err)
+
+	end := time.Date(2022, 2, 1, 0, 0, 0, 0, time.UTC)
+	b.ID = id
+	b.ValidTo = &end
+	assert.Nil(t, db.UpdateDeviceBoard(b))
+
+	boards, err := db.ListDeviceBoards()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(boards))
+	assert.Equal(t, "device0", boards[0].DeviceID)
+	assert.Nil(t, boards[0].ValidTo)
+	assert.Equal(t, uint64(1), boards[1].SysID)
+	assert.True(t, end.Equal(*boards[1].ValidTo))
+}
+
+// deadLetterTests checks that dead letters can be stored, listed and
+// deleted, and that the message survives the round trip
+func deadLetterTests(t *testing.T, db store.Store) {
+	m := &model.Message{DeviceID: "device1", MessageID: "m1", Payload: []byte{1, 2, 3}, NO2PPB: 12.5}
+
+	d, err := model.NewDeadLetter("retry", m, errors.New("persist: database is locked"), 3)
+	assert.Nil(t, err)
+	id, err := db.PutDeadLetter(d)
+	assert.Nil(t, err)
+	assert.True(t, id > 0)
+
+	d.DeviceID = "device2"
+	id2, err := db.PutDeadLetter(d)
+	assert.Nil(t, err)
+
+	letters, err := db.ListDeadLetters()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(letters))
+	assert.Equal(t, id, letters[0].ID)
+	assert.Equal(t, "retry", letters[0].Stage)
+	assert.Equal(t, "persist: database is locked", letters[0].Reason)
+	assert.Equal(t, 3, letters[0].Attempts)
+	assert.True(t, d.Created.Equal(letters[0].Created))
+
+	m2, err := letters[0].DecodeMessage()
+	assert.Nil(t, err)
+	assert.Equal(t, m, m2)
+
+	assert.Nil(t, db.DeleteDeadLetter(id))
+	letters, err = db.ListDeadLetters()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(letters))
+	assert.Equal(t, id2, letters[0].ID)
 }
 
 func ms(t time.Time) int64 {
 	return t.UnixNano() / int64(time.Millisecond)
 }
+
+// TestSqliteMigrateDuplicates checks that opening a database that
+// predates the unique message index removes duplicate messages.
+func TestSqliteMigrateDuplicates(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "aq.db")
+
+	db, err := sqlitestore.New(dbFile)
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = db.PutMessage(&model.Message{DeviceID: "dev", MessageID: fmt.Sprintf("msg-%d", i)})
+		assert.Nil(t, err)
+	}
+	_, err = db.PutMessage(&model.Message{DeviceID: "dev"})
+	assert.Nil(t, err)
+	db.Close()
+
+	// Roll back to a database without the unique index and turn the
+	// messages into duplicates behind the store's back.
+	raw, err := sql.Open("sqlite3", dbFile)
+	assert.Nil(t, err)
+	for _, statement := range []string{
+		"DROP INDEX messages_device_message",
+		"DELETE FROM schema_migrations",
+		"UPDATE messages SET message_id = 'dup' WHERE message_id <> ''",
+	} {
+		_, err = raw.Exec(statement)
+		assert.Nil(t, err)
+	}
+	raw.Close()
+
+	db, err = sqlitestore.New(dbFile)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	msgs, err := db.ListMessages(0, 100)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(msgs))
+
+	_, err = db.PutMessage(&model.Message{DeviceID: "dev", MessageID: "dup"})
+	assert.ErrorIs(t, err, store.ErrMessageExists)
+}
+
+// TestSqliteOtherConstraints checks that only duplicate messages are
+// reported as ErrMessageExists, not other constraint violations.
+func TestSqliteOtherConstraints(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "aq.db")
+
+	db, err := sqlitestore.New(dbFile)
+	assert.Nil(t, err)
+	db.Close()
+
+	raw, err := sql.Open("sqlite3", dbFile)
+	assert.Nil(t, err)
+	_, err = raw.Exec("CREATE UNIQUE INDEX messages_sysid ON messages(sysid)")
+	assert.Nil(t, err)
+	raw.Close()
+
+	db, err = sqlitestore.New(dbFile)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	_, err = db.PutMessage(&model.Message{DeviceID: "dev", MessageID: "m1", SysID: 1})
+	assert.Nil(t, err)
+
+	_, err = db.PutMessage(&model.Message{DeviceID: "dev", MessageID: "m2", SysID: 1})
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, store.ErrMessageExists))
+
+	_, err = db.PutMessage(&model.Message{DeviceID: "dev", MessageID: "m1", SysID: 2})
+	assert.ErrorIs(t, err, store.ErrMessageExists)
+}
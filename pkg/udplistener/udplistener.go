@@ -0,0 +1,130 @@
+// Package udplistener implements a listener that receives aqv1.Sample
+// protobuffers directly over UDP.  This allows devices that can reach
+// the server directly (eg. on a private APN) to bypass Span.
+package udplistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+)
+
+// UDPListener listens for datagrams containing protobuf encoded
+// samples and publishes them to the pipeline.
+type UDPListener struct {
+	pipeline   pipeline.Pipeline
+	conn       *net.UDPConn
+	bufferSize int
+	shutdownCh chan struct{}
+
+	// ctx is passed on to the pipeline.  It is not cancelled by
+	// Shutdown, so that the message being published can get through.
+	ctx context.Context
+}
+
+var (
+	// ErrPipelineNil indicates that no pipeline was given
+	ErrPipelineNil = errors.New("pipeline is nil")
+
+	// ErrInvalidBufferSize indicates that the read buffer size is not usable
+	ErrInvalidBufferSize = errors.New("buffer size must be positive")
+)
+
+// Create a new UDPListener listening to listenAddr.  The listener
+// starts reading immediately.  ctx is passed on to the pipeline with
+// each message, so cancelling it abandons the message being published.
+func Create(ctx context.Context, pipeline pipeline.Pipeline, listenAddr string, bufferSize int) (*UDPListener, error) {
+	if pipeline == nil {
+		return nil, ErrPipelineNil
+	}
+
+	if bufferSize <= 0 {
+		return nil, ErrInvalidBufferSize
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", listenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve '%s': %v", listenAddr, err)
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen to '%s': %v", listenAddr, err)
+	}
+
+	listener := &UDPListener{
+		pipeline:   pipeline,
+		conn:       conn,
+		bufferSize: bufferSize,
+		shutdownCh: make(chan struct{}),
+		ctx:        ctx,
+	}
+
+	go listener.readLoop()
+
+	return listener, nil
+}
+
+// LocalAddr returns the address the listener is bound to.
+func (u *UDPListener) LocalAddr() net.Addr {
+	return u.conn.LocalAddr()
+}
+
+// Shutdown closes the socket, which terminates the read loop once the
+// message being published, if any, has been published.
+func (u *UDPListener) Shutdown() {
+	u.conn.Close()
+}
+
+// WaitForShutdown blocks until the listener has terminated.
+func (u *UDPListener) WaitForShutdown() {
+	<-u.shutdownCh
+}
+
+func (u *UDPListener) readLoop() {
+	defer func() {
+		log.Printf("UDP listener on %s closed", u.conn.LocalAddr())
+		close(u.shutdownCh)
+	}()
+
+	buffer := make([]byte, u.bufferSize)
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("error reading from UDP socket: %v", err)
+			continue
+		}
+
+		// If the datagram filled the buffer it was most likely
+		// truncated, in which case we will not be able to decode it.
+		if n == len(buffer) {
+			log.Printf("datagram from %v filled the %d byte read buffer, possibly truncated", addr, n)
+		}
+
+		pb, err := model.ProtobufFromData(buffer[:n])
+		if err != nil {
+			log.Printf("payload error from %v: %v", addr, err)
+			continue
+		}
+
+		message := model.MessageFromProtobuf(pb)
+		message.ReceivedTime = time.Now().UnixMilli()
+		message.PacketSize = n
+		message.Payload = append([]byte(nil), buffer[:n]...)
+		message.SourceAddr = addr.String()
+
+		err = u.pipeline.Publish(u.ctx, message)
+		if err != nil {
+			log.Printf("error publishing message from %v: %v", addr, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package udplistener
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	aqv1 "github.com/lab5e/aqserver/pkg/aq/v1"
+	"github.com/lab5e/aqserver/pkg/model"
+	"github.com/lab5e/aqserver/pkg/pipeline"
+	"github.com/lab5e/aqserver/pkg/pipeline/circular"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPListener(t *testing.T) {
+	root := pipeline.New(nil)
+	buffer := circular.New(10)
+	root.AddNext(buffer)
+
+	listener, err := Create(context.Background(), root, "127.0.0.1:0", 1024)
+	assert.Nil(t, err)
+	assert.NotNil(t, listener)
+
+	data, err := model.DataFromProtobuf(&aqv1.Sample{Sysid: 42, Sensor_1Work: 1234})
+	assert.Nil(t, err)
+
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write(data)
+	assert.Nil(t, err)
+
+	var msgs []*model.Message
+	for i := 0; i < 100 && len(msgs) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		msgs = buffer.GetContents()
+	}
+	assert.Equal(t, 1, len(msgs))
+	assert.Equal(t, uint64(42), msgs[0].SysID)
+	assert.Equal(t, uint32(1234), msgs[0].Sensor1Work)
+	assert.Equal(t, len(data), msgs[0].PacketSize)
+	assert.Equal(t, conn.LocalAddr().String(), msgs[0].SourceAddr)
+	assert.NotZero(t, msgs[0].ReceivedTime)
+
+	listener.Shutdown()
+	listener.WaitForShutdown()
+}
+
+func TestCreateErrors(t *testing.T) {
+	_, err := Create(context.Background(), nil, "127.0.0.1:0", 1024)
+	assert.Equal(t, ErrPipelineNil, err)
+
+	_, err = Create(context.Background(), pipeline.New(nil), "127.0.0.1:0", 0)
+	assert.Equal(t, ErrInvalidBufferSize, err)
+}